@@ -22,6 +22,8 @@ import (
 	"os"
 	"reflect"
 	"sort"
+	"strconv"
+	"time"
 
 	"go.universe.tf/metallb/internal/allocator"
 	"go.universe.tf/metallb/internal/bgp"
@@ -37,6 +39,8 @@ import (
 type service interface {
 	Infof(svc *v1.Service, desc, msg string, args ...interface{})
 	Errorf(svc *v1.Service, desc, msg string, args ...interface{})
+	NodeLabels(name string) (map[string]string, error)
+	RequeueAfter(name string, d time.Duration)
 }
 
 type controller struct {
@@ -46,9 +50,14 @@ type controller struct {
 
 	config *config.Config
 	peers  []*peer
-	svcAds map[string][]*bgp.Advertisement
+	svcAds map[string][]*advertisement
 	ips    *allocator.Allocator
 
+	// For pools with an AnnounceDelay, when each pending service may
+	// be announced, and when the pool's next new announcement may be.
+	announceAt map[string]time.Time
+	poolNext   map[string]time.Time
+
 	// Metrics
 	announcing *prometheus.GaugeVec
 }
@@ -58,6 +67,44 @@ type peer struct {
 	bgp *bgp.Session
 }
 
+// advertisement is a BGP advertisement, along with the peer groups
+// it should be sent to.
+type advertisement struct {
+	*bgp.Advertisement
+	// The configuration ad was made from, which decides what peers
+	// it goes to.
+	cfg *config.Advertisement
+}
+
+// wants returns true if p should receive ad.
+func (ad *advertisement) wants(p *peer) bool {
+	return ad.cfg.SendsTo(p.cfg)
+}
+
+// withCommunities returns ad with p's own communities added, and
+// its strip communities removed.
+func (p *peer) withCommunities(ad *bgp.Advertisement) *bgp.Advertisement {
+	if len(p.cfg.Communities) == 0 && len(p.cfg.StripCommunities) == 0 {
+		return ad
+	}
+	comms := map[uint32]bool{}
+	for _, c := range ad.Communities {
+		if !p.cfg.StripCommunities[c] {
+			comms[c] = true
+		}
+	}
+	for c := range p.cfg.Communities {
+		comms[c] = true
+	}
+	ret := *ad
+	ret.Communities = nil
+	for c := range comms {
+		ret.Communities = append(ret.Communities, c)
+	}
+	sort.Slice(ret.Communities, func(i, j int) bool { return ret.Communities[i] < ret.Communities[j] })
+	return &ret
+}
+
 func (c *controller) SetBalancer(name string, svc *v1.Service, eps *v1.Endpoints) error {
 	if svc == nil {
 		return c.deleteBalancer(name, "service deleted")
@@ -103,23 +150,69 @@ func (c *controller) SetBalancer(name string, svc *v1.Service, eps *v1.Endpoints
 	if pool == nil {
 		glog.Errorf("%s: could not find pool %q that definitely should exist!", name, poolName)
 	}
+	if !pool.Speaks(config.BGP) {
+		glog.Infof("%s: pool %q does not use BGP", name, poolName)
+		return c.deleteBalancer(name, "pool does not use BGP")
+	}
+
+	if _, announced := c.svcAds[name]; !announced && pool.AnnounceDelay > 0 {
+		// Each new announcement of the pool is scheduled
+		// AnnounceDelay after the previous one, and the service is
+		// requeued until then, so other work isn't held up.
+		at, ok := c.announceAt[name]
+		if !ok {
+			at = time.Now()
+			if next := c.poolNext[poolName]; next.After(at) {
+				at = next
+			}
+			at = at.Add(pool.AnnounceDelay)
+			c.announceAt[name] = at
+			c.poolNext[poolName] = at
+		}
+		if wait := time.Until(at); wait > 0 {
+			glog.Infof("%s: waiting %s before announcing", name, wait)
+			c.client.RequeueAfter(name, wait)
+			return nil
+		}
+	}
+	delete(c.announceAt, name)
 
 	c.svcAds[name] = nil
 	for _, adCfg := range pool.Advertisements {
+		if !adCfg.Enabled || !adCfg.CoversIP(lbIP) {
+			continue
+		}
 		m := net.CIDRMask(adCfg.AggregationLength, 32)
+		var comms []uint32
+		for _, comm := range adCfg.SortedCommunities() {
+			if !adCfg.RemoveCommunities[comm] {
+				comms = append(comms, comm)
+			}
+		}
 		ad := &bgp.Advertisement{
 			Prefix: &net.IPNet{
 				IP:   lbIP.Mask(m),
 				Mask: m,
 			},
-			NextHop:   c.myIP,
-			LocalPref: adCfg.LocalPref,
+			NextHop:     c.myIP,
+			LocalPref:   adCfg.LocalPref,
+			Communities: comms,
+			Origin:      bgpOrigins[adCfg.Origin],
 		}
-		for comm := range adCfg.Communities {
-			ad.Communities = append(ad.Communities, comm)
+		for comm := range adCfg.LargeCommunities {
+			ad.LargeCommunities = append(ad.LargeCommunities, bgp.LargeCommunity(comm))
 		}
-		sort.Slice(ad.Communities, func(i, j int) bool { return ad.Communities[i] < ad.Communities[j] })
-		c.svcAds[name] = append(c.svcAds[name], ad)
+		sort.Slice(ad.LargeCommunities, func(i, j int) bool {
+			a, b := ad.LargeCommunities[i], ad.LargeCommunities[j]
+			if a.GlobalAdmin != b.GlobalAdmin {
+				return a.GlobalAdmin < b.GlobalAdmin
+			}
+			if a.LocalData1 != b.LocalData1 {
+				return a.LocalData1 < b.LocalData1
+			}
+			return a.LocalData2 < b.LocalData2
+		})
+		c.svcAds[name] = append(c.svcAds[name], &advertisement{ad, adCfg})
 	}
 
 	glog.Infof("%s: announcable, making %d advertisements", name, len(c.svcAds[name]))
@@ -166,18 +259,28 @@ func (c *controller) nodeHasHealthyEndpoint(eps *v1.Endpoints) bool {
 }
 
 func (c *controller) updateAds() error {
-	var allAds []*bgp.Advertisement
-	for _, ads := range c.svcAds {
-		// This list might contain duplicates, but that's fine,
-		// they'll get compacted by the session code when it's
-		// calculating advertisements.
-		//
-		// TODO: be more intelligent about compacting advertisements
-		// and detecting conflicting advertisements.
-		allAds = append(allAds, ads...)
-	}
 	for _, peer := range c.peers {
-		if err := peer.bgp.Set(allAds...); err != nil {
+		var peerAds []*bgp.Advertisement
+		for _, ads := range c.svcAds {
+			// This list might contain duplicates, but that's fine,
+			// they'll get compacted by the session code when it's
+			// calculating advertisements.
+			//
+			// TODO: be more intelligent about compacting advertisements
+			// and detecting conflicting advertisements.
+			for _, ad := range ads {
+				if ad.wants(peer) {
+					peerAds = append(peerAds, peer.withCommunities(ad.Advertisement))
+				}
+			}
+		}
+		if peer.cfg.OriginateDefault {
+			peerAds = append(peerAds, peer.withCommunities(&bgp.Advertisement{
+				Prefix:  defaultRoute,
+				NextHop: c.myIP,
+			}))
+		}
+		if err := peer.bgp.Set(peerAds...); err != nil {
 			return err
 		}
 	}
@@ -185,6 +288,11 @@ func (c *controller) updateAds() error {
 }
 
 func (c *controller) deleteBalancer(name, reason string) error {
+	if _, ok := c.announceAt[name]; ok {
+		// Never announced, just drop the pending announcement.
+		delete(c.announceAt, name)
+		c.ips.Unassign(name)
+	}
 	if _, ok := c.svcAds[name]; !ok {
 		return nil
 	}
@@ -213,9 +321,34 @@ func (c *controller) SetConfig(cfg *config.Config) error {
 		return fmt.Errorf("configuration rejected: %s", err)
 	}
 
-	newPeers := make([]*peer, 0, len(cfg.Peers))
+	if err := bgp.SetListenPort(cfg.BGPListenPort); err != nil {
+		glog.Errorf("Changing BGP listen port failed: %s", err)
+		return fmt.Errorf("configuration rejected: %s", err)
+	}
+
+	// A speaker on a node that isn't selected keeps computing
+	// advertisements, but has no peers to send them to. Node labels
+	// are only checked when the config changes.
+	cfgPeers := cfg.Peers
+	if cfg.SpeakerNodeSelector != nil {
+		nodeLabels, err := c.client.NodeLabels(c.myNode)
+		if err != nil {
+			glog.Errorf("Getting labels of node %q failed: %s", c.myNode, err)
+			return fmt.Errorf("getting node labels: %s", err)
+		}
+		if !cfg.SpeakerSelectsNode(nodeLabels) {
+			glog.Infof("Node %q not selected by speaker-node-selector, not peering", c.myNode)
+			cfgPeers = nil
+		}
+	}
+
+	newPeers := make([]*peer, 0, len(cfgPeers))
 newPeers:
-	for _, p := range cfg.Peers {
+	for _, p := range cfgPeers {
+		if !p.Enabled {
+			glog.Infof("Peer %s is disabled, not peering", peerLabel(p))
+			continue
+		}
 		for i, ep := range c.peers {
 			if ep == nil {
 				continue
@@ -240,9 +373,9 @@ newPeers:
 		if p == nil {
 			continue
 		}
-		glog.Infof("Peer %q deconfigured, closing BGP session", p.cfg.Addr)
+		glog.Infof("Peer %q deconfigured, closing BGP session", peerLabel(p.cfg))
 		if err := p.bgp.Close(); err != nil {
-			glog.Warningf("Shutting down BGP session to %q: %s", p.cfg.Addr, err)
+			glog.Warningf("Shutting down BGP session to %q: %s", peerLabel(p.cfg), err)
 		}
 	}
 
@@ -252,10 +385,19 @@ newPeers:
 			continue
 		}
 
-		glog.Infof("Peer %q configured, starting BGP session", p.cfg.Addr)
-		s, err := bgp.New(fmt.Sprintf("%s:%d", p.cfg.Addr, p.cfg.Port), p.cfg.MyASN, c.myIP, p.cfg.ASN, p.cfg.HoldTime)
+		glog.Infof("Peer %q configured, starting BGP session", peerLabel(p.cfg))
+		// Hostnames are handed to the session unresolved, so that
+		// every connection attempt picks up DNS changes.
+		addr := net.JoinHostPort(peerAddr(p.cfg), strconv.Itoa(int(p.cfg.Port)))
+		s, err := bgp.New(addr, p.cfg.MyASN, c.myIP, p.cfg.ASN, p.cfg.HoldTime, p.cfg.KeepaliveTime, p.cfg.ConnectRetryTime, bgp.SessionOptions{
+			MRAI:            p.cfg.MRAI,
+			Passive:         p.cfg.Passive,
+			MinTTL:          p.cfg.MinTTL,
+			Disable4ByteASN: p.cfg.Disable4ByteASN,
+			RouteRefresh:    p.cfg.RouteRefresh,
+		})
 		if err != nil {
-			errs = append(errs, fmt.Errorf("Creating BGP session to %q: %s", p.cfg.Addr, err))
+			errs = append(errs, fmt.Errorf("Creating BGP session to %q: %s", peerLabel(p.cfg), err))
 		} else {
 			p.bgp = s
 		}
@@ -267,7 +409,38 @@ newPeers:
 		return fmt.Errorf("%d new BGP sessions failed to start", len(errs))
 	}
 
-	return nil
+	// Bring new peers up to date right away, rather than on the next
+	// service update. In particular, peers with originate-default
+	// must get their default route even if there are no services.
+	return c.updateAds()
+}
+
+var defaultRoute = &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+
+var bgpOrigins = map[config.Origin]uint8{
+	config.OriginIGP:        bgp.OriginIGP,
+	config.OriginEGP:        bgp.OriginEGP,
+	config.OriginIncomplete: bgp.OriginIncomplete,
+}
+
+// peerAddr returns the address at which p should be dialed.
+func peerAddr(p *config.Peer) string {
+	if p.AddrHostname != "" {
+		return p.AddrHostname
+	}
+	if p.Zone != "" {
+		return p.Addr.String() + "%" + p.Zone
+	}
+	return p.Addr.String()
+}
+
+// peerLabel returns how p is referred to in logs: its name and
+// address if it has a name, otherwise just the address.
+func peerLabel(p *config.Peer) string {
+	if p.Name != "" {
+		return fmt.Sprintf("%s (%s)", p.Name, peerAddr(p))
+	}
+	return peerAddr(p)
 }
 
 func (c *controller) MarkSynced() {}
@@ -299,9 +472,12 @@ func main() {
 	c := &controller{
 		myIP:   myIP,
 		myNode: *myNode,
-		svcAds: map[string][]*bgp.Advertisement{},
+		svcAds: map[string][]*advertisement{},
 		ips:    allocator.New(),
 
+		announceAt: map[string]time.Time{},
+		poolNext:   map[string]time.Time{},
+
 		announcing: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Namespace: "metallb",
 			Subsystem: "speaker",
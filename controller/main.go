@@ -113,6 +113,7 @@ func (c *controller) SetConfig(cfg *config.Config) error {
 		glog.Errorf("Applying new configuration failed: %s", err)
 		return fmt.Errorf("configuration rejected: %s", err)
 	}
+	c.ips.SetExcludedAddresses(cfg.ExcludeAddresses)
 	c.config = cfg
 	return nil
 }
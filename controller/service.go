@@ -18,6 +18,9 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strings"
+
+	"go.universe.tf/metallb/internal/config"
 
 	"github.com/golang/glog"
 	"k8s.io/api/core/v1"
@@ -113,9 +116,33 @@ func (c *controller) allocateIP(key string, svc *v1.Service) (net.IP, error) {
 		return ip, nil
 	}
 
+	// Pinned addresses always go to their service.
+	if ip := c.config.PinnedAddress(key); ip != nil {
+		if err := c.ips.Assign(key, ip); err != nil {
+			return nil, err
+		}
+		return ip, nil
+	}
+
+	// Pools can be dedicated to a class of services.
+	class := svc.Annotations["metallb.universe.tf/service-class"]
+
+	// Services get IPv4 addresses, unless they ask for IPv6.
+	family := config.IPv4
+	f := svc.Annotations["metallb.universe.tf/ip-family"]
+	if f != "" {
+		family = config.IPFamily(f)
+		if family != config.IPv4 && family != config.IPv6 {
+			return nil, fmt.Errorf("invalid ip-family annotation %q, must be %q or %q", f, config.IPv4, config.IPv6)
+		}
+	}
+
 	// Otherwise, did the user ask for a specific pool?
 	desiredPool := svc.Annotations["metallb.universe.tf/address-pool"]
 	if desiredPool != "" {
+		if pool := c.config.Pools[desiredPool]; pool != nil && !pool.ServesClass(class) {
+			return nil, fmt.Errorf("pool %q does not serve service class %q", desiredPool, class)
+		}
 		ip, err := c.ips.AllocateFromPool(key, desiredPool)
 		if err != nil {
 			return nil, err
@@ -123,6 +150,49 @@ func (c *controller) allocateIP(key string, svc *v1.Service) (net.IP, error) {
 		return ip, nil
 	}
 
-	// Okay, in that case just bruteforce across all pools.
-	return c.ips.Allocate(key)
+	// Did the user list preferred pools?
+	if prefs := svc.Annotations["metallb.universe.tf/preferred-pools"]; prefs != "" {
+		var preferred []string
+		for _, p := range strings.Split(prefs, ",") {
+			preferred = append(preferred, strings.TrimSpace(p))
+		}
+		// Use the first preferred pool that has room.
+		pools := c.config.EligiblePools(preferred, family, class, svc.Labels)
+		if len(pools) == 0 {
+			return nil, fmt.Errorf("no auto-assignable %s pool among preferred pools %q", family, preferred)
+		}
+		for _, pool := range pools {
+			if ip, err := c.ips.AllocateFromPool(key, pool); err == nil {
+				return ip, nil
+			}
+		}
+		return nil, fmt.Errorf("no addresses available in preferred pools %q", pools)
+	}
+
+	// Without an explicit family, any pool will do, as before
+	// ip-family existed.
+	var eligible []string
+	for _, name := range c.config.PoolNames() {
+		if pool := c.config.Pools[name]; pool.AutoAssign && pool.ServesClass(class) && pool.SelectsService(svc.Labels) && (f == "" || pool.HasFamily(family)) {
+			eligible = append(eligible, name)
+		}
+	}
+
+	// Okay, in that case pick a pool according to the configured
+	// weights, and fall back to bruteforcing across all eligible
+	// pools if it turns out to be full.
+	if pool := c.config.PickWeightedPool(eligible); pool != "" {
+		if ip, err := c.ips.AllocateFromPool(key, pool); err == nil {
+			return ip, nil
+		}
+	}
+	for _, pool := range eligible {
+		if ip, err := c.ips.AllocateFromPool(key, pool); err == nil {
+			return ip, nil
+		}
+	}
+	if class != "" {
+		return nil, fmt.Errorf("no addresses available in any pool for service class %q", class)
+	}
+	return nil, errors.New("no addresses available in any pool")
 }
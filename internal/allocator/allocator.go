@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"math/rand"
 	"net"
 
 	"go.universe.tf/metallb/internal/config"
@@ -11,7 +12,8 @@ import (
 
 // An Allocator tracks IP address pools and allocates addresses from them.
 type Allocator struct {
-	pools map[string]*config.Pool
+	pools    map[string]*config.Pool
+	excluded []*net.IPNet
 
 	svcToIP       map[string]net.IP
 	svcToPool     map[string]string
@@ -66,40 +68,50 @@ func (a *Allocator) SetPools(pools map[string]*config.Pool) error {
 	return nil
 }
 
-// poolCount returns the number of addresses in the pool.
+// SetExcludedAddresses updates the set of addresses that the
+// allocator must never hand out automatically. Explicit assignments
+// with Assign are still permitted.
+func (a *Allocator) SetExcludedAddresses(cidrs []*net.IPNet) {
+	a.excluded = cidrs
+}
+
+// isExcluded returns true if ip must not be automatically allocated.
+func (a *Allocator) isExcluded(ip net.IP) bool {
+	for _, cidr := range a.excluded {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// poolCount returns the number of addresses in the pool, capped at
+// the largest int64 for huge IPv6 pools.
 func poolCount(p *config.Pool) int64 {
-	var total int64
-	for _, cidr := range p.CIDR {
-		o, b := cidr.Mask.Size()
-		sz := int64(math.Pow(2, float64(b-o)))
-		if p.AvoidBuggyIPs {
-			if o <= 24 {
-				// A pair of buggy IPs occur for each /24 present in the range.
-				buggies := int64(math.Pow(2, float64(24-o))) * 2
-				sz -= buggies
-			} else {
-				// Ranges smaller than /24 contain 1 buggy IP if they
-				// start/end on a /24 boundary, otherwise they contain
-				// none.
-				ip := cidr.IP.Mask(cidr.Mask).To4()
-				if ipConfusesBuggyFirmwares(ip) {
-					sz--
-				}
-				ip[3] += byte(math.Pow(2, float64(b-o)))
-				if ipConfusesBuggyFirmwares(ip) {
-					sz--
-				}
-			}
+	sz := p.Size()
+	if sz.BitLen() > 63 {
+		return math.MaxInt64
+	}
+	return sz.Int64()
+}
+
+// isReserved returns true if ip is one of p's reserved addresses.
+func isReserved(p *config.Pool, ip net.IP) bool {
+	for _, cidr := range p.Reserved {
+		if cidr.Contains(ip) {
+			return true
 		}
-		total += sz
 	}
-	return total
+	return false
 }
 
 // poolFor returns the pool that owns the requested IP, or "" if none.
 func poolFor(pools map[string]*config.Pool, service string, ip net.IP) string {
 	for pname, p := range pools {
-		if ipConfusesBuggyFirmwares(ip) && p.AvoidBuggyIPs {
+		if p.AvoidsIP(ip) {
+			continue
+		}
+		if isReserved(p, ip) {
 			continue
 		}
 		for _, cidr := range p.CIDR {
@@ -136,6 +148,9 @@ func (a *Allocator) Assign(service string, ip net.IP) error {
 	if pool == "" {
 		return fmt.Errorf("cannot assign %q to %q, no pool owns that IP", ip, service)
 	}
+	if other := a.pools[pool].PinnedTo(ip); other != "" && other != service {
+		return fmt.Errorf("cannot assign %q to %q, it is pinned to %q", ip, service, other)
+	}
 
 	// If the service already has another assignment, clear it. This
 	// is idempotent, so won't do harm if there's no allocation.
@@ -147,20 +162,93 @@ func (a *Allocator) Assign(service string, ip net.IP) error {
 // allocateFromPool tries to allocate an IP from pool. Returns nil if no IPs are available.
 func (a *Allocator) allocateFromPool(service, pname string) net.IP {
 	pool := a.pools[pname]
-	for _, cidr := range pool.CIDR {
-		for ip := cidr.IP; cidr.Contains(ip); ip = nextIP(ip) {
-			if pool.AvoidBuggyIPs && ipConfusesBuggyFirmwares(ip) {
-				continue
+	var ret net.IP
+	forEachIP(pool, service, func(ip net.IP) bool {
+		if pool.AvoidsIP(ip) {
+			return false
+		}
+		if isReserved(pool, ip) || a.isExcluded(ip) {
+			return false
+		}
+		if a.ipToSvc[ip.String()] != "" {
+			return false
+		}
+		if other := pool.PinnedTo(ip); other != "" && other != service {
+			return false
+		}
+		a.assign(service, pname, ip)
+		ret = ip
+		return true
+	})
+	return ret
+}
+
+// forEachIP calls fn with each IP in pool, in the order dictated by
+// the pool's allocation strategy, until fn returns true. The hashed
+// strategy starts from the address derived from service.
+func forEachIP(pool *config.Pool, service string, fn func(net.IP) bool) {
+	if len(pool.CIDR) == 0 {
+		return
+	}
+
+	switch pool.AllocationStrategy {
+	case config.AllocateHighest:
+		for i := len(pool.CIDR) - 1; i >= 0; i-- {
+			cidr := pool.CIDR[i]
+			for ip := lastIP(cidr); cidr.Contains(ip); ip = prevIP(ip) {
+				if fn(ip) {
+					return
+				}
 			}
-			if a.ipToSvc[ip.String()] == "" {
-				a.assign(service, pname, ip)
-				return ip
+		}
+
+	case config.AllocateRandom, config.AllocateHashed:
+		// Start at a random (or hashed) address, and scan upwards
+		// from there, wrapping around through the other CIDRs until
+		// we're back where we started.
+		var (
+			start int
+			first net.IP
+		)
+		if pool.AllocationStrategy == config.AllocateRandom {
+			start = rand.Intn(len(pool.CIDR))
+			first = randomIP(pool.CIDR[start])
+		} else {
+			var err error
+			if first, err = pool.HashedIP(service); err != nil {
+				return
+			}
+			for start = range pool.CIDR {
+				if pool.CIDR[start].Contains(first) {
+					break
+				}
+			}
+		}
+		for i := 0; i <= len(pool.CIDR); i++ {
+			cidr := pool.CIDR[(start+i)%len(pool.CIDR)]
+			ip := cidr.IP
+			if i == 0 {
+				ip = first
+			}
+			for ; cidr.Contains(ip); ip = nextIP(ip) {
+				if i == len(pool.CIDR) && ip.Equal(first) {
+					return
+				}
+				if fn(ip) {
+					return
+				}
 			}
 		}
-	}
 
-	// No IPs available.
-	return nil
+	default:
+		for _, cidr := range pool.CIDR {
+			for ip := cidr.IP; cidr.Contains(ip); ip = nextIP(ip) {
+				if fn(ip) {
+					return
+				}
+			}
+		}
+	}
 }
 
 // AllocateFromPool assigns an available IP from pool to service.
@@ -229,14 +317,49 @@ func nextIP(prev net.IP) net.IP {
 	return ip
 }
 
-// ipConfusesBuggyFirmwares returns true if ip is an IPv4 address ending in 0 or 255.
-//
-// Such addresses can confuse smurf protection on crappy CPE
-// firmwares, leaving to packet drops.
-func ipConfusesBuggyFirmwares(ip net.IP) bool {
-	ip = ip.To4()
-	if ip == nil {
-		return false
+// prevIP returns the previous IP in sequence before next.
+func prevIP(next net.IP) net.IP {
+	var ip net.IP
+	ip = append(ip, next...)
+	if ip.To4() != nil {
+		ip = ip.To4()
+	}
+	for o := 0; o < len(ip); o++ {
+		if ip[len(ip)-o-1] != 0 {
+			ip[len(ip)-o-1]--
+			return ip
+		}
+		ip[len(ip)-o-1] = 255
+	}
+	return ip
+}
+
+// lastIP returns the highest IP in cidr.
+func lastIP(cidr *net.IPNet) net.IP {
+	base := cidrBase(cidr)
+	ip := make(net.IP, len(base))
+	for i := range ip {
+		ip[i] = base[i] | ^cidr.Mask[i]
+	}
+	return ip
+}
+
+// randomIP returns a random IP in cidr.
+func randomIP(cidr *net.IPNet) net.IP {
+	base := cidrBase(cidr)
+	ip := make(net.IP, len(base))
+	rand.Read(ip)
+	for i := range ip {
+		ip[i] = base[i] | (ip[i] &^ cidr.Mask[i])
+	}
+	return ip
+}
+
+// cidrBase returns cidr's network address, in the same form as its
+// mask.
+func cidrBase(cidr *net.IPNet) net.IP {
+	if len(cidr.Mask) == net.IPv4len {
+		return cidr.IP.To4()
 	}
-	return ip[net.IPv4len-1] == 0 || ip[net.IPv4len-1] == 255
+	return cidr.IP.To16()
 }
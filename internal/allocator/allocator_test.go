@@ -305,6 +305,245 @@ func TestBuggyIPs(t *testing.T) {
 
 }
 
+func TestPoolCountIncludeNetworkBroadcast(t *testing.T) {
+	tests := []struct {
+		network, broadcast bool
+		want               int64
+	}{
+		{false, false, 254},
+		{true, false, 255},
+		{false, true, 255},
+		{true, true, 256},
+	}
+	for _, test := range tests {
+		p := pool("test", true, "1.2.3.0/24")["test"]
+		p.IncludeNetwork = test.network
+		p.IncludeBroadcast = test.broadcast
+		if got := poolCount(p); got != test.want {
+			t.Errorf("include-network=%v include-broadcast=%v: poolCount = %d, want %d", test.network, test.broadcast, got, test.want)
+		}
+	}
+}
+
+func TestReservedIPs(t *testing.T) {
+	alloc := New()
+	p := pool("test", false, "1.2.3.0/30")
+	p["test"].Reserved = []*net.IPNet{ipnet("1.2.3.0/31")}
+	if err := alloc.SetPools(p); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+
+	if err := alloc.Assign("s1", net.ParseIP("1.2.3.1")); err == nil {
+		t.Errorf("assigning reserved IP 1.2.3.1 succeeded, should have failed")
+	}
+
+	validIPs := map[string]bool{
+		"1.2.3.2": true,
+		"1.2.3.3": true,
+	}
+	for _, svc := range []string{"s1", "s2"} {
+		ip, err := alloc.Allocate(svc)
+		if err != nil {
+			t.Fatalf("Allocate(%q): %s", svc, err)
+		}
+		if !validIPs[ip.String()] {
+			t.Errorf("Allocate(%q) allocated unexpected IP %q", svc, ip)
+		}
+	}
+	if ip, err := alloc.Allocate("s3"); err == nil {
+		t.Errorf("Allocate(\"s3\") allocated %q from exhausted pool", ip)
+	}
+
+	if got := poolCount(p["test"]); got != 2 {
+		t.Errorf("poolCount = %d, want 2", got)
+	}
+}
+
+func TestPinnedIPs(t *testing.T) {
+	alloc := New()
+	p := pool("test", false, "1.2.3.0/31")
+	p["test"].PinnedAddresses = []config.PinnedAddress{{IP: net.ParseIP("1.2.3.0").To4(), Service: "ns/pinned"}}
+	if err := alloc.SetPools(p); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+
+	if err := alloc.Assign("s1", net.ParseIP("1.2.3.0")); err == nil {
+		t.Errorf("assigning IP pinned to another service succeeded, should have failed")
+	}
+	ip, err := alloc.Allocate("s1")
+	if err != nil {
+		t.Fatalf("Allocate(\"s1\"): %s", err)
+	}
+	if ip.String() != "1.2.3.1" {
+		t.Errorf("Allocate(\"s1\") allocated %q, want 1.2.3.1", ip)
+	}
+	if ip, err := alloc.Allocate("s2"); err == nil {
+		t.Errorf("Allocate(\"s2\") allocated pinned IP %q", ip)
+	}
+	if err := alloc.Assign("ns/pinned", net.ParseIP("1.2.3.0")); err != nil {
+		t.Errorf("assigning pinned IP to its service failed: %s", err)
+	}
+}
+
+func TestExcludedIPs(t *testing.T) {
+	alloc := New()
+	if err := alloc.SetPools(pool("test", false, "1.2.3.0/30")); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+	alloc.SetExcludedAddresses([]*net.IPNet{ipnet("1.2.3.0/31")})
+
+	validIPs := map[string]bool{
+		"1.2.3.2": true,
+		"1.2.3.3": true,
+	}
+	for _, svc := range []string{"s1", "s2"} {
+		ip, err := alloc.Allocate(svc)
+		if err != nil {
+			t.Fatalf("Allocate(%q): %s", svc, err)
+		}
+		if !validIPs[ip.String()] {
+			t.Errorf("Allocate(%q) allocated unexpected IP %q", svc, ip)
+		}
+	}
+	if ip, err := alloc.Allocate("s3"); err == nil {
+		t.Errorf("Allocate(\"s3\") allocated excluded IP %q", ip)
+	}
+
+	// Explicitly requested IPs are not subject to exclusion.
+	if err := alloc.Assign("s3", net.ParseIP("1.2.3.1")); err != nil {
+		t.Errorf("Assign(\"s3\", 1.2.3.1): %s", err)
+	}
+}
+
+func TestAllocationStrategy(t *testing.T) {
+	tests := []struct {
+		strategy config.AllocationStrategy
+		want     []string
+	}{
+		{
+			strategy: "",
+			want:     []string{"1.2.3.0", "1.2.3.1", "1.2.3.2", "1.2.3.3", "1.2.4.0", "1.2.4.1"},
+		},
+		{
+			strategy: config.AllocateLowest,
+			want:     []string{"1.2.3.0", "1.2.3.1", "1.2.3.2", "1.2.3.3", "1.2.4.0", "1.2.4.1"},
+		},
+		{
+			strategy: config.AllocateHighest,
+			want:     []string{"1.2.4.1", "1.2.4.0", "1.2.3.3", "1.2.3.2", "1.2.3.1", "1.2.3.0"},
+		},
+	}
+
+	for _, test := range tests {
+		alloc := New()
+		p := pool("test", false, "1.2.3.0/30", "1.2.4.0/31")
+		p["test"].AllocationStrategy = test.strategy
+		if err := alloc.SetPools(p); err != nil {
+			t.Fatalf("SetPools: %s", err)
+		}
+		for i, want := range test.want {
+			ip, err := alloc.Allocate(fmt.Sprintf("s%d", i))
+			if err != nil {
+				t.Fatalf("%q: allocation #%d failed: %s", test.strategy, i+1, err)
+			}
+			if ip.String() != want {
+				t.Errorf("%q: allocation #%d got %q, want %q", test.strategy, i+1, ip, want)
+			}
+		}
+	}
+
+	// Random allocation must still eventually hand out every
+	// address, exactly once.
+	alloc := New()
+	p := pool("test", false, "1.2.3.0/30", "1.2.4.0/31")
+	p["test"].AllocationStrategy = config.AllocateRandom
+	if err := alloc.SetPools(p); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+	seen := map[string]bool{}
+	for i := 0; i < 6; i++ {
+		ip, err := alloc.Allocate(fmt.Sprintf("s%d", i))
+		if err != nil {
+			t.Fatalf("random: allocation #%d failed: %s", i+1, err)
+		}
+		if seen[ip.String()] {
+			t.Errorf("random: allocation #%d returned duplicate IP %q", i+1, ip)
+		}
+		if !ipnet("1.2.3.0/30").Contains(ip) && !ipnet("1.2.4.0/31").Contains(ip) {
+			t.Errorf("random: allocation #%d returned IP %q outside of pool", i+1, ip)
+		}
+		seen[ip.String()] = true
+	}
+	if ip, err := alloc.Allocate("s6"); err == nil {
+		t.Errorf("random: allocated %q from exhausted pool", ip)
+	}
+
+	hashed := pool("test", false, "1.2.3.0/30")
+	hashed["test"].AllocationStrategy = config.AllocateHashed
+	alloc = New()
+	if err := alloc.SetPools(hashed); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+	want, err := hashed["test"].HashedIP("ns/web")
+	if err != nil {
+		t.Fatalf("HashedIP: %s", err)
+	}
+	// Another service already holds the hashed address, so ns/web
+	// gets the next one.
+	if err := alloc.Assign("ns/other", want); err != nil {
+		t.Fatalf("Assign: %s", err)
+	}
+	next := ipnet("1.2.3.0/30").IP.To4()
+	next[3] = (want.To4()[3] + 1) % 4
+	ip, err := alloc.Allocate("ns/web")
+	if err != nil {
+		t.Fatalf("hashed: allocation failed: %s", err)
+	}
+	if !ip.Equal(next) {
+		t.Errorf("hashed: allocated %q on collision, want %q", ip, next)
+	}
+	alloc.Unassign("ns/other")
+	alloc.Unassign("ns/web")
+	if ip, err := alloc.Allocate("ns/web"); err != nil || !ip.Equal(want) {
+		t.Errorf("hashed: allocated %q (err %v) once free, want %q", ip, err, want)
+	}
+}
+
+func TestCIDROrder(t *testing.T) {
+	tests := []struct {
+		order string
+		want  string
+	}{
+		{"sorted", "1.2.3.0"},
+		{"listed", "1.2.4.0"},
+	}
+
+	for _, test := range tests {
+		cfg, err := config.Parse([]byte(fmt.Sprintf(`
+address-pools:
+- name: test
+  cidr-order: %s
+  cidr:
+  - 1.2.4.0/31
+  - 1.2.3.0/30
+`, test.order)))
+		if err != nil {
+			t.Fatalf("%q: parse failed: %s", test.order, err)
+		}
+		alloc := New()
+		if err := alloc.SetPools(cfg.Pools); err != nil {
+			t.Fatalf("%q: SetPools: %s", test.order, err)
+		}
+		ip, err := alloc.Allocate("s1")
+		if err != nil {
+			t.Fatalf("%q: allocation failed: %s", test.order, err)
+		}
+		if ip.String() != test.want {
+			t.Errorf("%q: first allocation got %q, want %q", test.order, ip, test.want)
+		}
+	}
+}
+
 func TestNextIP(t *testing.T) {
 	tests := []struct {
 		in, out string
@@ -430,6 +669,14 @@ func assignedPool(a *Allocator, svc string) string {
 	return a.svcToPool[svc]
 }
 
+func ipnet(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(fmt.Sprintf("malformed CIDR %q", s))
+	}
+	return n
+}
+
 func pools(pools ...map[string]*config.Pool) map[string]*config.Pool {
 	ret := map[string]*config.Pool{}
 	for _, p := range pools {
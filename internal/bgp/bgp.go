@@ -16,19 +16,30 @@ import (
 	"github.com/golang/glog"
 )
 
-const (
-	backoff = 2 * time.Second
-)
-
 var errClosed = errors.New("session closed")
 
 // Session represents one BGP session to an external router.
 type Session struct {
-	asn      uint32
-	routerID net.IP
-	addr     string
-	peerASN  uint32
-	holdTime time.Duration
+	asn       uint32
+	routerID  net.IP
+	addr      string
+	peerASN   uint32
+	holdTime  time.Duration
+	keepalive time.Duration
+	backoff   time.Duration
+	mrai      time.Duration
+	passive   bool
+	minTTL    uint8
+	// If false, the 4-byte ASN capability (RFC 6793) is not
+	// offered, and ASNs are encoded in 2 bytes.
+	fourByteASN bool
+	// If true, the route refresh capability (RFC 2918) is offered,
+	// and the peer may ask for all advertisements to be resent.
+	routeRefresh bool
+
+	// For passive sessions, inbound connections from the peer.
+	incoming chan net.Conn
+	done     chan struct{}
 
 	newHoldTime chan bool
 
@@ -47,8 +58,11 @@ func (s *Session) run() {
 	defer stats.DeleteSession(s.addr)
 	for {
 		if err := s.connect(); err != nil {
+			if err == errClosed {
+				return
+			}
 			glog.Error(err)
-			time.Sleep(backoff)
+			time.Sleep(s.backoff)
 			continue
 		}
 		stats.SessionUp(s.addr)
@@ -82,7 +96,7 @@ func (s *Session) sendUpdates() error {
 	}
 
 	for c, adv := range s.advertised {
-		if err := sendUpdate(s.conn, asn, adv); err != nil {
+		if err := sendUpdate(s.conn, asn, s.fourByteASN, adv); err != nil {
 			s.abort()
 			return fmt.Errorf("sending update of %q to %q: %s", c, s.addr, err)
 		}
@@ -114,7 +128,7 @@ func (s *Session) sendUpdates() error {
 				continue
 			}
 
-			if err := sendUpdate(s.conn, asn, adv); err != nil {
+			if err := sendUpdate(s.conn, asn, s.fourByteASN, adv); err != nil {
 				s.abort()
 				return fmt.Errorf("sending update of %q to %q: %s", c, s.addr, err)
 			}
@@ -136,26 +150,58 @@ func (s *Session) sendUpdates() error {
 		}
 		s.advertised, s.new = s.new, nil
 		stats.AdvertisedPrefixes(s.addr, len(s.advertised))
+
+		if s.mrai > 0 {
+			// Hold off the next batch, letting changes in the
+			// meantime coalesce in s.new.
+			s.mu.Unlock()
+			select {
+			case <-time.After(s.mrai):
+			case <-s.done:
+			}
+			s.mu.Lock()
+		}
 	}
 }
 
 // connect establishes the BGP session with the peer.
 func (s *Session) connect() error {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if s.passive {
+		// Waiting for the peer can take arbitrarily long, don't hold
+		// the lock while doing so.
+		if conn, err = s.accept(); err != nil {
+			return err
+		}
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	var d net.Dialer
-	conn, err := d.DialContext(ctx, "tcp", s.addr)
-	if err != nil {
-		return fmt.Errorf("dial %q: %s", s.addr, err)
+	if conn == nil {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", s.addr)
+		if err != nil {
+			return fmt.Errorf("dial %q: %s", s.addr, err)
+		}
 	}
 	deadline, _ := ctx.Deadline()
 	conn.SetDeadline(deadline)
 
-	if err := sendOpen(conn, s.asn, s.routerID, s.holdTime); err != nil {
+	if s.minTTL > 0 {
+		if err := setMinTTL(conn, s.minTTL); err != nil {
+			conn.Close()
+			return fmt.Errorf("set TTL security on connection to %q: %s", s.addr, err)
+		}
+	}
+
+	if err := sendOpen(conn, s.asn, s.routerID, s.holdTime, s.fourByteASN, s.routeRefresh); err != nil {
 		conn.Close()
 		return fmt.Errorf("send OPEN to %q: %s", s.addr, err)
 	}
@@ -209,6 +255,7 @@ func (s *Session) sendKeepalives() {
 		case <-s.newHoldTime:
 			s.mu.Lock()
 			ht := s.actualHoldTime
+			ka := s.keepalive
 			s.mu.Unlock()
 			if t != nil {
 				t.Stop()
@@ -216,7 +263,13 @@ func (s *Session) sendKeepalives() {
 				ch = nil
 			}
 			if ht != 0 {
-				t = time.NewTicker(ht / 3)
+				// The peer may have negotiated a shorter hold time
+				// than we asked for, in which case our configured
+				// keepalive interval may be too slow.
+				if ka == 0 || ka >= ht {
+					ka = ht / 3
+				}
+				t = time.NewTicker(ka)
 				ch = t.C
 			}
 
@@ -251,23 +304,63 @@ func (s *Session) sendKeepalive() error {
 	return nil
 }
 
+// SessionOptions are the optional parameters of a Session. The zero
+// value is an active session with no MRAI, no TTL security, 4-byte
+// ASNs and no route refresh.
+type SessionOptions struct {
+	// Successive batches of updates are at least MRAI (the Minimum
+	// Route Advertisement Interval) apart.
+	MRAI time.Duration
+	// If true, the session waits for the peer to connect, instead of
+	// connecting itself, and addr must be an IP:port.
+	Passive bool
+	// A nonzero MinTTL enables TTL security (RFC 5082), rejecting
+	// packets from the peer whose TTL is below MinTTL.
+	MinTTL uint8
+	// If true, the session is negotiated for legacy peers with 2-byte
+	// ASNs only, and both asn and peerASN must fit in 2 bytes.
+	Disable4ByteASN bool
+	// If true, the peer may ask the session to resend all its
+	// advertisements.
+	RouteRefresh bool
+}
+
 // New creates a BGP session using the given session parameters.
 //
 // The session will immediately try to connect and synchronize its
-// local state with the peer.
-func New(addr string, asn uint32, routerID net.IP, peerASN uint32, holdTime time.Duration) (*Session, error) {
+// local state with the peer, sending keepalives every keepaliveTime
+// once established, and waiting connectRetryTime between failed
+// connection attempts.
+func New(addr string, asn uint32, routerID net.IP, peerASN uint32, holdTime, keepaliveTime, connectRetryTime time.Duration, opts SessionOptions) (*Session, error) {
 	ret := &Session{
-		addr:        addr,
-		asn:         asn,
-		routerID:    routerID.To4(),
-		peerASN:     peerASN,
-		holdTime:    holdTime,
-		newHoldTime: make(chan bool, 1),
-		advertised:  map[string]*Advertisement{},
+		addr:         addr,
+		asn:          asn,
+		routerID:     routerID.To4(),
+		peerASN:      peerASN,
+		holdTime:     holdTime,
+		keepalive:    keepaliveTime,
+		backoff:      connectRetryTime,
+		mrai:         opts.MRAI,
+		passive:      opts.Passive,
+		minTTL:       opts.MinTTL,
+		fourByteASN:  !opts.Disable4ByteASN,
+		routeRefresh: opts.RouteRefresh,
+		incoming:     make(chan net.Conn),
+		done:         make(chan struct{}),
+		newHoldTime:  make(chan bool, 1),
+		advertised:   map[string]*Advertisement{},
 	}
 	if ret.routerID == nil {
 		return nil, fmt.Errorf("invalid routerID %q, must be IPv4", routerID)
 	}
+	if opts.Disable4ByteASN && (asn > 65535 || peerASN > 65535) {
+		return nil, fmt.Errorf("ASNs %d and %d must both fit in 2 bytes when 4-byte ASNs are disabled", asn, peerASN)
+	}
+	if opts.Passive {
+		if err := registerPassive(ret); err != nil {
+			return nil, err
+		}
+	}
 	ret.cond = sync.NewCond(&ret.mu)
 	go ret.sendKeepalives()
 	go ret.run()
@@ -279,8 +372,9 @@ func New(addr string, asn uint32, routerID net.IP, peerASN uint32, holdTime time
 }
 
 // consumeBGP receives BGP messages from the peer, and ignores
-// them. It does minimal checks for the well-formedness of messages,
-// and terminates the connection if something looks wrong.
+// them, except for ROUTE-REFRESH which resends all advertisements. It
+// does minimal checks for the well-formedness of messages, and
+// terminates the connection if something looks wrong.
 func (s *Session) consumeBGP(conn net.Conn) {
 	defer func() {
 		s.mu.Lock()
@@ -310,7 +404,39 @@ func (s *Session) consumeBGP(conn net.Conn) {
 			// TODO: propagate
 			return
 		}
+		if hdr.Type == 5 && s.routeRefresh {
+			// We only speak IPv4 unicast, so there is no need to
+			// look at the AFI/SAFI being refreshed.
+			if err := s.refresh(conn); err != nil {
+				glog.Error(err)
+				return
+			}
+		}
+	}
+}
+
+// refresh resends all current advertisements to the peer on conn,
+// in response to a ROUTE-REFRESH.
+func (s *Session) refresh(conn net.Conn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != conn {
+		// Connection was replaced, the new one gets a full
+		// table anyway.
+		return nil
+	}
+
+	asn := s.asn
+	if s.peerASN == s.asn {
+		asn = 0
+	}
+	for c, adv := range s.advertised {
+		if err := sendUpdate(s.conn, asn, s.fourByteASN, adv); err != nil {
+			return fmt.Errorf("resending update of %q to %q: %s", c, s.addr, err)
+		}
+		stats.UpdateSent(s.addr)
 	}
+	return nil
 }
 
 // Set updates the set of Advertisements that this session's peer should receive.
@@ -363,7 +489,14 @@ func (s *Session) abort() {
 func (s *Session) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
 	s.closed = true
+	close(s.done)
+	if s.passive {
+		unregisterPassive(s)
+	}
 	s.abort()
 	return nil
 }
@@ -379,8 +512,26 @@ type Advertisement struct {
 	LocalPref uint32
 	// BGP communities to attach to the path.
 	Communities []uint32
+	// BGP large communities to attach to the path.
+	LargeCommunities []LargeCommunity
+	// Value of the ORIGIN path attribute.
+	Origin uint8
+}
+
+// LargeCommunity is a BGP large community, per RFC 8092.
+type LargeCommunity struct {
+	GlobalAdmin uint32
+	LocalData1  uint32
+	LocalData2  uint32
 }
 
+// Values of the ORIGIN path attribute, per RFC 4271.
+const (
+	OriginIGP        uint8 = 0
+	OriginEGP        uint8 = 1
+	OriginIncomplete uint8 = 2
+)
+
 // Equal returns true if a and b are equivalent advertisements.
 func (a *Advertisement) Equal(b *Advertisement) bool {
 	if a.Prefix.String() != b.Prefix.String() {
@@ -392,5 +543,11 @@ func (a *Advertisement) Equal(b *Advertisement) bool {
 	if a.LocalPref != b.LocalPref {
 		return false
 	}
-	return reflect.DeepEqual(a.Communities, b.Communities)
+	if a.Origin != b.Origin {
+		return false
+	}
+	if !reflect.DeepEqual(a.Communities, b.Communities) {
+		return false
+	}
+	return reflect.DeepEqual(a.LargeCommunities, b.LargeCommunities)
 }
@@ -76,7 +76,7 @@ func TestInterop(t *testing.T) {
 		t.Fatalf("starting GoBGP: %s", err)
 	}
 
-	sess, err := New("127.0.0.1:4179", 64543, net.ParseIP("2.3.4.5"), 64543, 10*time.Second)
+	sess, err := New("127.0.0.1:4179", 64543, net.ParseIP("2.3.4.5"), 64543, 10*time.Second, 3*time.Second, 2*time.Second, SessionOptions{RouteRefresh: true})
 	if err != nil {
 		t.Fatalf("starting BGP session to GoBGP: %s", err)
 	}
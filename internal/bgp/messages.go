@@ -15,11 +15,25 @@ const (
 	afiIPv6 = 2
 )
 
-func sendOpen(w io.Writer, asn uint32, routerID net.IP, holdTime time.Duration) error {
+func sendOpen(w io.Writer, asn uint32, routerID net.IP, holdTime time.Duration, fourByteASN, routeRefresh bool) error {
 	if routerID.To4() == nil {
 		panic("ipv4 address used as RouterID")
 	}
 
+	// Capabilities: multiprotocol extension for IPv4+IPv6 unicast,
+	// then optionally route refresh and 4-byte ASNs.
+	caps := []byte{
+		1, 4, 0, 1, 0, 1, // BGP Multi-protocol Extensions, IPv4 unicast
+		1, 4, 0, 2, 0, 1, // BGP Multi-protocol Extensions, IPv6 unicast
+	}
+	if routeRefresh {
+		caps = append(caps, 2, 0) // Route refresh (RFC 2918)
+	}
+	if fourByteASN {
+		caps = append(caps, 65, 4, 0, 0, 0, 0) // 4-byte ASN
+		binary.BigEndian.PutUint32(caps[len(caps)-4:], asn)
+	}
+
 	msg := struct {
 		// Header
 		Marker1, Marker2 uint64
@@ -36,23 +50,6 @@ func sendOpen(w io.Writer, asn uint32, routerID net.IP, holdTime time.Duration)
 		OptsLen uint8
 		OptType uint8
 		OptLen  uint8
-
-		// Capabilities: multiprotocol extension for IPv4+IPv6
-		// unicast, and 4-byte ASNs
-
-		MP4Type uint8
-		MP4Len  uint8
-		AFI4    uint16
-		SAFI4   uint16
-
-		MP6Type uint8
-		MP6Len  uint8
-		AFI6    uint16
-		SAFI6   uint16
-
-		CapType uint8
-		CapLen  uint8
-		ASN32   uint32
 	}{
 		Marker1: 0xffffffffffffffff,
 		Marker2: 0xffffffffffffffff,
@@ -64,31 +61,23 @@ func sendOpen(w io.Writer, asn uint32, routerID net.IP, holdTime time.Duration)
 		HoldTime: uint16(holdTime.Seconds()),
 		// RouterID filled below
 
-		OptsLen: 20,
+		OptsLen: uint8(len(caps) + 2),
 		OptType: 2, // Capabilities
-		OptLen:  18,
-
-		MP4Type: 1, // BGP Multi-protocol Extensions
-		MP4Len:  4,
-		AFI4:    1, // IPv4
-		SAFI4:   1, // Unicast
-
-		MP6Type: 1, // BGP Multi-protocol Extensions
-		MP6Len:  4,
-		AFI6:    2, // IPv6
-		SAFI6:   1, // Unicast
-
-		CapType: 65, // 4-byte ASN
-		CapLen:  4,
-		ASN32:   asn,
+		OptLen:  uint8(len(caps)),
 	}
-	msg.Len = uint16(binary.Size(msg))
+	msg.Len = uint16(binary.Size(msg) + len(caps))
 	if asn > 65535 {
 		msg.ASN16 = 23456
 	}
 	copy(msg.RouterID[:], routerID.To4())
 
-	return binary.Write(w, binary.BigEndian, msg)
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.BigEndian, msg); err != nil {
+		return err
+	}
+	b.Write(caps)
+	_, err := w.Write(b.Bytes())
+	return err
 }
 
 type openResult struct {
@@ -96,6 +85,8 @@ type openResult struct {
 	holdTime time.Duration
 	mp4      bool
 	mp6      bool
+	// Peer can send and accept ROUTE-REFRESH messages.
+	routeRefresh bool
 }
 
 func readOpen(r io.Reader) (*openResult, error) {
@@ -197,6 +188,8 @@ func readCapabilities(r io.Reader, ret *openResult) error {
 			N: int64(cap.Len),
 		}
 		switch cap.Code {
+		case 2:
+			ret.routeRefresh = true
 		case 65:
 			if err := binary.Read(&lr, binary.BigEndian, &ret.asn); err != nil {
 				return err
@@ -225,7 +218,7 @@ func readCapabilities(r io.Reader, ret *openResult) error {
 	}
 }
 
-func sendUpdate(w io.Writer, asn uint32, adv *Advertisement) error {
+func sendUpdate(w io.Writer, asn uint32, fourByteASN bool, adv *Advertisement) error {
 	var b bytes.Buffer
 
 	hdr := struct {
@@ -243,7 +236,7 @@ func sendUpdate(w io.Writer, asn uint32, adv *Advertisement) error {
 		return err
 	}
 	l := b.Len()
-	if err := encodePathAttrs(&b, asn, adv); err != nil {
+	if err := encodePathAttrs(&b, asn, fourByteASN, adv); err != nil {
 		return err
 	}
 	binary.BigEndian.PutUint16(b.Bytes()[21:23], uint16(b.Len()-l))
@@ -271,17 +264,18 @@ func bytesForBits(n int) int {
 	return ((n + 7) &^ 7) / 8
 }
 
-func encodePathAttrs(b *bytes.Buffer, asn uint32, adv *Advertisement) error {
+func encodePathAttrs(b *bytes.Buffer, asn uint32, fourByteASN bool, adv *Advertisement) error {
 	b.Write([]byte{
 		0x40, 1, // mandatory, origin
 		1, // len
-		2, // incomplete
+		adv.Origin,
 
 		0x40, 2, // mandatory, as-path
 	})
-	if asn == 0 {
+	switch {
+	case asn == 0:
 		b.WriteByte(0) // empty AS path
-	} else {
+	case fourByteASN:
 		b.Write([]byte{
 			6, // len
 			1, // AS_SET
@@ -290,6 +284,15 @@ func encodePathAttrs(b *bytes.Buffer, asn uint32, adv *Advertisement) error {
 		if err := binary.Write(b, binary.BigEndian, asn); err != nil {
 			return err
 		}
+	default:
+		b.Write([]byte{
+			4, // len
+			1, // AS_SET
+			1, // len (in number of ASes)
+		})
+		if err := binary.Write(b, binary.BigEndian, uint16(asn)); err != nil {
+			return err
+		}
 	}
 	b.Write([]byte{
 		0x40, 3, // mandatory, next-hop
@@ -318,6 +321,32 @@ func encodePathAttrs(b *bytes.Buffer, asn uint32, adv *Advertisement) error {
 		}
 	}
 
+	if len(adv.LargeCommunities) > 0 {
+		// Each large community is 12 bytes, so it doesn't take many
+		// to need the extended length encoding.
+		l := len(adv.LargeCommunities) * 12
+		if l > 255 {
+			b.Write([]byte{
+				0xd0, 32, // optional transitive extended-length, large communities
+			})
+			if err := binary.Write(b, binary.BigEndian, uint16(l)); err != nil {
+				return err
+			}
+		} else {
+			b.Write([]byte{
+				0xc0, 32, // optional transitive, large communities
+			})
+			if err := binary.Write(b, binary.BigEndian, uint8(l)); err != nil {
+				return err
+			}
+		}
+		for _, c := range adv.LargeCommunities {
+			if err := binary.Write(b, binary.BigEndian, c); err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -14,7 +14,7 @@ func TestOpen(t *testing.T) {
 	var b bytes.Buffer
 	wantHold := 4 * time.Second
 	wantASN := uint32(12345)
-	if err := sendOpen(&b, wantASN, net.ParseIP("1.2.3.4"), wantHold); err != nil {
+	if err := sendOpen(&b, wantASN, net.ParseIP("1.2.3.4"), wantHold, true, false); err != nil {
 		t.Fatalf("Send open: %s", err)
 	}
 	op, err := readOpen(&b)
@@ -29,6 +29,44 @@ func TestOpen(t *testing.T) {
 	}
 }
 
+func TestOpen2ByteASN(t *testing.T) {
+	var b bytes.Buffer
+	if err := sendOpen(&b, 12345, net.ParseIP("1.2.3.4"), 4*time.Second, false, false); err != nil {
+		t.Fatalf("Send open: %s", err)
+	}
+	// Without the 4-byte ASN capability, only the two multiprotocol
+	// capabilities remain.
+	if b.Len() != 43 {
+		t.Errorf("Wrong OPEN length, want 43, got %d", b.Len())
+	}
+	op, err := readOpen(&b)
+	if err != nil {
+		t.Fatalf("Read open: %s", err)
+	}
+	if op.asn != 12345 {
+		t.Errorf("Wrong ASN, want 12345, got %d", op.asn)
+	}
+}
+
+func TestOpenRouteRefresh(t *testing.T) {
+	for _, rr := range []bool{false, true} {
+		var b bytes.Buffer
+		if err := sendOpen(&b, 12345, net.ParseIP("1.2.3.4"), 4*time.Second, true, rr); err != nil {
+			t.Fatalf("Send open: %s", err)
+		}
+		op, err := readOpen(&b)
+		if err != nil {
+			t.Fatalf("Read open: %s", err)
+		}
+		if op.routeRefresh != rr {
+			t.Errorf("Wrong route refresh capability, want %v, got %v", rr, op.routeRefresh)
+		}
+		if op.asn != 12345 {
+			t.Errorf("Wrong ASN, want 12345, got %d", op.asn)
+		}
+	}
+}
+
 func TestPcapInterop(t *testing.T) {
 	ms, err := filepath.Glob("testdata/open-*")
 	if err != nil {
@@ -46,3 +84,66 @@ func TestPcapInterop(t *testing.T) {
 		}
 	}
 }
+
+func TestOriginAttr(t *testing.T) {
+	for _, origin := range []uint8{OriginIGP, OriginEGP, OriginIncomplete} {
+		var b bytes.Buffer
+		adv := &Advertisement{
+			Prefix:  &net.IPNet{IP: net.ParseIP("1.2.3.0").To4(), Mask: net.CIDRMask(24, 32)},
+			NextHop: net.ParseIP("10.20.30.40"),
+			Origin:  origin,
+		}
+		if err := encodePathAttrs(&b, 0, true, adv); err != nil {
+			t.Fatalf("encodePathAttrs: %s", err)
+		}
+		// ORIGIN is the first path attribute: flags, type, length, value.
+		if got := b.Bytes()[:4]; !bytes.Equal(got, []byte{0x40, 1, 1, origin}) {
+			t.Errorf("wrong ORIGIN attribute for origin %d, got %v", origin, got)
+		}
+	}
+}
+
+func TestASPathAttr(t *testing.T) {
+	adv := &Advertisement{
+		Prefix:  &net.IPNet{IP: net.ParseIP("1.2.3.0").To4(), Mask: net.CIDRMask(24, 32)},
+		NextHop: net.ParseIP("10.20.30.40"),
+	}
+	for _, test := range []struct {
+		fourByteASN bool
+		want        []byte
+	}{
+		{true, []byte{0x40, 2, 6, 1, 1, 0, 0, 0x30, 0x39}},
+		{false, []byte{0x40, 2, 4, 1, 1, 0x30, 0x39}},
+	} {
+		var b bytes.Buffer
+		if err := encodePathAttrs(&b, 12345, test.fourByteASN, adv); err != nil {
+			t.Fatalf("encodePathAttrs: %s", err)
+		}
+		// AS_PATH follows the 4 byte ORIGIN attribute.
+		if got := b.Bytes()[4 : 4+len(test.want)]; !bytes.Equal(got, test.want) {
+			t.Errorf("wrong AS_PATH attribute with fourByteASN=%v, got %v, want %v", test.fourByteASN, got, test.want)
+		}
+	}
+}
+
+func TestLargeCommunitiesAttr(t *testing.T) {
+	var b bytes.Buffer
+	adv := &Advertisement{
+		Prefix:           &net.IPNet{IP: net.ParseIP("1.2.3.0").To4(), Mask: net.CIDRMask(24, 32)},
+		NextHop:          net.ParseIP("10.20.30.40"),
+		LargeCommunities: []LargeCommunity{{64512, 1, 2}},
+	}
+	if err := encodePathAttrs(&b, 0, true, adv); err != nil {
+		t.Fatalf("encodePathAttrs: %s", err)
+	}
+	// LARGE_COMMUNITY is the last path attribute.
+	want := []byte{
+		0xc0, 32, 12,
+		0, 0, 0xfc, 0,
+		0, 0, 0, 1,
+		0, 0, 0, 2,
+	}
+	if got := b.Bytes()[b.Len()-len(want):]; !bytes.Equal(got, want) {
+		t.Errorf("wrong LARGE_COMMUNITY attribute, got %v, want %v", got, want)
+	}
+}
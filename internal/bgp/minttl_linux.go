@@ -0,0 +1,48 @@
+package bgp
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// ipv6MinHopCount is IPV6_MINHOPCOUNT from linux/in6.h, which the
+// syscall package doesn't know about.
+const ipv6MinHopCount = 73
+
+// setMinTTL enables the Generalized TTL Security Mechanism (RFC 5082)
+// on conn: outgoing packets are sent with the maximum TTL, and
+// incoming packets with a TTL below minTTL are dropped by the kernel.
+func setMinTTL(conn net.Conn, minTTL uint8) error {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return errors.New("not a TCP connection")
+	}
+	addr, ok := tcp.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return errors.New("unknown remote address type")
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if addr.IP.To4() != nil {
+			if serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, 255); serr != nil {
+				return
+			}
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MINTTL, int(minTTL))
+		} else {
+			if serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, 255); serr != nil {
+				return
+			}
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6MinHopCount, int(minTTL))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package bgp
+
+import (
+	"errors"
+	"net"
+)
+
+// setMinTTL is only implemented on Linux.
+func setMinTTL(conn net.Conn, minTTL uint8) error {
+	return errors.New("TTL security is not supported on this platform")
+}
@@ -0,0 +1,165 @@
+package bgp
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// passive tracks the sessions that are waiting for inbound
+// connections, keyed by peer IP. The listener is started when the
+// first passive session registers, and stopped when the last one
+// goes away.
+var passive = struct {
+	sync.Mutex
+	port     uint16
+	ln       net.Listener
+	sessions map[string]*Session
+}{
+	port:     179,
+	sessions: map[string]*Session{},
+}
+
+// SetListenPort sets the local TCP port on which passive sessions
+// wait for their peers to connect. If passive sessions are already
+// listening, they move to the new port. If the new port can't be
+// bound, they keep listening on the old one.
+func SetListenPort(port uint16) error {
+	passive.Lock()
+	defer passive.Unlock()
+	if port == passive.port {
+		return nil
+	}
+	if passive.ln == nil {
+		passive.port = port
+		return nil
+	}
+	ln, err := listen(port)
+	if err != nil {
+		return err
+	}
+	passive.ln.Close()
+	passive.ln = ln
+	passive.port = port
+	go acceptPassive(ln)
+	return nil
+}
+
+// listenPassive starts accepting connections for passive sessions.
+// passive must be locked.
+func listenPassive() error {
+	ln, err := listen(passive.port)
+	if err != nil {
+		return err
+	}
+	passive.ln = ln
+	go acceptPassive(ln)
+	return nil
+}
+
+// listen opens a TCP listener on port, on all local addresses.
+func listen(port uint16) (net.Listener, error) {
+	addr := net.JoinHostPort("", strconv.Itoa(int(port)))
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen on %q: %s", addr, err)
+	}
+	return ln, nil
+}
+
+// registerPassive makes s eligible to receive inbound connections
+// from its peer.
+func registerPassive(s *Session) error {
+	key := passiveKey(s.addr)
+	if key == "" {
+		return fmt.Errorf("passive session address %q is not an IP:port", s.addr)
+	}
+
+	passive.Lock()
+	defer passive.Unlock()
+	if passive.sessions[key] != nil {
+		return fmt.Errorf("already have a passive session for %q", key)
+	}
+	if passive.ln == nil {
+		if err := listenPassive(); err != nil {
+			return err
+		}
+	}
+	passive.sessions[key] = s
+	return nil
+}
+
+// passiveKey returns the canonical form of the IP (and zone, if any)
+// in addr, or "" if addr is not an IP:port.
+func passiveKey(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	zone := ""
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host, zone = host[:i], host[i:]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	return ip.String() + zone
+}
+
+// unregisterPassive undoes registerPassive.
+func unregisterPassive(s *Session) {
+	passive.Lock()
+	defer passive.Unlock()
+	for key, s2 := range passive.sessions {
+		if s2 == s {
+			delete(passive.sessions, key)
+		}
+	}
+	if len(passive.sessions) == 0 && passive.ln != nil {
+		passive.ln.Close()
+		passive.ln = nil
+	}
+}
+
+// acceptPassive hands inbound connections on ln to the session
+// configured for the remote IP, or drops them if there is none.
+func acceptPassive(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			// Listener closed by unregisterPassive.
+			return
+		}
+		passive.Lock()
+		s := passive.sessions[passiveKey(conn.RemoteAddr().String())]
+		passive.Unlock()
+
+		if s == nil {
+			glog.Infof("Rejecting BGP connection from unconfigured peer %q", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		select {
+		case s.incoming <- conn:
+		default:
+			// Session isn't waiting for a connection, either
+			// because it already has one or it's shutting down.
+			conn.Close()
+		}
+	}
+}
+
+// accept waits for the peer to connect to us.
+func (s *Session) accept() (net.Conn, error) {
+	select {
+	case conn := <-s.incoming:
+		return conn, nil
+	case <-s.done:
+		return nil, errClosed
+	}
+}
@@ -0,0 +1,70 @@
+package bgp
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+// freePort returns a local TCP port that is likely unused.
+func freePort(t *testing.T) uint16 {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("finding a free port: %s", err)
+	}
+	defer ln.Close()
+	return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func dial(port uint16) error {
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func TestSetListenPortBindFailure(t *testing.T) {
+	oldPort := freePort(t)
+	if err := SetListenPort(oldPort); err != nil {
+		t.Fatalf("setting listen port without listener: %s", err)
+	}
+	passive.Lock()
+	err := listenPassive()
+	passive.Unlock()
+	if err != nil {
+		t.Fatalf("starting passive listener: %s", err)
+	}
+	defer func() {
+		passive.Lock()
+		passive.ln.Close()
+		passive.ln = nil
+		passive.port = 179
+		passive.Unlock()
+	}()
+
+	// Hold the new port, so that the move fails.
+	blocker, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("binding blocker: %s", err)
+	}
+	newPort := uint16(blocker.Addr().(*net.TCPAddr).Port)
+	if err := SetListenPort(newPort); err == nil {
+		t.Fatalf("SetListenPort(%d) succeeded on a port already in use", newPort)
+	}
+	if passive.port != oldPort {
+		t.Errorf("listen port is %d after failed move, want %d", passive.port, oldPort)
+	}
+	if err := dial(oldPort); err != nil {
+		t.Errorf("old listener gone after failed move: %s", err)
+	}
+
+	// Once the port is free, retrying the move works.
+	blocker.Close()
+	if err := SetListenPort(newPort); err != nil {
+		t.Fatalf("retrying SetListenPort(%d): %s", newPort, err)
+	}
+	if err := dial(newPort); err != nil {
+		t.Errorf("no listener on new port: %s", err)
+	}
+}
@@ -15,36 +15,138 @@
 package config
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"math"
+	"math/big"
+	"math/rand"
 	"net"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	yaml "gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 // configFile is the configuration as parsed out of the ConfigMap,
 // without validation or useful high level types.
 type configFile struct {
 	Peers []struct {
-		MyASN    uint32 `yaml:"my-asn"`
-		ASN      uint32 `yaml:"peer-asn"`
-		Addr     string `yaml:"peer-address"`
-		Port     uint16 `yaml:"peer-port"`
-		HoldTime string `yaml:"hold-time"`
-	}
-	Communities map[string]string
-	Pools       []struct {
-		Name           string
-		CIDR           []string
-		AvoidBuggyIPs  bool `yaml:"avoid-buggy-ips"`
-		Advertisements []struct {
-			AggregationLength *int `yaml:"aggregation-length"`
-			LocalPref         *uint32
-			Communities       []string
+		Name             string
+		MyASN            uint32 `yaml:"my-asn"`
+		ASN              uint32 `yaml:"peer-asn"`
+		Addr             string `yaml:"peer-address"`
+		Port             uint16 `yaml:"peer-port"`
+		HoldTime         string `yaml:"hold-time"`
+		KeepaliveTime    string `yaml:"keepalive-time"`
+		Passive          bool
+		MinTTL           int    `yaml:"min-ttl"`
+		MaxPrefixes      uint32 `yaml:"max-prefixes"`
+		MaxPrefixAction  string `yaml:"max-prefixes-action"`
+		ConnectRetryTime string `yaml:"connect-retry-time"`
+		MRAI             string `yaml:"min-route-advertisement-interval"`
+		VRF              string
+		PeerGroup        string `yaml:"peer-group"`
+		OriginateDefault bool   `yaml:"originate-default"`
+		Disable4ByteASN  bool   `yaml:"disable-4byte-asn"`
+		RouteRefresh     *bool  `yaml:"route-refresh"`
+		Enabled          *bool
+		Communities      []string
+		StripCommunities []string `yaml:"strip-communities"`
+		Capabilities     []string
+		AddPaths         string `yaml:"add-paths"`
+		GracefulRestart  *struct {
+			Enabled   bool
+			StaleTime string `yaml:"stale-time"`
+		} `yaml:"graceful-restart"`
+	}
+	HoldTime             string `yaml:"hold-time"`
+	KeepaliveTime        string `yaml:"keepalive-time"`
+	Communities          map[string]string
+	AvoidBuggyIPs        bool     `yaml:"avoid-buggy-ips"`
+	DefaultCommunities   []string `yaml:"default-communities"`
+	DefaultAggLength     *int     `yaml:"default-aggregation-length"`
+	LocalPref            *int64   `yaml:"localpref"`
+	ExcludeAddresses     []string `yaml:"exclude-addresses"`
+	GracefulShutdownTime string   `yaml:"graceful-shutdown-time"`
+	ReloadMinInterval    string   `yaml:"reload-min-interval"`
+	BGPListenPort        *int     `yaml:"bgp-listen-port"`
+	SpeakerNodeSelector  string   `yaml:"speaker-node-selector"`
+	Dampening            *struct {
+		SuppressThreshold *int   `yaml:"suppress-threshold"`
+		ReuseThreshold    *int   `yaml:"reuse-threshold"`
+		HalfLife          string `yaml:"half-life"`
+		MaxSuppressTime   string `yaml:"max-suppress-time"`
+	}
+	Confederation *struct {
+		ID      uint32 `yaml:"confed-id"`
+		Members []uint32
+	}
+	Pools []struct {
+		Name              string
+		Protocol          protocolList
+		CIDR              []string
+		AvoidBuggyIPs     *bool    `yaml:"avoid-buggy-ips"`
+		IncludeNetwork    bool     `yaml:"include-network"`
+		IncludeBroadcast  bool     `yaml:"include-broadcast"`
+		ReservedAddresses []string `yaml:"reserved-addresses"`
+		PinnedAddresses   []struct {
+			Address string
+			Service string
+		} `yaml:"pinned-addresses"`
+		Communities        []string
+		AllocationStrategy string   `yaml:"allocation-strategy"`
+		CIDROrder          string   `yaml:"cidr-order"`
+		NodeSelectors      []string `yaml:"node-selectors"`
+		ServiceSelectors   []string `yaml:"service-selectors"`
+		NodePriorities     []struct {
+			NodeSelector string `yaml:"node-selector"`
+			Priority     int
+		} `yaml:"node-priorities"`
+		InterfaceSelection string `yaml:"interface-selection"`
+		Interfaces         []string
+		Weight             int
+		AnnounceDelay      string  `yaml:"announce-delay"`
+		ServiceClass       *string `yaml:"service-class"`
+		AutoAssign         *bool   `yaml:"auto-assign"`
+		System             bool
+		IPFamily           string   `yaml:"ip-family"`
+		AllowedCommunities []string `yaml:"allowed-communities"`
+		AllowedAggLengths  []int    `yaml:"allowed-aggregation-lengths"`
+		TagCommunityASN    *int     `yaml:"tag-community-asn"`
+		Advertisements     []struct {
+			AggregationLength   *int `yaml:"aggregation-length"`
+			AggregationLengthV6 *int `yaml:"aggregation-length-v6"`
+			LocalPref           *int64
+			Communities         []string
+			LargeCommunities    []string `yaml:"large-communities"`
+			RemoveCommunities   []string `yaml:"remove-communities"`
+			Blackhole           bool
+			LocalOnly           bool     `yaml:"local-only"`
+			PeerGroups          []string `yaml:"peer-groups"`
+			NoAdvertiseEBGP     bool     `yaml:"no-advertise-ebgp"`
+			Origin              string
+			Type                string `yaml:"advertisement-type"`
+			Aggregate           *bool
+			Enabled             *bool
+			NextHop             string `yaml:"next-hop"`
+			NextHopLinkLocal    string `yaml:"next-hop-link-local"`
+			CIDR                []string
 		}
 	} `yaml:"address-pools"`
+	Rules []struct {
+		Pool      string
+		PeerGroup string `yaml:"peer-group"`
+		Condition string
+		Action    string
+	}
 }
 
 // Config is a parsed MetalLB configuration.
@@ -53,28 +155,261 @@ type Config struct {
 	Peers []*Peer
 	// Address pools from which to allocate load balancer IPs.
 	Pools map[string]*Pool
+	// Addresses that must never be automatically allocated, regardless
+	// of which pools contain them.
+	ExcludeAddresses []*net.IPNet
+	// How long the speaker waits, after withdrawing its routes, before
+	// shutting down. Zero means shut down immediately.
+	GracefulShutdownTime time.Duration
+	// Minimum time between two applications of the configuration.
+	// Changes arriving sooner are held back, and only the latest one
+	// is applied once the interval has passed. Zero means apply
+	// every change immediately.
+	ReloadMinInterval time.Duration
+	// Local TCP port on which passive BGP sessions listen.
+	BGPListenPort uint16
+	// Route flap dampening parameters. Nil if dampening is disabled.
+	Dampening *Dampening
+	// BGP confederation (RFC 5065) that the local ASNs belong to. Nil
+	// if MetalLB isn't part of a confederation.
+	Confederation *Confederation
+	// Conditional advertisement rules, in the order given. Not yet
+	// evaluated, see Rule.
+	Rules []*Rule
+	// Nodes whose speaker announces anything at all. Nil means all
+	// nodes.
+	SpeakerNodeSelector labels.Selector
+	// The community aliases defined by the config, resolved to their
+	// values. Parse has already substituted them wherever they are
+	// used, they are only kept so that tools like ToCRDs can write
+	// them back out. Nil if none are defined.
+	CommunityAliases map[string]uint32
+	// Problems found in the configuration that don't prevent it from
+	// being used, but that the operator probably wants to know about.
+	Warnings []string
+}
+
+// Dampening holds route flap dampening parameters, per RFC 2439.
+type Dampening struct {
+	// Penalty above which a flapping route is suppressed.
+	SuppressThreshold int
+	// Penalty below which a suppressed route is reused. config.Parse
+	// guarantees that this is below SuppressThreshold.
+	ReuseThreshold int
+	// Time it takes for a route's penalty to halve.
+	HalfLife time.Duration
+	// Maximum time a route can stay suppressed.
+	MaxSuppressTime time.Duration
+}
+
+// Confederation describes a BGP confederation, per RFC 5065.
+type Confederation struct {
+	// The ASN the confederation presents to the outside world.
+	ID uint32
+	// The member ASNs. config.Parse guarantees that every peer's
+	// MyASN is one of them.
+	Members []uint32
 }
 
 // Peer is the configuration of a BGP peering session.
 type Peer struct {
+	// Human-readable name of the session, for logs and metrics. Empty
+	// if unnamed, otherwise a DNS-1123 label unique across peers.
+	Name string
 	// AS number to use for the local end of the session.
 	MyASN uint32
 	// AS number to expect from the remote end of the session.
 	ASN uint32
-	// Address to dial when establishing the session.
+	// Address to dial when establishing the session. Nil if the peer
+	// was configured by hostname.
 	Addr net.IP
+	// IPv6 zone (i.e. the local interface name) to use when dialing
+	// Addr. Required if Addr is an IPv6 link-local address, empty
+	// otherwise.
+	Zone string
+	// Hostname to resolve and dial when establishing the session,
+	// if the peer was not configured by IP address.
+	AddrHostname string
 	// Port to dial when establishing the session.
 	Port uint16
 	// Requested BGP hold time, per RFC4271.
 	HoldTime time.Duration
+	// Interval between BGP keepalive messages, per RFC4271.
+	KeepaliveTime time.Duration
+	// If true, wait for the peer to connect to us rather than
+	// dialing it.
+	Passive bool
+	// If nonzero, enable TTL security (RFC 5082) by dropping packets
+	// from the peer whose TTL is below MinTTL.
+	MinTTL uint8
+	// Limit on the number of prefixes exchanged with the peer.
+	MaxPrefixes MaxPrefixes
+	// How long to wait between attempts to establish the session.
+	ConnectRetryTime time.Duration
+	// Minimum Route Advertisement Interval, per RFC4271: the least
+	// time between successive batches of updates to the peer. Zero
+	// sends updates as soon as they happen.
+	MRAI time.Duration
+	// Name of the Linux VRF the session is bound to. Empty means the
+	// default VRF.
+	VRF string
+	// Name of the peer group this peer belongs to, for use in
+	// Advertisement.PeerGroups. Empty if the peer is in no group.
+	PeerGroup string
+	// If true, advertise a default route (0.0.0.0/0) to this peer.
+	OriginateDefault bool
+	// If true, don't offer the 4-byte ASN capability (RFC 6793), for
+	// legacy routers that only speak 2-byte ASNs. config.Parse
+	// guarantees that MyASN and ASN fit in 2 bytes.
+	Disable4ByteASN bool
+	// If true (the default), offer the route refresh capability (RFC
+	// 2918), so the peer can ask for our routes again without
+	// resetting the session.
+	RouteRefresh bool
+	// If false, the speakers don't establish the session, but the peer
+	// stays in the config, e.g. during router maintenance. Defaults
+	// to true.
+	Enabled bool
+	// Communities added to every route sent to this peer, on top of
+	// the advertisement's own. Nil if none.
+	Communities map[uint32]bool
+	// Communities removed from every route sent to this peer, e.g.
+	// internal communities that shouldn't leave the network. Nil if
+	// none. config.Parse guarantees that none of them are in
+	// Communities.
+	StripCommunities map[uint32]bool
+	// Graceful restart (RFC 4724) settings. Nil if graceful restart
+	// is disabled.
+	GracefulRestart *GracefulRestart
+	// Optional BGP capabilities to offer the peer in addition to
+	// the ones MetalLB always negotiates. Nil if none.
+	Capabilities map[Capability]bool
+	// Which directions of the add-path capability to negotiate.
+	// Empty if add-path is off. config.Parse adds CapabilityAddPath
+	// to Capabilities when this is set.
+	AddPaths AddPathsMode
 	// TODO: more BGP session settings
 }
 
-// Pool is the configuration of an IP address pool.
+// AddPathsMode is the direction in which a peer exchanges multiple
+// paths per prefix.
+type AddPathsMode string
+
+// Supported add-path modes.
+const (
+	// Accept multiple paths from the peer.
+	AddPathsReceive AddPathsMode = "receive"
+	// Send multiple paths to the peer.
+	AddPathsSend AddPathsMode = "send"
+	// Both of the above.
+	AddPathsBoth AddPathsMode = "both"
+)
+
+// Capability is an optional BGP capability that can be enabled on a
+// peer.
+type Capability string
+
+// Supported optional capabilities.
+const (
+	// Advertisement of multiple paths for the same prefix (RFC 7911).
+	CapabilityAddPath Capability = "add-path"
+	// IPv4 routes with IPv6 next hops (RFC 5549).
+	CapabilityExtendedNextHop Capability = "extended-nexthop"
+	// Route refresh with explicit start and end markers (RFC 7313).
+	CapabilityEnhancedRouteRefresh Capability = "enhanced-route-refresh"
+)
+
+// GracefulRestart holds the graceful restart settings of a peer.
+type GracefulRestart struct {
+	// How long routes learned before a restart are kept once the
+	// session is back up, waiting for the peer to refresh them.
+	StaleTime time.Duration
+}
+
+// PinnedAddress reserves an address of a pool for one service.
+type PinnedAddress struct {
+	IP net.IP
+	// The service, as "namespace/name".
+	Service string
+}
+
+// NodePriority gives the nodes matching a selector a priority in
+// layer2 leader election.
+type NodePriority struct {
+	Selector labels.Selector
+	// Higher priorities win. config.Parse guarantees that it is not
+	// negative.
+	Priority int
+}
+
+// MaxPrefixes limits the number of prefixes exchanged with a peer.
+type MaxPrefixes struct {
+	// Maximum number of prefixes. Zero means unlimited.
+	Limit uint32
+	// What to do when the limit is exceeded. config.Parse sets this
+	// to MaxPrefixesWarn if Limit is set without an action.
+	Action MaxPrefixesAction
+}
+
+// MaxPrefixesAction is what to do when a peer's prefix limit is
+// exceeded.
+type MaxPrefixesAction string
+
+// Supported max prefix actions.
+const (
+	// Log a warning, and otherwise carry on.
+	MaxPrefixesWarn MaxPrefixesAction = "warn"
+	// Tear down the session, and let it reconnect.
+	MaxPrefixesRestart MaxPrefixesAction = "restart"
+	// Tear down the session, and leave it down.
+	MaxPrefixesDisable MaxPrefixesAction = "disable"
+)
+
+// Proto holds the protocol we are speaking.
+type Proto string
+
+// protocolList is a pool's protocol setting, which is either a single
+// protocol or a list of them.
+type protocolList []string
+
+func (l *protocolList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		*l = protocolList{s}
+		return nil
+	}
+	var ss []string
+	if err := unmarshal(&ss); err != nil {
+		return err
+	}
+	if ss == nil {
+		ss = []string{}
+	}
+	*l = protocolList(ss)
+	return nil
+}
+
+// MetalLB supported protocols.
+const (
+	BGP    Proto = "bgp"
+	Layer2 Proto = "layer2"
+)
+
+// Pool is the configuration of an IP address pool. config.Parse
+// merges global defaults into each Pool, so its fields are always the
+// effective settings for the pool.
 type Pool struct {
+	// Protocol for this pool. For pools announced with several
+	// protocols, this is the first of Protocols.
+	Protocol Proto
+	// All the protocols of a pool announced with more than one, in
+	// the order of the config. Nil for single-protocol pools. Use
+	// Speaks rather than comparing Protocol.
+	Protocols []Proto
 	// The addresses that are part of this pool, expressed as CIDR
 	// prefixes. config.Parse guarantees that these are
-	// non-overlapping, both within and between pools.
+	// non-overlapping, both within and between pools, and sorts them
+	// by address, IPv4 first, unless CIDROrder is CIDROrderListed.
 	CIDR []*net.IPNet
 	// Some buggy consumer devices mistakenly drop IPv4 traffic for IP
 	// addresses ending in .0 or .255, due to poor implementations of
@@ -82,87 +417,704 @@ type Pool struct {
 	// unusable, for maximum compatibility with ancient parts of the
 	// internet.
 	AvoidBuggyIPs bool
+	// Refinements of AvoidBuggyIPs for legacy subnets where only one
+	// end of each /24 is a problem: if set, addresses ending in .0
+	// (IncludeNetwork) or .255 (IncludeBroadcast) remain usable.
+	IncludeNetwork   bool
+	IncludeBroadcast bool
+	// Addresses within CIDR that must never be allocated. config.Parse
+	// guarantees that these are contained in CIDR and don't overlap
+	// each other.
+	Reserved []*net.IPNet
+	// Addresses that are always allocated to a given service.
+	// config.Parse guarantees that they are within CIDR, outside
+	// Reserved, and that no address or service is pinned twice.
+	PinnedAddresses []PinnedAddress
+	// The order in which addresses are allocated from the pool. The
+	// empty value is equivalent to AllocateLowest.
+	AllocationStrategy AllocationStrategy
+	// The order of CIDR, and so the order in which the CIDRs are
+	// exhausted. The empty value is equivalent to CIDROrderSorted.
+	CIDROrder CIDROrder
+	// For layer2 pools, the nodes that are allowed to announce the
+	// pool's addresses. A node is eligible if it matches any of the
+	// selectors. If empty, all nodes are eligible.
+	NodeSelectors []labels.Selector
+	// For layer2 pools, biases the election of the node announcing
+	// each address towards nodes with a higher priority. See
+	// Pool.NodePriority.
+	NodePriorities []NodePriority
+	// For layer2 pools, how the speaker picks the network interface
+	// to announce an address on. The empty value is equivalent to
+	// InterfaceAuto.
+	InterfaceSelection InterfaceSelection
+	// For layer2 pools with InterfaceExplicit, the interfaces to
+	// announce on. config.Parse guarantees that this is set if and
+	// only if InterfaceSelection is InterfaceExplicit.
+	Interfaces []string
+	// The services this pool auto-assigns addresses to. A service is
+	// eligible if its labels match any of the selectors. If empty,
+	// all services are eligible. Services that ask for the pool by
+	// name are served regardless.
+	ServiceSelectors []labels.Selector
+	// Relative likelihood of this pool being picked by
+	// PickWeightedPool, when the user didn't ask for a specific
+	// pool. Pools with weight 0 are only picked if no eligible pool
+	// has a positive weight.
+	Weight int
+	// How long the speaker waits before announcing each newly
+	// announceable service of the pool, so that a reload doesn't
+	// announce everything at once. Zero means no delay.
+	AnnounceDelay time.Duration
+	// If set, the pool only serves services annotated with this
+	// class, and services with a class are only served by pools of
+	// that class.
+	ServiceClass string
+	// If false, addresses are only allocated from this pool to
+	// services that explicitly ask for it.
+	AutoAssign bool
+	// If true, the pool is reserved for MetalLB's own infrastructure
+	// addresses, such as a health check VIP, and never auto-assigns.
+	// config.Parse guarantees that AutoAssign is false.
+	System bool
+	// Address family the pool is declared to serve. config.Parse
+	// guarantees that the pool's CIDRs match it. Empty if the pool
+	// didn't declare a family.
+	IPFamily IPFamily
+	// Communities that services allocated from this pool may request
+	// be added to their advertisements, by annotation. Nil if
+	// services may not request any.
+	AllowedCommunities map[uint32]bool
+	// Aggregation lengths that the pool's advertisements may use.
+	// config.Parse guarantees that every advertisement's length for
+	// each address family in the pool is listed. Nil if any length is
+	// allowed.
+	AllowedAggregationLengths []int
+	// If nonzero, every advertisement of the pool carries the
+	// community TagCommunity(TagCommunityASN, name), so that routes
+	// can be traced back to the pool.
+	TagCommunityASN uint16
 	// When an IP is allocated from this pool, how should it be
 	// translated into BGP announcements?
 	Advertisements []*Advertisement
 }
 
+// AllocationStrategy is the order in which a pool's addresses are
+// handed out.
+type AllocationStrategy string
+
+// Supported allocation strategies.
+const (
+	// Allocate the numerically lowest free address.
+	AllocateLowest AllocationStrategy = "lowest"
+	// Allocate the numerically highest free address.
+	AllocateHighest AllocationStrategy = "highest"
+	// Allocate a free address at random.
+	AllocateRandom AllocationStrategy = "random"
+	// Allocate the free address closest to Pool.HashedIP of the
+	// service's namespace/name, so that a service gets the same
+	// address whenever possible.
+	AllocateHashed AllocationStrategy = "hashed"
+)
+
+// CIDROrder is the order in which a pool's CIDRs are used.
+type CIDROrder string
+
+// Supported CIDR orders.
+const (
+	// Use the CIDRs in address order, IPv4 first.
+	CIDROrderSorted CIDROrder = "sorted"
+	// Use the CIDRs in the order of the config, e.g. to fill a
+	// preferred range before moving on to the next.
+	CIDROrderListed CIDROrder = "listed"
+)
+
+// InterfaceSelection is how a layer2 pool picks the interfaces it
+// announces on.
+type InterfaceSelection string
+
+// Supported interface selection modes.
+const (
+	// Announce on the interface that is on the same subnet as the
+	// address.
+	InterfaceAuto InterfaceSelection = "auto"
+	// Announce on the interfaces listed in Pool.Interfaces.
+	InterfaceExplicit InterfaceSelection = "explicit"
+)
+
 // Advertisement describes one translation from an IP address to a BGP advertisement.
 type Advertisement struct {
 	// Roll up the IP address into a CIDR prefix of this
 	// length. Optional, defaults to 32 (i.e. no aggregation) if not
 	// specified.
 	AggregationLength int
+	// Like AggregationLength, but for IPv6 addresses. Defaults to
+	// 128.
+	AggregationLengthV6 int
 	// Value of the LOCAL_PREF BGP path attribute. Used only when
 	// advertising to IBGP peers (i.e. Peer.MyASN == Peer.ASN).
 	LocalPref uint32
-	// Value of the COMMUNITIES path attribute.
+	// Value of the COMMUNITIES path attribute. config.Parse merges
+	// the pool and default communities into it, unless the
+	// advertisement set communities to an empty list, in which case
+	// it is empty (but never nil). The speaker still adds each
+	// peer's own communities.
 	Communities map[uint32]bool
+	// Value of the LARGE_COMMUNITY path attribute.
+	LargeCommunities map[LargeCommunity]bool
+	// Communities that the speaker strips from Communities before
+	// sending, e.g. to drop a pool-wide community from one
+	// advertisement. config.Parse already leaves them out of
+	// Communities. Nil if none.
+	RemoveCommunities map[uint32]bool
+	// Value of the ORIGIN path attribute.
+	Origin Origin
+	// Ask peers to discard traffic for this route. config.Parse adds
+	// the BLACKHOLE community to Communities for such
+	// advertisements.
+	Blackhole bool
+	// The pool CIDRs whose addresses this advertisement applies to.
+	// config.Parse guarantees that they are within the pool. Nil
+	// means all of the pool's addresses, empty means none of them.
+	CIDR []*net.IPNet
+	// Keep this route within the peer's AS. config.Parse adds the
+	// NO_EXPORT community to Communities for such advertisements.
+	LocalOnly bool
+	// Whether this advertisement is meant to announce host routes or
+	// an aggregate. Empty if not declared. config.Parse guarantees
+	// that a declared type agrees with the aggregation lengths.
+	Type AdvertisementType
+	// Only send this advertisement to peers in these peer groups. If
+	// empty, the advertisement is sent to all peers. config.Parse
+	// guarantees that every group listed has at least one peer.
+	PeerGroups []string
+	// If true, only send this advertisement to IBGP peers.
+	NoAdvertiseEBGP bool
+	// Next-hop addresses for IPv6 routes, per RFC 2545: a global
+	// address, and optionally the link-local address of the same
+	// interface. Nil if unset.
+	NextHop          net.IP
+	NextHopLinkLocal net.IP
+	// If false, the speaker doesn't make this advertisement.
+	// config.Parse still validates disabled advertisements fully, and
+	// defaults this to true.
+	Enabled bool
+}
+
+// AdvertisementType says what kind of routes an advertisement
+// produces.
+type AdvertisementType string
+
+// Supported advertisement types.
+const (
+	// One route per allocated address, i.e. no aggregation.
+	AdvertiseHost AdvertisementType = "host"
+	// A covering route for several addresses.
+	AdvertiseAggregate AdvertisementType = "aggregate"
+)
+
+// SortedCommunities returns a's communities in ascending numeric
+// order.
+func (a *Advertisement) SortedCommunities() []uint32 {
+	var ret []uint32
+	for c := range a.Communities {
+		ret = append(ret, c)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+// SendsTo returns true if a should be sent to p, according to its
+// PeerGroups and NoAdvertiseEBGP.
+func (a *Advertisement) SendsTo(p *Peer) bool {
+	if a.NoAdvertiseEBGP && p.MyASN != p.ASN {
+		return false
+	}
+	if len(a.PeerGroups) == 0 {
+		return true
+	}
+	for _, g := range a.PeerGroups {
+		if g == p.PeerGroup {
+			return true
+		}
+	}
+	return false
+}
+
+// EffectiveForPeer returns a copy of a, as it should be sent to p:
+// LocalPref only has meaning for IBGP peers, so it is zeroed for EBGP
+// peers. The copy shares a's maps and slices.
+func (a *Advertisement) EffectiveForPeer(p *Peer) *Advertisement {
+	ret := *a
+	if p.MyASN != p.ASN {
+		ret.LocalPref = 0
+	}
+	return &ret
+}
+
+// Origin is the value of the BGP ORIGIN path attribute, per RFC 4271.
+type Origin string
+
+// Valid BGP origins.
+const (
+	OriginIGP        Origin = "igp"
+	OriginEGP        Origin = "egp"
+	OriginIncomplete Origin = "incomplete"
+)
+
+// LargeCommunity is a BGP large community, per RFC 8092.
+type LargeCommunity struct {
+	GlobalAdmin uint32
+	LocalData1  uint32
+	LocalData2  uint32
+}
+
+// BlackholeCommunity is the well-known BLACKHOLE community, defined in
+// RFC 7999.
+const BlackholeCommunity uint32 = 0xFFFF029A
+
+// NoExportCommunity is the well-known NO_EXPORT community, defined in
+// RFC 1997.
+const NoExportCommunity uint32 = 0xFFFFFF01
+
+// wellKnownCommunities are the community names that can be used
+// without defining an alias for them.
+var wellKnownCommunities = map[string]uint32{
+	"graceful-shutdown":   0xFFFF0000, // RFC 8326
+	"accept-own":          0xFFFF0001, // RFC 7611
+	"blackhole":           BlackholeCommunity,
+	"no-export":           NoExportCommunity,
+	"no-advertise":        0xFFFFFF02, // RFC 1997
+	"no-export-subconfed": 0xFFFFFF03, // RFC 1997
+	"no-peer":             0xFFFFFF04, // RFC 3765
 }
 
-func parseHoldTime(ht string) (time.Duration, error) {
-	if ht == "" {
-		return 90 * time.Second, nil
+// parseBGPTimer parses a BGP session timer, returning def if t is
+// unset. BGP timers are carried in whole seconds on the wire, so
+// values with a fractional second are rejected rather than silently
+// truncated.
+func parseBGPTimer(t string, def time.Duration) (time.Duration, error) {
+	if t == "" {
+		return def, nil
 	}
-	d, err := time.ParseDuration(ht)
+	d, err := time.ParseDuration(t)
 	if err != nil {
-		return 0, fmt.Errorf("invalid hold time %q: %s", ht, err)
+		return 0, err
+	}
+	if d%time.Second != 0 {
+		return 0, errors.New("must be a whole number of seconds")
+	}
+	return d, nil
+}
+
+// validateHoldTime checks that ht is a hold time permitted by
+// RFC4271.
+func validateHoldTime(ht time.Duration) error {
+	if ht != 0 && ht < 3*time.Second {
+		return errors.New("must be 0 or >=3s")
+	}
+	if ht > 65535*time.Second {
+		return errors.New("must be <=65535s")
+	}
+	return nil
+}
+
+// validateKeepaliveTime checks that ka is a sensible keepalive
+// interval for a session with hold time ht.
+func validateKeepaliveTime(ka, ht time.Duration) error {
+	if ht == 0 {
+		if ka != 0 {
+			return errors.New("must be 0 when hold time is 0")
+		}
+		return nil
 	}
-	rounded := time.Duration(int(d.Seconds())) * time.Second
-	if rounded != 0 && rounded < 3*time.Second {
-		return 0, fmt.Errorf("invalid hold time %q: must be 0 or >=3s", ht)
+	if ka <= 0 || ka >= ht {
+		return fmt.Errorf("must be positive and less than the hold time (%s)", ht)
 	}
-	return rounded, nil
+	return nil
+}
+
+// parseLocalPref checks that lp is a valid LOCAL_PREF value. It is
+// parsed signed, so that negative values get a clear error rather
+// than a YAML type mismatch.
+func parseLocalPref(lp int64) (uint32, error) {
+	if lp < 0 {
+		return 0, errors.New("must not be negative")
+	}
+	if lp > math.MaxUint32 {
+		return 0, errors.New("must fit in 32 bits")
+	}
+	return uint32(lp), nil
+}
+
+func parseConnectRetryTime(rt string) (time.Duration, error) {
+	if rt == "" {
+		return 2 * time.Second, nil
+	}
+	d, err := time.ParseDuration(rt)
+	if err != nil {
+		return 0, fmt.Errorf("invalid connect retry time %q: %s", rt, err)
+	}
+	return d, nil
+}
+
+// ParseOptions controls optional checks performed by
+// ParseWithOptions. The zero value gives the same behavior as Parse.
+type ParseOptions struct {
+	// Reject peers that use an ASN reserved for documentation by
+	// RFC 5398. These usually mean an example configuration was
+	// copied without being adjusted.
+	RejectDocumentationASN bool
+	// Treat problems that would normally only produce a warning in
+	// Config.Warnings as errors.
+	Strict bool
+	// Allow community aliases to redefine well-known community names
+	// like no-export. Parse sets this for compatibility with configs
+	// written before well-known names were built in.
+	AllowWellKnownShadowing bool
+	// Report unknown keys in advertisements as warnings even in
+	// strict mode, so that configs written for newer versions of
+	// MetalLB still load.
+	IgnoreUnknownAdvertisementKeys bool
+	// If positive, reject configs with more than this many peers. A
+	// sudden jump in the peer count is usually a templating bug.
+	MaxPeers int
+	// Substitute ${VAR} placeholders in the raw config before
+	// decoding it, with values from Env. Placeholders with no value
+	// are an error.
+	ExpandEnv bool
+	// Variables for ExpandEnv. If nil, the process environment is
+	// used.
+	Env map[string]string
+	// Warn about communities whose ASN part isn't the my-asn of any
+	// peer, which is usually a typo.
+	WarnCommunityASNMismatch bool
 }
 
 // Parse loads and validates a Config from bs.
 func Parse(bs []byte) (*Config, error) {
+	return ParseWithOptions(bs, ParseOptions{AllowWellKnownShadowing: true})
+}
+
+// ParseWithOptions loads and validates a Config from bs, applying the
+// optional checks requested in opts.
+func ParseWithOptions(bs []byte, opts ParseOptions) (*Config, error) {
+	if opts.ExpandEnv {
+		var err error
+		if bs, err = expandEnv(bs, opts.Env); err != nil {
+			return nil, fmt.Errorf("could not parse config: %s", err)
+		}
+	}
+
 	var raw configFile
 	if err := yaml.Unmarshal([]byte(bs), &raw); err != nil {
+		return nil, fmt.Errorf("could not parse config: %s", yamlError(bs, err))
+	}
+
+	// Problems found while parsing, which can't wait for validate.
+	var warnings []string
+	unknown, err := unknownAdvertisementKeys(bs)
+	if err != nil {
 		return nil, fmt.Errorf("could not parse config: %s", err)
 	}
+	for _, msg := range unknown {
+		switch {
+		case opts.IgnoreUnknownAdvertisementKeys:
+			warnings = append(warnings, msg+", ignoring")
+		case opts.Strict:
+			return nil, errors.New(msg)
+		default:
+			warnings = append(warnings, msg)
+		}
+	}
 
 	cfg := &Config{
 		Pools: map[string]*Pool{},
 	}
-	for i, p := range raw.Peers {
-		if p.MyASN == 0 {
-			return nil, fmt.Errorf("peer #%d missing local ASN", i+1)
+
+	if raw.GracefulShutdownTime != "" {
+		d, err := time.ParseDuration(raw.GracefulShutdownTime)
+		if err != nil {
+			return nil, fmt.Errorf("invalid graceful shutdown time %q: %s", raw.GracefulShutdownTime, err)
 		}
-		if p.ASN == 0 {
-			return nil, fmt.Errorf("peer #%d missing peer ASN", i+1)
+		cfg.GracefulShutdownTime = d
+	}
+
+	if raw.ReloadMinInterval != "" {
+		d, err := time.ParseDuration(raw.ReloadMinInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reload min interval %q: %s", raw.ReloadMinInterval, err)
+		}
+		cfg.ReloadMinInterval = d
+	}
+
+	cfg.BGPListenPort = 179
+	if raw.BGPListenPort != nil {
+		if *raw.BGPListenPort < 1 || *raw.BGPListenPort > 65535 {
+			return nil, fmt.Errorf("invalid bgp-listen-port %d: must be between 1 and 65535", *raw.BGPListenPort)
+		}
+		cfg.BGPListenPort = uint16(*raw.BGPListenPort)
+	}
+
+	for i, r := range raw.Rules {
+		cond, err := parseCondition(r.Condition)
+		if err != nil {
+			return nil, fmt.Errorf("invalid condition %q in rule #%d: %s", r.Condition, i+1, err)
+		}
+		cfg.Rules = append(cfg.Rules, &Rule{
+			Pool:      r.Pool,
+			PeerGroup: r.PeerGroup,
+			Condition: cond,
+			Action:    RuleAction(r.Action),
+		})
+	}
+
+	if raw.SpeakerNodeSelector != "" {
+		sel, err := labels.Parse(raw.SpeakerNodeSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid speaker node selector %q: %s", raw.SpeakerNodeSelector, err)
+		}
+		cfg.SpeakerNodeSelector = sel
+	}
+
+	if raw.Confederation != nil {
+		cfg.Confederation = &Confederation{
+			ID:      raw.Confederation.ID,
+			Members: raw.Confederation.Members,
+		}
+	}
+
+	if raw.Dampening != nil {
+		// Defaults are the values commonly used by router vendors.
+		d := &Dampening{
+			SuppressThreshold: 2000,
+			ReuseThreshold:    750,
+			HalfLife:          15 * time.Minute,
+			MaxSuppressTime:   60 * time.Minute,
 		}
-		ip := net.ParseIP(p.Addr)
+		if raw.Dampening.SuppressThreshold != nil {
+			d.SuppressThreshold = *raw.Dampening.SuppressThreshold
+		}
+		if raw.Dampening.ReuseThreshold != nil {
+			d.ReuseThreshold = *raw.Dampening.ReuseThreshold
+		}
+		var err error
+		if raw.Dampening.HalfLife != "" {
+			if d.HalfLife, err = time.ParseDuration(raw.Dampening.HalfLife); err != nil {
+				return nil, fmt.Errorf("invalid dampening half-life %q: %s", raw.Dampening.HalfLife, err)
+			}
+		}
+		if raw.Dampening.MaxSuppressTime != "" {
+			if d.MaxSuppressTime, err = time.ParseDuration(raw.Dampening.MaxSuppressTime); err != nil {
+				return nil, fmt.Errorf("invalid dampening max-suppress-time %q: %s", raw.Dampening.MaxSuppressTime, err)
+			}
+		}
+		cfg.Dampening = d
+	}
+
+	// Global timers act as defaults for all peers. They are checked
+	// here, since they don't survive into the Config.
+	defaultHoldTime, err := parseBGPTimer(raw.HoldTime, 90*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("invalid global hold time %q: %s", raw.HoldTime, err)
+	}
+	if err = validateHoldTime(defaultHoldTime); err != nil {
+		return nil, fmt.Errorf("invalid global hold time %q: %s", raw.HoldTime, err)
+	}
+	defaultKeepaliveTime, err := parseBGPTimer(raw.KeepaliveTime, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid global keepalive time %q: %s", raw.KeepaliveTime, err)
+	}
+	if raw.KeepaliveTime != "" {
+		if err = validateKeepaliveTime(defaultKeepaliveTime, defaultHoldTime); err != nil {
+			return nil, fmt.Errorf("invalid global keepalive time %q: %s", raw.KeepaliveTime, err)
+		}
+	}
+
+	if !opts.AllowWellKnownShadowing {
+		for _, name := range sortedKeys(raw.Communities) {
+			if _, ok := wellKnownCommunities[name]; ok {
+				return nil, fmt.Errorf("community alias %q shadows the well-known community of the same name", name)
+			}
+		}
+	}
+	communities, err := parseCommunityAliases(raw.Communities)
+	if err != nil {
+		return nil, err
+	}
+	if len(communities) > 0 {
+		cfg.CommunityAliases = communities
+	}
+
+	for _, p := range raw.Peers {
+		ip, zone := parseIPZone(p.Addr)
+		hostname := ""
 		if ip == nil {
-			return nil, fmt.Errorf("invalid peer IP %q", p.Addr)
+			hostname = p.Addr
+		}
+		holdTime, err := parseBGPTimer(p.HoldTime, defaultHoldTime)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hold time %q: %s", p.HoldTime, err)
+		}
+		// Absent any explicit keepalive, use the RFC4271 suggestion
+		// of a third of the hold time.
+		keepaliveTime := defaultKeepaliveTime
+		if raw.KeepaliveTime == "" {
+			keepaliveTime = time.Duration(int((holdTime / 3).Seconds())) * time.Second
+		}
+		keepaliveTime, err = parseBGPTimer(p.KeepaliveTime, keepaliveTime)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keepalive time %q: %s", p.KeepaliveTime, err)
 		}
-		holdTime, err := parseHoldTime(p.HoldTime)
+		retryTime, err := parseConnectRetryTime(p.ConnectRetryTime)
 		if err != nil {
 			return nil, err
 		}
+		// RFC4271 suggests 30s for EBGP and 5s for IBGP.
+		mrai := 30 * time.Second
+		if p.MyASN == p.ASN {
+			mrai = 5 * time.Second
+		}
+		if p.MRAI != "" {
+			if mrai, err = time.ParseDuration(p.MRAI); err != nil {
+				return nil, fmt.Errorf("invalid min-route-advertisement-interval %q: %s", p.MRAI, err)
+			}
+		}
 		port := uint16(179)
 		if p.Port != 0 {
 			port = p.Port
 		}
+		maxPrefixes := MaxPrefixes{
+			Limit:  p.MaxPrefixes,
+			Action: MaxPrefixesAction(p.MaxPrefixAction),
+		}
+		if maxPrefixes.Limit != 0 && maxPrefixes.Action == "" {
+			maxPrefixes.Action = MaxPrefixesWarn
+		}
+		if p.MinTTL < 0 || p.MinTTL > 255 {
+			return nil, fmt.Errorf("invalid min-ttl %d for peer %q: must be between 0 and 255", p.MinTTL, p.Addr)
+		}
+		var peerComms map[uint32]bool
+		for _, c := range p.Communities {
+			v, err := resolveCommunity(communities, c)
+			if err != nil {
+				return nil, fmt.Errorf("invalid community %q for peer %q: %s", c, p.Addr, err)
+			}
+			if peerComms == nil {
+				peerComms = map[uint32]bool{}
+			}
+			peerComms[v] = true
+		}
+		var stripComms map[uint32]bool
+		for _, c := range p.StripCommunities {
+			v, err := resolveCommunity(communities, c)
+			if err != nil {
+				return nil, fmt.Errorf("invalid strip community %q for peer %q: %s", c, p.Addr, err)
+			}
+			if peerComms[v] {
+				return nil, fmt.Errorf("peer %q both adds and strips community %q", p.Addr, c)
+			}
+			if stripComms == nil {
+				stripComms = map[uint32]bool{}
+			}
+			stripComms[v] = true
+		}
+		routeRefresh := true
+		if p.RouteRefresh != nil {
+			routeRefresh = *p.RouteRefresh
+		}
+		enabled := p.Enabled == nil || *p.Enabled
+		var caps map[Capability]bool
+		for _, c := range p.Capabilities {
+			if caps == nil {
+				caps = map[Capability]bool{}
+			}
+			caps[Capability(c)] = true
+		}
+		if p.AddPaths != "" {
+			if caps == nil {
+				caps = map[Capability]bool{}
+			}
+			caps[CapabilityAddPath] = true
+		}
+		var gr *GracefulRestart
+		if p.GracefulRestart != nil {
+			if !p.GracefulRestart.Enabled {
+				if p.GracefulRestart.StaleTime != "" {
+					return nil, fmt.Errorf("stale-time set for peer %q, but graceful-restart is disabled", p.Addr)
+				}
+			} else {
+				staleTime, err := parseBGPTimer(p.GracefulRestart.StaleTime, 360*time.Second)
+				if err != nil {
+					return nil, fmt.Errorf("invalid stale time %q: %s", p.GracefulRestart.StaleTime, err)
+				}
+				gr = &GracefulRestart{StaleTime: staleTime}
+			}
+		}
 		cfg.Peers = append(cfg.Peers, &Peer{
-			MyASN:    p.MyASN,
-			ASN:      p.ASN,
-			Addr:     ip,
-			Port:     port,
-			HoldTime: holdTime,
+			Name:             p.Name,
+			MyASN:            p.MyASN,
+			ASN:              p.ASN,
+			Addr:             ip,
+			Zone:             zone,
+			AddrHostname:     hostname,
+			Port:             port,
+			HoldTime:         holdTime,
+			KeepaliveTime:    keepaliveTime,
+			Passive:          p.Passive,
+			MinTTL:           uint8(p.MinTTL),
+			MaxPrefixes:      maxPrefixes,
+			ConnectRetryTime: retryTime,
+			MRAI:             mrai,
+			VRF:              p.VRF,
+			PeerGroup:        p.PeerGroup,
+			OriginateDefault: p.OriginateDefault,
+			Disable4ByteASN:  p.Disable4ByteASN,
+			RouteRefresh:     routeRefresh,
+			Enabled:          enabled,
+			Communities:      peerComms,
+			StripCommunities: stripComms,
+			GracefulRestart:  gr,
+			Capabilities:     caps,
+			AddPaths:         AddPathsMode(p.AddPaths),
 		})
 	}
 
-	communities := map[string]uint32{}
-	for n, v := range raw.Communities {
-		c, err := parseCommunity(v)
+	// Pool references are resolved once the pools are parsed.
+	var excludedPools []string
+	for _, cidr := range raw.ExcludeAddresses {
+		if strings.HasPrefix(cidr, "pool:") {
+			excludedPools = append(excludedPools, strings.TrimPrefix(cidr, "pool:"))
+			continue
+		}
+		n, err := parseCIDR(cidr)
 		if err != nil {
-			return nil, fmt.Errorf("parsing community %q: %s", n, err)
+			return nil, fmt.Errorf("invalid excluded CIDR %q", cidr)
+		}
+		cfg.ExcludeAddresses = append(cfg.ExcludeAddresses, n)
+	}
+
+	// Global defaults are merged into each pool below, so that the
+	// Config describes exactly what gets applied.
+	defaultComms := map[uint32]bool{}
+	for _, c := range raw.DefaultCommunities {
+		v, err := resolveCommunity(communities, c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid default community %q: %s", c, err)
+		}
+		defaultComms[v] = true
+	}
+	defaultAgLen := 32
+	if raw.DefaultAggLength != nil {
+		defaultAgLen = *raw.DefaultAggLength
+	}
+	defaultLocalPref := uint32(0)
+	if raw.LocalPref != nil {
+		if defaultLocalPref, err = parseLocalPref(*raw.LocalPref); err != nil {
+			return nil, fmt.Errorf("invalid global localpref %d: %s", *raw.LocalPref, err)
 		}
-		communities[n] = c
 	}
 
-	var allCIDRs []*net.IPNet
 	for i, p := range raw.Pools {
 		if p.Name == "" {
 			return nil, fmt.Errorf("address pool #%d is missing name", i+1)
@@ -170,98 +1122,2159 @@ func Parse(bs []byte) (*Config, error) {
 		if _, ok := cfg.Pools[p.Name]; ok {
 			return nil, fmt.Errorf("duplicate pool definition for %q", p.Name)
 		}
+		proto := BGP
+		var protos []Proto
+		if p.Protocol != nil && len(p.Protocol) == 0 {
+			return nil, fmt.Errorf("pool %q lists no protocols", p.Name)
+		}
+		for _, pr := range p.Protocol {
+			for _, seen := range protos {
+				if Proto(pr) == seen {
+					return nil, fmt.Errorf("duplicate protocol %q in pool %q", pr, p.Name)
+				}
+			}
+			protos = append(protos, Proto(pr))
+		}
+		if len(protos) > 0 && protos[0] != "" {
+			proto = protos[0]
+		}
+		if len(protos) < 2 {
+			protos = nil
+		}
+		avoidBuggyIPs := raw.AvoidBuggyIPs
+		if p.AvoidBuggyIPs != nil {
+			avoidBuggyIPs = *p.AvoidBuggyIPs
+		}
 		pool := &Pool{
-			AvoidBuggyIPs: p.AvoidBuggyIPs,
+			Protocol:           proto,
+			Protocols:          protos,
+			AvoidBuggyIPs:      avoidBuggyIPs,
+			IncludeNetwork:     p.IncludeNetwork,
+			IncludeBroadcast:   p.IncludeBroadcast,
+			AllocationStrategy: AllocationStrategy(p.AllocationStrategy),
+			CIDROrder:          CIDROrder(p.CIDROrder),
+			Weight:             p.Weight,
+			IPFamily:           IPFamily(p.IPFamily),
+			InterfaceSelection: InterfaceSelection(p.InterfaceSelection),
+			Interfaces:         p.Interfaces,
+		}
+		if p.AnnounceDelay != "" {
+			d, err := time.ParseDuration(p.AnnounceDelay)
+			if err != nil {
+				return nil, fmt.Errorf("invalid announce delay %q in pool %q: %s", p.AnnounceDelay, p.Name, err)
+			}
+			pool.AnnounceDelay = d
+		}
+		pool.System = p.System
+		// System pools are only ever asked for by name.
+		pool.AutoAssign = !p.System
+		if p.AutoAssign != nil {
+			pool.AutoAssign = *p.AutoAssign
+		}
+		if p.ServiceClass != nil {
+			if *p.ServiceClass == "" {
+				return nil, fmt.Errorf("empty service-class in pool %q", p.Name)
+			}
+			pool.ServiceClass = *p.ServiceClass
 		}
 		cfg.Pools[p.Name] = pool
 
 		for _, cidr := range p.CIDR {
-			_, n, err := net.ParseCIDR(cidr)
+			if strings.Contains(cidr, "-") {
+				ns, err := parseRange(cidr)
+				if err != nil {
+					return nil, fmt.Errorf("invalid range %q in pool %q: %s", cidr, p.Name, err)
+				}
+				pool.CIDR = append(pool.CIDR, ns...)
+				continue
+			}
+			n, err := parseCIDR(cidr)
 			if err != nil {
 				return nil, fmt.Errorf("invalid CIDR %q in pool %q", cidr, p.Name)
 			}
-			for _, m := range allCIDRs {
-				if cidrsOverlap(n, m) {
-					return nil, fmt.Errorf("CIDR %q in pool %q overlaps with already defined CIDR %q", n, p.Name, m)
-				}
-			}
 			pool.CIDR = append(pool.CIDR, n)
-			allCIDRs = append(allCIDRs, n)
+		}
+		// A canonical order makes equivalent configs identical,
+		// whatever order their CIDRs are listed in.
+		if pool.CIDROrder != CIDROrderListed {
+			sortCIDRs(pool.CIDR)
 		}
 
-		for _, ad := range p.Advertisements {
-			// TODO: ipv6 support :(
-			agLen := 32
-			if ad.AggregationLength != nil {
-				agLen = *ad.AggregationLength
-			}
-			if agLen > 32 {
-				return nil, fmt.Errorf("invalid aggregation length %q in pool %q", ad.AggregationLength, p.Name)
+		for _, sel := range p.NodeSelectors {
+			ls, err := labels.Parse(sel)
+			if err != nil {
+				return nil, fmt.Errorf("invalid node selector %q in pool %q: %s", sel, p.Name, err)
 			}
-			for _, cidr := range pool.CIDR {
-				o, _ := cidr.Mask.Size()
-				if agLen < o {
-					return nil, fmt.Errorf("invalid aggregation length %d in pool %q: prefix %q in this pool is more specific than the aggregation length", ad.AggregationLength, p.Name, cidr)
-				}
+			pool.NodeSelectors = append(pool.NodeSelectors, ls)
+		}
+
+		for _, sel := range p.ServiceSelectors {
+			ls, err := labels.Parse(sel)
+			if err != nil {
+				return nil, fmt.Errorf("invalid service selector %q in pool %q: %s", sel, p.Name, err)
 			}
+			pool.ServiceSelectors = append(pool.ServiceSelectors, ls)
+		}
 
-			comms := map[uint32]bool{}
-			for _, c := range ad.Communities {
-				if v, ok := communities[c]; ok {
-					comms[v] = true
-				} else {
-					v, err := parseCommunity(c)
-					if err != nil {
-						return nil, fmt.Errorf("invalid community %q in advertisement of pool %q: %s", c, p.Name, err)
-					}
-					comms[v] = true
-				}
+		for _, np := range p.NodePriorities {
+			ls, err := labels.Parse(np.NodeSelector)
+			if err != nil {
+				return nil, fmt.Errorf("invalid node priority selector %q in pool %q: %s", np.NodeSelector, p.Name, err)
 			}
+			pool.NodePriorities = append(pool.NodePriorities, NodePriority{
+				Selector: ls,
+				Priority: np.Priority,
+			})
+		}
 
-			localPref := uint32(0)
-			if ad.LocalPref != nil {
-				localPref = *ad.LocalPref
+		for _, cidr := range p.ReservedAddresses {
+			n, err := parseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid reserved CIDR %q in pool %q", cidr, p.Name)
 			}
+			pool.Reserved = append(pool.Reserved, n)
+		}
 
-			pool.Advertisements = append(pool.Advertisements, &Advertisement{
-				AggregationLength: agLen,
-				LocalPref:         localPref,
-				Communities:       comms,
+		for _, pin := range p.PinnedAddresses {
+			ip := net.ParseIP(pin.Address)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid pinned address %q in pool %q", pin.Address, p.Name)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			pool.PinnedAddresses = append(pool.PinnedAddresses, PinnedAddress{
+				IP:      ip,
+				Service: pin.Service,
 			})
 		}
-	}
 
-	return cfg, nil
-}
+		// Default and pool-level communities apply to every
+		// advertisement of the pool.
+		poolComms := map[uint32]bool{}
+		for c := range defaultComms {
+			poolComms[c] = true
+		}
+		for _, c := range p.Communities {
+			v, err := resolveCommunity(communities, c)
+			if err != nil {
+				return nil, fmt.Errorf("invalid community %q in pool %q: %s", c, p.Name, err)
+			}
+			poolComms[v] = true
+		}
+		if p.TagCommunityASN != nil {
+			asn := *p.TagCommunityASN
+			if asn < 1 || asn > 65535 {
+				return nil, fmt.Errorf("invalid tag-community-asn %d in pool %q: must fit in 16 bits", asn, p.Name)
+			}
+			pool.TagCommunityASN = uint16(asn)
+			poolComms[TagCommunity(pool.TagCommunityASN, p.Name)] = true
+		}
 
-func parseCommunity(c string) (uint32, error) {
-	fs := strings.Split(c, ":")
-	if len(fs) != 2 {
-		return 0, fmt.Errorf("invalid community string %q", c)
-	}
-	a, err := strconv.ParseUint(fs[0], 10, 16)
-	if err != nil {
-		return 0, fmt.Errorf("invalid first section of community %q: %s", fs[0], err)
-	}
-	b, err := strconv.ParseUint(fs[1], 10, 16)
-	if err != nil {
-		return 0, fmt.Errorf("invalid second section of community %q: %s", fs[0], err)
+		for _, c := range p.AllowedCommunities {
+			v, err := resolveCommunity(communities, c)
+			if err != nil {
+				return nil, fmt.Errorf("invalid allowed community %q in pool %q: %s", c, p.Name, err)
+			}
+			if pool.AllowedCommunities == nil {
+				pool.AllowedCommunities = map[uint32]bool{}
+			}
+			pool.AllowedCommunities[v] = true
+		}
+
+		pool.AllowedAggregationLengths = p.AllowedAggLengths
+
+		for _, ad := range p.Advertisements {
+			agLen := defaultAgLen
+			if ad.AggregationLength != nil {
+				agLen = *ad.AggregationLength
+			}
+			agLenV6 := 128
+			if ad.AggregationLengthV6 != nil {
+				agLenV6 = *ad.AggregationLengthV6
+			}
+
+			// An explicitly empty cidr list selects nothing, which
+			// validate flags.
+			var adCIDRs []*net.IPNet
+			if ad.CIDR != nil {
+				adCIDRs = []*net.IPNet{}
+			}
+			for _, cidr := range ad.CIDR {
+				n, err := parseCIDR(cidr)
+				if err != nil {
+					return nil, fmt.Errorf("invalid CIDR %q in advertisement of pool %q", cidr, p.Name)
+				}
+				adCIDRs = append(adCIDRs, n)
+			}
+			// An aggregation length for a family the advertisement
+			// doesn't select is a mistake, not a harmless default.
+			if adCIDRs != nil {
+				hasV4, hasV6 := false, false
+				for _, n := range adCIDRs {
+					if n.IP.To4() != nil {
+						hasV4 = true
+					} else {
+						hasV6 = true
+					}
+				}
+				if ad.AggregationLength != nil && !hasV4 {
+					return nil, fmt.Errorf("advertisement of pool %q sets aggregation-length, but selects no IPv4 CIDRs", p.Name)
+				}
+				if ad.AggregationLengthV6 != nil && !hasV6 {
+					return nil, fmt.Errorf("advertisement of pool %q sets aggregation-length-v6, but selects no IPv6 CIDRs", p.Name)
+				}
+				// Nor does default-aggregation-length apply.
+				if !hasV4 {
+					agLen = 32
+				}
+			}
+
+			// A missing communities key inherits the pool and
+			// default communities, an explicitly empty list clears
+			// them.
+			comms := map[uint32]bool{}
+			if ad.Communities == nil || len(ad.Communities) > 0 {
+				for c := range poolComms {
+					comms[c] = true
+				}
+			}
+			for _, c := range ad.Communities {
+				v, err := resolveCommunity(communities, c)
+				if err != nil {
+					return nil, fmt.Errorf("invalid community %q in advertisement of pool %q: %s", c, p.Name, err)
+				}
+				comms[v] = true
+			}
+			if ad.Blackhole {
+				comms[BlackholeCommunity] = true
+			}
+			if ad.LocalOnly {
+				comms[NoExportCommunity] = true
+			}
+
+			var removeComms map[uint32]bool
+			for _, c := range ad.RemoveCommunities {
+				v, err := resolveCommunity(communities, c)
+				if err != nil {
+					return nil, fmt.Errorf("invalid community %q in remove-communities of advertisement of pool %q: %s", c, p.Name, err)
+				}
+				if removeComms == nil {
+					removeComms = map[uint32]bool{}
+				}
+				removeComms[v] = true
+			}
+			// Removing pool-wide communities is the point, but
+			// adding and removing the same community in one
+			// advertisement is a contradiction.
+			for _, c := range ad.Communities {
+				if v, _ := resolveCommunity(communities, c); removeComms[v] {
+					return nil, fmt.Errorf("advertisement of pool %q both adds and removes community %q", p.Name, c)
+				}
+			}
+			if ad.Blackhole && removeComms[BlackholeCommunity] {
+				return nil, fmt.Errorf("blackhole advertisement of pool %q removes the blackhole community", p.Name)
+			}
+			if ad.LocalOnly && removeComms[NoExportCommunity] {
+				return nil, fmt.Errorf("local-only advertisement of pool %q removes the no-export community", p.Name)
+			}
+			for c := range removeComms {
+				delete(comms, c)
+			}
+
+			largeComms := map[LargeCommunity]bool{}
+			for _, c := range ad.LargeCommunities {
+				if _, ok := communities[c]; ok {
+					return nil, fmt.Errorf("invalid large community %q in advertisement of pool %q: community aliases are standard communities, list it under communities instead", c, p.Name)
+				}
+				v, err := parseLargeCommunity(c)
+				if err != nil {
+					return nil, fmt.Errorf("invalid large community %q in advertisement of pool %q: %s", c, p.Name, err)
+				}
+				largeComms[v] = true
+			}
+
+			localPref := defaultLocalPref
+			if ad.LocalPref != nil {
+				if localPref, err = parseLocalPref(*ad.LocalPref); err != nil {
+					return nil, fmt.Errorf("invalid localpref %d in advertisement of pool %q: %s", *ad.LocalPref, p.Name, err)
+				}
+			}
+
+			origin := OriginIGP
+			if ad.Origin != "" {
+				origin = Origin(ad.Origin)
+			}
+
+			var nextHop, nextHopLL net.IP
+			if ad.NextHop != "" {
+				if nextHop = net.ParseIP(ad.NextHop); nextHop == nil {
+					return nil, fmt.Errorf("invalid next-hop %q in advertisement of pool %q", ad.NextHop, p.Name)
+				}
+			}
+			if ad.NextHopLinkLocal != "" {
+				if nextHopLL = net.ParseIP(ad.NextHopLinkLocal); nextHopLL == nil {
+					return nil, fmt.Errorf("invalid next-hop-link-local %q in advertisement of pool %q", ad.NextHopLinkLocal, p.Name)
+				}
+			}
+
+			// "aggregate: true/false" is shorthand for the
+			// corresponding advertisement-type.
+			adType := AdvertisementType(ad.Type)
+			if ad.Aggregate != nil {
+				t := AdvertiseHost
+				if *ad.Aggregate {
+					t = AdvertiseAggregate
+				}
+				if adType != "" && adType != t {
+					return nil, fmt.Errorf("advertisement in pool %q sets aggregate: %v, which conflicts with advertisement-type %q", p.Name, *ad.Aggregate, adType)
+				}
+				adType = t
+			}
+
+			pool.Advertisements = append(pool.Advertisements, &Advertisement{
+				AggregationLength:   agLen,
+				AggregationLengthV6: agLenV6,
+				LocalPref:           localPref,
+				Communities:         comms,
+				LargeCommunities:    largeComms,
+				RemoveCommunities:   removeComms,
+				Enabled:             ad.Enabled == nil || *ad.Enabled,
+				NextHop:             nextHop,
+				NextHopLinkLocal:    nextHopLL,
+				Origin:              origin,
+				Blackhole:           ad.Blackhole,
+				LocalOnly:           ad.LocalOnly,
+				CIDR:                adCIDRs,
+				Type:                adType,
+				PeerGroups:          ad.PeerGroups,
+				NoAdvertiseEBGP:     ad.NoAdvertiseEBGP,
+			})
+		}
+	}
+
+	for _, name := range excludedPools {
+		pool := cfg.Pools[name]
+		if pool == nil {
+			return nil, fmt.Errorf("excluded addresses refer to unknown pool %q", name)
+		}
+		cfg.ExcludeAddresses = append(cfg.ExcludeAddresses, pool.CIDR...)
+	}
+
+	validateWarnings, err := cfg.validate(opts)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Warnings = append(warnings, validateWarnings...)
+
+	return cfg, nil
+}
+
+// Validate checks that c is semantically valid. It returns an error
+// describing the first problem found, or the warnings for problems
+// that don't make c unusable, as Parse records in Config.Warnings.
+// Parse runs the same checks on the configurations it returns, so only
+// hand-constructed Configs need to be checked explicitly. Validate
+// doesn't modify c, use ApplyDefaults first to fill in the settings
+// that Parse defaults.
+func (c *Config) Validate() ([]string, error) {
+	return c.validate(ParseOptions{})
+}
+
+// ApplyDefaults replaces the zero values in c that Parse never
+// produces with Parse's defaults: BGPListenPort and peer ports become
+// 179, a peer's ConnectRetryTime 2s, its KeepaliveTime a third of a
+// non-zero HoldTime, and an advertisement's Origin igp. A zero
+// HoldTime or MRAI is meaningful, it disables the timer, so those are
+// left alone.
+func (c *Config) ApplyDefaults() {
+	if c.BGPListenPort == 0 {
+		c.BGPListenPort = 179
+	}
+	for _, p := range c.Peers {
+		if p.Port == 0 {
+			p.Port = 179
+		}
+		if p.ConnectRetryTime == 0 {
+			p.ConnectRetryTime = 2 * time.Second
+		}
+		if p.KeepaliveTime == 0 && p.HoldTime != 0 {
+			p.KeepaliveTime = time.Duration(int((p.HoldTime / 3).Seconds())) * time.Second
+		}
+	}
+	for _, pool := range c.Pools {
+		for _, ad := range pool.Advertisements {
+			if ad.Origin == "" {
+				ad.Origin = OriginIGP
+			}
+		}
+	}
+}
+
+// Ready returns whether c gives MetalLB anything to do, i.e. has at
+// least one pool or peer, and if not, a reason suitable for a
+// readiness check. Ready doesn't check that c is valid, see Validate
+// for that.
+func (c *Config) Ready() (bool, string) {
+	if c == nil {
+		return false, "no configuration"
+	}
+	if len(c.Pools) == 0 && len(c.Peers) == 0 {
+		return false, "configuration has no address pools or peers"
+	}
+	return true, ""
+}
+
+// ValidateAgainstNodes returns warnings for the node selectors in c
+// that match none of the given nodes, each described by its labels.
+// Such selectors leave their pool's addresses unannounced, as does a
+// speaker-node-selector that matches no nodes for the bgp pools.
+func (c *Config) ValidateAgainstNodes(nodeLabels []map[string]string) []string {
+	var ret []string
+	if c.SpeakerNodeSelector != nil && c.anyPeerEnabled() {
+		speakers := false
+		for _, l := range nodeLabels {
+			if c.SpeakerSelectsNode(l) {
+				speakers = true
+				break
+			}
+		}
+		for _, name := range c.PoolNames() {
+			if !speakers && c.Pools[name].Speaks(BGP) {
+				ret = append(ret, fmt.Sprintf("speaker node selector %q matches no nodes, so bgp pool %q can't be announced", c.SpeakerNodeSelector, name))
+			}
+		}
+	}
+	for _, name := range c.PoolNames() {
+	selectors:
+		for _, sel := range c.Pools[name].NodeSelectors {
+			for _, l := range nodeLabels {
+				if sel.Matches(labels.Set(l)) {
+					continue selectors
+				}
+			}
+			ret = append(ret, fmt.Sprintf("node selector %q of pool %q matches no nodes", sel, name))
+		}
+	}
+	return ret
+}
+
+// anyPeerEnabled returns true if at least one of c's peers is enabled.
+func (c *Config) anyPeerEnabled() bool {
+	for _, p := range c.Peers {
+		if p.Enabled {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks c for problems. It returns an error for the first
+// problem that makes c unusable, or a list of warnings for problems
+// that the operator should know about, but that don't prevent c from
+// being used.
+func (c *Config) validate(opts ParseOptions) ([]string, error) {
+	var warnings []string
+	// warn records a non-fatal problem, or returns it as an error in
+	// strict mode.
+	warn := func(format string, args ...interface{}) error {
+		if opts.Strict {
+			return fmt.Errorf(format, args...)
+		}
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+		return nil
+	}
+
+	if c.GracefulShutdownTime < 0 {
+		return nil, fmt.Errorf("invalid graceful shutdown time %q: must not be negative", c.GracefulShutdownTime)
+	}
+	if c.ReloadMinInterval < 0 {
+		return nil, fmt.Errorf("invalid reload min interval %q: must not be negative", c.ReloadMinInterval)
+	}
+
+	if d := c.Dampening; d != nil {
+		if d.ReuseThreshold <= 0 {
+			return nil, fmt.Errorf("invalid dampening reuse threshold %d: must be positive", d.ReuseThreshold)
+		}
+		if d.ReuseThreshold >= d.SuppressThreshold {
+			return nil, fmt.Errorf("invalid dampening thresholds: reuse threshold %d must be less than suppress threshold %d", d.ReuseThreshold, d.SuppressThreshold)
+		}
+		if d.HalfLife <= 0 {
+			return nil, fmt.Errorf("invalid dampening half-life %q: must be positive", d.HalfLife)
+		}
+		if d.MaxSuppressTime < d.HalfLife {
+			return nil, fmt.Errorf("invalid dampening max-suppress-time %q: must be at least the half-life (%s)", d.MaxSuppressTime, d.HalfLife)
+		}
+	}
+
+	confedMembers := map[uint32]bool{}
+	if cf := c.Confederation; cf != nil {
+		if cf.ID == 0 {
+			return nil, errors.New("confederation is missing confed-id")
+		}
+		if len(cf.Members) == 0 {
+			return nil, errors.New("confederation has no members")
+		}
+		for _, m := range cf.Members {
+			if m == 0 {
+				return nil, errors.New("invalid confederation member ASN 0")
+			}
+			if m == cf.ID {
+				return nil, fmt.Errorf("confederation member ASN %d is the same as the confed-id", m)
+			}
+			confedMembers[m] = true
+		}
+	}
+
+	if opts.MaxPeers > 0 && len(c.Peers) > opts.MaxPeers {
+		return nil, fmt.Errorf("config has %d peers, more than the limit of %d", len(c.Peers), opts.MaxPeers)
+	}
+
+	// A peer group exists by virtue of having peers in it, but only
+	// its enabled peers announce anything.
+	peerGroups, enabledGroups := map[string]bool{}, map[string]bool{}
+	peerNames := map[string]bool{}
+	for i, p := range c.Peers {
+		if p.PeerGroup != "" {
+			peerGroups[p.PeerGroup] = true
+			if p.Enabled {
+				enabledGroups[p.PeerGroup] = true
+			}
+		}
+		if p.Name != "" {
+			if !dns1123LabelRe.MatchString(p.Name) {
+				return nil, fmt.Errorf("invalid name %q for peer #%d: must be a DNS-1123 label", p.Name, i+1)
+			}
+			if peerNames[p.Name] {
+				return nil, fmt.Errorf("duplicate peer name %q", p.Name)
+			}
+			peerNames[p.Name] = true
+		}
+		if p.MyASN == 0 {
+			return nil, fmt.Errorf("peer #%d missing local ASN", i+1)
+		}
+		if p.ASN == 0 {
+			return nil, fmt.Errorf("peer #%d missing peer ASN", i+1)
+		}
+		if opts.RejectDocumentationASN {
+			if isDocumentationASN(p.MyASN) {
+				return nil, fmt.Errorf("peer #%d uses local ASN %d, which is reserved for documentation", i+1, p.MyASN)
+			}
+			if isDocumentationASN(p.ASN) {
+				return nil, fmt.Errorf("peer #%d uses peer ASN %d, which is reserved for documentation", i+1, p.ASN)
+			}
+		}
+		if c.Confederation != nil && !confedMembers[p.MyASN] {
+			return nil, fmt.Errorf("peer #%d has my-asn %d, which is not a member of confederation %d", i+1, p.MyASN, c.Confederation.ID)
+		}
+		if p.Disable4ByteASN && (p.MyASN > 65535 || p.ASN > 65535) {
+			return nil, fmt.Errorf("peer #%d has disable-4byte-asn, but its ASNs %d and %d don't both fit in 2 bytes", i+1, p.MyASN, p.ASN)
+		}
+		if gr := p.GracefulRestart; gr != nil && (gr.StaleTime < time.Second || gr.StaleTime > 4095*time.Second) {
+			return nil, fmt.Errorf("invalid stale time %q for peer #%d: must be between 1s and 4095s", gr.StaleTime, i+1)
+		}
+		if p.Addr != nil && p.AddrHostname != "" {
+			return nil, fmt.Errorf("peer #%d has both an IP address and a hostname", i+1)
+		}
+		if p.Addr == nil && !isHostname(p.AddrHostname) {
+			return nil, fmt.Errorf("invalid peer address %q, must be an IP address or hostname", p.AddrHostname)
+		}
+		if p.Passive && p.Addr == nil {
+			return nil, fmt.Errorf("passive peer %q must be given by IP address, so that inbound connections can be matched to it", p.AddrHostname)
+		}
+		// With the default port on both ends this is normal, but a
+		// custom listen port showing up as the peer's port usually
+		// means the two got mixed up.
+		if p.Passive && c.BGPListenPort != 179 && p.Port == c.BGPListenPort {
+			if err := warn("passive peer %q has peer-port %d, the same as bgp-listen-port, but peer-port is the router's port, not the one MetalLB listens on", p.Addr, p.Port); err != nil {
+				return nil, err
+			}
+		}
+		if p.Addr != nil && p.Addr.To4() == nil && p.Addr.IsLinkLocalUnicast() {
+			if p.Zone == "" {
+				return nil, fmt.Errorf("peer #%d has link-local address %q, which requires a zone (e.g. %s%%eth0)", i+1, p.Addr, p.Addr)
+			}
+			if !isInterfaceName(p.Zone) {
+				return nil, fmt.Errorf("peer #%d has invalid zone %q, must be a network interface name", i+1, p.Zone)
+			}
+		} else if p.Zone != "" {
+			return nil, fmt.Errorf("peer #%d has zone %q, but zones are only valid for IPv6 link-local addresses", i+1, p.Zone)
+		}
+		switch p.MaxPrefixes.Action {
+		case MaxPrefixesWarn, MaxPrefixesRestart, MaxPrefixesDisable:
+			if p.MaxPrefixes.Limit == 0 {
+				return nil, fmt.Errorf("peer #%d has max-prefixes-action %q but no max-prefixes limit", i+1, p.MaxPrefixes.Action)
+			}
+		case "":
+			if p.MaxPrefixes.Limit != 0 {
+				return nil, fmt.Errorf("peer #%d has max-prefixes %d but no max-prefixes-action", i+1, p.MaxPrefixes.Limit)
+			}
+		default:
+			return nil, fmt.Errorf("peer #%d has unknown max-prefixes-action %q", i+1, p.MaxPrefixes.Action)
+		}
+		for c := range p.Capabilities {
+			switch c {
+			case CapabilityAddPath, CapabilityExtendedNextHop, CapabilityEnhancedRouteRefresh:
+			default:
+				return nil, fmt.Errorf("peer #%d has unknown capability %q", i+1, c)
+			}
+		}
+		switch p.AddPaths {
+		case "", AddPathsReceive, AddPathsSend, AddPathsBoth:
+		default:
+			return nil, fmt.Errorf("peer #%d has unknown add-paths mode %q", i+1, p.AddPaths)
+		}
+		if p.Port == 0 {
+			return nil, fmt.Errorf("peer #%d missing peer port", i+1)
+		}
+		if err := validateHoldTime(p.HoldTime); err != nil {
+			return nil, fmt.Errorf("invalid hold time %q for peer #%d: %s", p.HoldTime, i+1, err)
+		}
+		if err := validateKeepaliveTime(p.KeepaliveTime, p.HoldTime); err != nil {
+			return nil, fmt.Errorf("invalid keepalive time %q for peer #%d: %s", p.KeepaliveTime, i+1, err)
+		}
+		if p.ConnectRetryTime <= 0 {
+			return nil, fmt.Errorf("invalid connect retry time %q for peer #%d: must be positive", p.ConnectRetryTime, i+1)
+		}
+		if p.MRAI < 0 {
+			return nil, fmt.Errorf("invalid min-route-advertisement-interval %q for peer #%d: must not be negative", p.MRAI, i+1)
+		}
+		// VRFs are network devices, so they follow the same naming
+		// rules as interfaces.
+		if p.VRF != "" && !isInterfaceName(p.VRF) {
+			return nil, fmt.Errorf("invalid VRF name %q for peer #%d", p.VRF, i+1)
+		}
+		if p.OriginateDefault {
+			bgpPools := 0
+			for _, pool := range c.Pools {
+				if pool.Speaks(BGP) {
+					bgpPools++
+				}
+			}
+			if len(c.Pools) > 0 && bgpPools == 0 {
+				return nil, fmt.Errorf("peer #%d has originate-default, which requires BGP mode, but no address pool uses the bgp protocol", i+1)
+			}
+			if bgpPools > 0 {
+				if err := warn("peer #%d is sent a default route as well as the routes of %d bgp address pools, so it may send all of its traffic to MetalLB nodes", i+1, bgpPools); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	var allCIDRs []*net.IPNet
+	pinnedIPs, pinnedSvcs := map[string]bool{}, map[string]bool{}
+	for _, name := range c.PoolNames() {
+		pool := c.Pools[name]
+		if name == "" {
+			return nil, errors.New("address pool is missing name")
+		}
+
+		for _, proto := range pool.protocols() {
+			if proto != BGP && proto != Layer2 {
+				return nil, fmt.Errorf("unknown protocol %q in pool %q", proto, name)
+			}
+		}
+		// Pools announced with both protocols may have the settings
+		// of either.
+		if !pool.Speaks(Layer2) {
+			if len(pool.NodeSelectors) > 0 {
+				return nil, fmt.Errorf("pool %q has node selectors, which are only valid for layer2 pools", name)
+			}
+			if len(pool.NodePriorities) > 0 {
+				return nil, fmt.Errorf("pool %q has node priorities, which are only valid for layer2 pools", name)
+			}
+			if pool.InterfaceSelection != "" || len(pool.Interfaces) > 0 {
+				return nil, fmt.Errorf("pool %q has interface settings, which are only valid for layer2 pools", name)
+			}
+		}
+		if !pool.Speaks(BGP) && len(pool.Advertisements) > 0 {
+			return nil, fmt.Errorf("pool %q has BGP advertisements, which are only valid for bgp pools", name)
+		}
+		if pool.Speaks(Layer2) {
+			switch pool.InterfaceSelection {
+			case "", InterfaceAuto:
+				if len(pool.Interfaces) > 0 {
+					return nil, fmt.Errorf("pool %q lists interfaces, which requires interface-selection %s", name, InterfaceExplicit)
+				}
+			case InterfaceExplicit:
+				if len(pool.Interfaces) == 0 {
+					return nil, fmt.Errorf("pool %q has interface-selection %s, but lists no interfaces", name, InterfaceExplicit)
+				}
+			default:
+				return nil, fmt.Errorf("unknown interface-selection %q in pool %q", pool.InterfaceSelection, name)
+			}
+			for _, intf := range pool.Interfaces {
+				if !isInterfaceName(intf) {
+					return nil, fmt.Errorf("invalid interface name %q in pool %q", intf, name)
+				}
+			}
+		}
+
+		for _, n := range pool.CIDR {
+			for _, m := range allCIDRs {
+				if cidrsOverlap(n, m) {
+					return nil, fmt.Errorf("CIDR %q in pool %q overlaps with already defined CIDR %q", n, name, m)
+				}
+			}
+			allCIDRs = append(allCIDRs, n)
+		}
+
+		for i, n := range pool.Reserved {
+			if !pool.ContainsCIDR(n) {
+				return nil, fmt.Errorf("reserved CIDR %q in pool %q is not within any of the pool's CIDRs", n, name)
+			}
+			for _, m := range pool.Reserved[:i] {
+				if cidrsOverlap(n, m) {
+					return nil, fmt.Errorf("reserved CIDR %q in pool %q overlaps with already reserved CIDR %q", n, name, m)
+				}
+			}
+		}
+
+		for _, pin := range pool.PinnedAddresses {
+			if fs := strings.Split(pin.Service, "/"); len(fs) != 2 || fs[0] == "" || fs[1] == "" {
+				return nil, fmt.Errorf("invalid service %q pinned to %q in pool %q, must be namespace/name", pin.Service, pin.IP, name)
+			}
+			if !pool.ContainsCIDR(&net.IPNet{IP: pin.IP, Mask: net.CIDRMask(len(pin.IP)*8, len(pin.IP)*8)}) {
+				return nil, fmt.Errorf("pinned address %q in pool %q is not within any of the pool's CIDRs", pin.IP, name)
+			}
+			if !poolContainsIP(pool, pin.IP) {
+				return nil, fmt.Errorf("pinned address %q in pool %q is a reserved address, and can't be allocated", pin.IP, name)
+			}
+			if pinnedIPs[pin.IP.String()] {
+				return nil, fmt.Errorf("address %q is pinned more than once", pin.IP)
+			}
+			if pinnedSvcs[pin.Service] {
+				return nil, fmt.Errorf("service %q has more than one pinned address", pin.Service)
+			}
+			pinnedIPs[pin.IP.String()] = true
+			pinnedSvcs[pin.Service] = true
+		}
+
+		if (pool.IncludeNetwork || pool.IncludeBroadcast) && !pool.HasFamily(IPv4) {
+			return nil, fmt.Errorf("include-network and include-broadcast only apply to IPv4, but pool %q has no IPv4 CIDRs", name)
+		}
+
+		switch pool.IPFamily {
+		case "":
+		case IPv4, IPv6:
+			for _, n := range pool.CIDR {
+				if (n.IP.To4() != nil) != (pool.IPFamily == IPv4) {
+					return nil, fmt.Errorf("CIDR %q in pool %q does not match the pool's ip-family %s", n, name, pool.IPFamily)
+				}
+			}
+		case DualStack:
+			if !pool.HasFamily(IPv4) || !pool.HasFamily(IPv6) {
+				return nil, fmt.Errorf("pool %q has ip-family %s, but does not contain both IPv4 and IPv6 CIDRs", name, pool.IPFamily)
+			}
+		default:
+			return nil, fmt.Errorf("unknown ip-family %q in pool %q", pool.IPFamily, name)
+		}
+
+		switch pool.AllocationStrategy {
+		case "", AllocateLowest, AllocateHighest, AllocateRandom, AllocateHashed:
+		default:
+			return nil, fmt.Errorf("unknown allocation strategy %q in pool %q", pool.AllocationStrategy, name)
+		}
+		switch pool.CIDROrder {
+		case "", CIDROrderSorted, CIDROrderListed:
+		default:
+			return nil, fmt.Errorf("unknown cidr-order %q in pool %q", pool.CIDROrder, name)
+		}
+
+		if pool.System && pool.AutoAssign {
+			return nil, fmt.Errorf("pool %q is a system pool, and cannot be auto-assign", name)
+		}
+
+		for _, np := range pool.NodePriorities {
+			if np.Priority < 0 {
+				return nil, fmt.Errorf("invalid priority %d for nodes %q in pool %q: must be non-negative", np.Priority, np.Selector, name)
+			}
+		}
+
+		if pool.Weight < 0 {
+			return nil, fmt.Errorf("invalid weight %d in pool %q: must be non-negative", pool.Weight, name)
+		}
+		if pool.AnnounceDelay < 0 {
+			return nil, fmt.Errorf("invalid announce delay %q in pool %q: must not be negative", pool.AnnounceDelay, name)
+		}
+		for _, l := range pool.AllowedAggregationLengths {
+			if l < 0 || l > 128 {
+				return nil, fmt.Errorf("invalid allowed aggregation length %d in pool %q", l, name)
+			}
+		}
+
+		if len(pool.CIDR) > 0 && pool.Size().Sign() == 0 {
+			if err := warn("address pool %q has no usable addresses after avoid-buggy-ips and reserved-addresses are applied", name); err != nil {
+				return nil, err
+			}
+		}
+
+		aggregates := 0
+		for _, ad := range pool.Advertisements {
+			if ad.Type == AdvertiseAggregate {
+				aggregates++
+			}
+		}
+		if aggregates > 1 {
+			return nil, fmt.Errorf("pool %q has %d aggregate advertisements, at most one is allowed", name, aggregates)
+		}
+
+		for i, ad := range pool.Advertisements {
+			announced := len(ad.PeerGroups) == 0
+			for _, g := range ad.PeerGroups {
+				if !peerGroups[g] {
+					return nil, fmt.Errorf("advertisement in pool %q references peer group %q, which has no peers", name, g)
+				}
+				announced = announced || enabledGroups[g]
+			}
+			// With all peers disabled, the whole pool is warned about
+			// below.
+			if ad.Enabled && !announced && c.anyPeerEnabled() {
+				if err := warn("advertisement #%d of pool %q can't be announced, all peers of its peer groups are disabled", i+1, name); err != nil {
+					return nil, err
+				}
+			}
+			if ad.NextHop != nil && (ad.NextHop.To4() != nil || !ad.NextHop.IsGlobalUnicast()) {
+				return nil, fmt.Errorf("next-hop %q in advertisement of pool %q must be a global IPv6 address", ad.NextHop, name)
+			}
+			if ad.NextHopLinkLocal != nil {
+				if ad.NextHopLinkLocal.To4() != nil || !ad.NextHopLinkLocal.IsLinkLocalUnicast() {
+					return nil, fmt.Errorf("next-hop-link-local %q in advertisement of pool %q must be an IPv6 link-local address", ad.NextHopLinkLocal, name)
+				}
+				if ad.NextHop == nil {
+					return nil, fmt.Errorf("advertisement of pool %q has a next-hop-link-local but no global next-hop", name)
+				}
+			}
+			switch ad.Origin {
+			case OriginIGP, OriginEGP, OriginIncomplete:
+			default:
+				return nil, fmt.Errorf("unknown origin %q in advertisement of pool %q", ad.Origin, name)
+			}
+			if ad.AggregationLength > 32 {
+				return nil, fmt.Errorf("invalid aggregation length %d in pool %q", ad.AggregationLength, name)
+			}
+			if ad.AggregationLengthV6 > 128 {
+				return nil, fmt.Errorf("invalid IPv6 aggregation length %d in pool %q", ad.AggregationLengthV6, name)
+			}
+			switch ad.Type {
+			case "":
+			case AdvertiseHost:
+				if ad.AggregationLength != 32 || ad.AggregationLengthV6 != 128 {
+					return nil, fmt.Errorf("host advertisement in pool %q has aggregation length %d/%d, must be 32/128", name, ad.AggregationLength, ad.AggregationLengthV6)
+				}
+			case AdvertiseAggregate:
+				if ad.AggregationLength == 32 && ad.AggregationLengthV6 == 128 {
+					return nil, fmt.Errorf("aggregate advertisement in pool %q doesn't aggregate, set an aggregation length shorter than 32 (or 128 for IPv6)", name)
+				}
+			default:
+				return nil, fmt.Errorf("unknown advertisement type %q in pool %q", ad.Type, name)
+			}
+			for _, cidr := range ad.CIDR {
+				if !pool.ContainsCIDR(cidr) {
+					return nil, fmt.Errorf("CIDR %q in advertisement of pool %q is not within the pool", cidr, name)
+				}
+			}
+			// Each family's aggregation length only applies to, and
+			// must be compatible with, that family's CIDRs.
+			for _, cidr := range pool.advertisedCIDRs(ad) {
+				o, _ := cidr.Mask.Size()
+				if cidr.IP.To4() != nil {
+					if ad.AggregationLength < o {
+						return nil, fmt.Errorf("invalid aggregation length %d in pool %q: prefix %q in this pool is more specific than the aggregation length", ad.AggregationLength, name, cidr)
+					}
+					if !pool.allowsAggregationLength(ad.AggregationLength) {
+						return nil, fmt.Errorf("aggregation length %d in pool %q is not in the pool's allowed-aggregation-lengths", ad.AggregationLength, name)
+					}
+				} else {
+					if ad.AggregationLengthV6 < o {
+						return nil, fmt.Errorf("invalid IPv6 aggregation length %d in pool %q: prefix %q in this pool is more specific than the aggregation length", ad.AggregationLengthV6, name, cidr)
+					}
+					if !pool.allowsAggregationLength(ad.AggregationLengthV6) {
+						return nil, fmt.Errorf("IPv6 aggregation length %d in pool %q is not in the pool's allowed-aggregation-lengths", ad.AggregationLengthV6, name)
+					}
+				}
+			}
+			// Dead config, but harmless: likely a CIDR selection
+			// that was never filled in. Any selected CIDR yields at
+			// least one route.
+			if len(pool.CIDR) > 0 && len(pool.advertisedCIDRs(ad)) == 0 {
+				if err := warn("advertisement #%d of pool %q produces no routes", i+1, name); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	for i, r := range c.Rules {
+		if err := r.validate(c, peerGroups); err != nil {
+			return nil, fmt.Errorf("invalid rule #%d: %s", i+1, err)
+		}
+	}
+
+	// Without peers at all, MetalLB is most likely being set up. With
+	// peers that are all disabled, the bgp pools silently go
+	// unannounced.
+	if len(c.Peers) > 0 && !c.anyPeerEnabled() {
+		for _, name := range c.PoolNames() {
+			if !c.Pools[name].Speaks(BGP) {
+				continue
+			}
+			if err := warn("bgp address pool %q can't be announced, all peers are disabled", name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// A peer address that can be allocated to a service will break
+	// the session when it is.
+	for _, p := range c.Peers {
+		if p.Addr == nil {
+			continue
+		}
+		for _, name := range c.PoolNames() {
+			pool := c.Pools[name]
+			if !poolContainsIP(pool, p.Addr) {
+				continue
+			}
+			if err := warn("peer address %q is inside address pool %q, and could be allocated to a service", p.Addr, name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Pools without service selectors have always shared services
+	// between them, so only pairs where a selector narrows the scope
+	// are worth flagging.
+	names := c.PoolNames()
+	for i, name := range names {
+		a := c.Pools[name]
+		for _, name2 := range names[i+1:] {
+			b := c.Pools[name2]
+			if !a.AutoAssign || !b.AutoAssign || a.ServiceClass != b.ServiceClass {
+				continue
+			}
+			if len(a.ServiceSelectors) == 0 && len(b.ServiceSelectors) == 0 {
+				continue
+			}
+			if !serviceScopesOverlap(a, b) {
+				continue
+			}
+			if err := warn("auto-assign address pools %q and %q have overlapping service selectors, so which one serves a matching service is ambiguous", name, name2); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if opts.WarnCommunityASNMismatch && len(c.Peers) > 0 {
+		myASNs := map[uint32]bool{}
+		for _, p := range c.Peers {
+			myASNs[p.MyASN] = true
+		}
+		comms := map[uint32]bool{}
+		for _, p := range c.Peers {
+			for comm := range p.Communities {
+				comms[comm] = true
+			}
+		}
+		for _, pool := range c.Pools {
+			for _, ad := range pool.Advertisements {
+				for comm := range ad.Communities {
+					comms[comm] = true
+				}
+			}
+		}
+		var mismatched []uint32
+		for comm := range comms {
+			// ASNs 0 and 65535 are reserved for well-known
+			// communities.
+			asn := comm >> 16
+			if asn != 0 && asn != 0xffff && !myASNs[asn] {
+				mismatched = append(mismatched, comm)
+			}
+		}
+		sort.Slice(mismatched, func(i, j int) bool { return mismatched[i] < mismatched[j] })
+		for _, comm := range mismatched {
+			if err := warn("community %d:%d uses ASN %d, which is not the my-asn of any peer", comm>>16, comm&0xffff, comm>>16); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return warnings, nil
+}
+
+// poolContainsIP returns true if ip is in one of p's CIDRs, and not
+// reserved.
+func poolContainsIP(p *Pool, ip net.IP) bool {
+	for _, r := range p.Reserved {
+		if r.Contains(ip) {
+			return false
+		}
+	}
+	for _, cidr := range p.CIDR {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// unknownAdvertisementKeys returns a description of every key in the
+// advertisements of bs that configFile doesn't know about.
+func unknownAdvertisementKeys(bs []byte) ([]string, error) {
+	var raw struct {
+		Pools []struct {
+			Name           string
+			Advertisements []map[string]interface{}
+		} `yaml:"address-pools"`
+	}
+	if err := yaml.Unmarshal(bs, &raw); err != nil {
+		return nil, err
+	}
+
+	poolType := reflect.TypeOf(configFile{}.Pools).Elem()
+	f, _ := poolType.FieldByName("Advertisements")
+	known := yamlKeys(f.Type.Elem())
+
+	var ret []string
+	for _, p := range raw.Pools {
+		for i, ad := range p.Advertisements {
+			var keys []string
+			for k := range ad {
+				if !known[k] {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				ret = append(ret, fmt.Sprintf("unknown key %q in advertisement #%d of pool %q", k, i+1, p.Name))
+			}
+		}
+	}
+	return ret, nil
+}
+
+// yamlKeys returns the keys that the yaml library maps to fields of
+// the struct type t.
+func yamlKeys(t reflect.Type) map[string]bool {
+	ret := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		ret[name] = true
+	}
+	return ret
+}
+
+var envVarRe = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces the ${VAR} placeholders in bs with their values
+// in env, or in the process environment if env is nil.
+func expandEnv(bs []byte, env map[string]string) ([]byte, error) {
+	lookup := os.LookupEnv
+	if env != nil {
+		lookup = func(k string) (string, bool) {
+			v, ok := env[k]
+			return v, ok
+		}
+	}
+
+	var undefined []string
+	ret := envVarRe.ReplaceAllFunc(bs, func(m []byte) []byte {
+		name := string(envVarRe.FindSubmatch(m)[1])
+		v, ok := lookup(name)
+		if !ok {
+			undefined = append(undefined, name)
+		}
+		return []byte(v)
+	})
+	if len(undefined) > 0 {
+		return nil, fmt.Errorf("undefined variables %q", undefined)
+	}
+	return ret, nil
+}
+
+var yamlLineRe = regexp.MustCompile(`^line (\d+): `)
+
+// yamlError rewrites err, as returned by yaml.Unmarshal for bs, so
+// that it names the line at fault. The yaml library already does so
+// for type errors, but its syntax errors count lines from zero, and
+// leave out the line number for the first line.
+func yamlError(bs []byte, err error) error {
+	msg := strings.TrimPrefix(err.Error(), "yaml: ")
+	if _, ok := err.(*yaml.TypeError); ok {
+		return errors.New(msg)
+	}
+
+	line := 1
+	if m := yamlLineRe.FindStringSubmatch(msg); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		line = n + 1
+		msg = msg[len(m[0]):]
+	}
+	// Errors at the end of the input point one past the last line.
+	lines := bytes.Count(bs, []byte("\n"))
+	if len(bs) > 0 && bs[len(bs)-1] != '\n' {
+		lines++
+	}
+	if line > lines && lines > 0 {
+		line = lines
+	}
+	return fmt.Errorf("line %d: %s", line, msg)
+}
+
+// PoolNames returns the names of c's pools, in sorted order.
+func (c *Config) PoolNames() []string {
+	var ret []string
+	for name := range c.Pools {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// ConfigDiff describes what changed between two Configs.
+type ConfigDiff struct {
+	// Peers present only in the new config.
+	AddedPeers []*Peer
+	// Peers present only in the old config.
+	RemovedPeers []*Peer
+	// Peers present in both configs, with different settings. These
+	// are the new config's peers.
+	ChangedPeers []*Peer
+	// Names of pools present only in the new config, in sorted order.
+	AddedPools []string
+	// Names of pools present only in the old config, in sorted order.
+	RemovedPools []string
+	// Names of pools present in both configs, with different
+	// settings, in sorted order.
+	ChangedPools []string
+}
+
+// Diff returns the changes needed to go from old to c. Peers are
+// matched by address, port and VRF, pools by name. A nil old is an
+// empty config.
+func (c *Config) Diff(old *Config) ConfigDiff {
+	if old == nil {
+		old = &Config{}
+	}
+
+	var ret ConfigDiff
+
+	oldPeers := map[string]*Peer{}
+	for _, p := range old.Peers {
+		oldPeers[peerKey(p)] = p
+	}
+	for _, p := range c.Peers {
+		key := peerKey(p)
+		op := oldPeers[key]
+		switch {
+		case op == nil:
+			ret.AddedPeers = append(ret.AddedPeers, p)
+		case !reflect.DeepEqual(p, op):
+			ret.ChangedPeers = append(ret.ChangedPeers, p)
+		}
+		delete(oldPeers, key)
+	}
+	for _, p := range old.Peers {
+		if oldPeers[peerKey(p)] == p {
+			ret.RemovedPeers = append(ret.RemovedPeers, p)
+		}
+	}
+
+	for _, name := range c.PoolNames() {
+		op := old.Pools[name]
+		switch {
+		case op == nil:
+			ret.AddedPools = append(ret.AddedPools, name)
+		case !reflect.DeepEqual(c.Pools[name], op):
+			ret.ChangedPools = append(ret.ChangedPools, name)
+		}
+	}
+	for _, name := range old.PoolNames() {
+		if c.Pools[name] == nil {
+			ret.RemovedPools = append(ret.RemovedPools, name)
+		}
+	}
+
+	return ret
+}
+
+// Equal returns true if c and other are the same configuration.
+// Parse puts pool CIDRs in a canonical order, so configs that only
+// list them differently are equal.
+func (c *Config) Equal(other *Config) bool {
+	return reflect.DeepEqual(c, other)
+}
+
+// peerKey returns the identity of p's BGP session, for matching peers
+// across configs.
+func peerKey(p *Peer) string {
+	addr := p.AddrHostname
+	if addr == "" {
+		addr = p.Addr.String()
+		if p.Zone != "" {
+			addr += "%" + p.Zone
+		}
+	}
+	return fmt.Sprintf("%s@%s", net.JoinHostPort(addr, strconv.Itoa(int(p.Port))), p.VRF)
+}
+
+// IPFamily is an IP address family.
+type IPFamily string
+
+// Supported IP families.
+const (
+	IPv4 IPFamily = "ipv4"
+	IPv6 IPFamily = "ipv6"
+	// Only valid as a Pool's IPFamily, for pools that serve both
+	// IPv4 and IPv6.
+	DualStack IPFamily = "dual"
+)
+
+// HasFamily returns true if p contains addresses of the given family.
+func (p *Pool) HasFamily(f IPFamily) bool {
+	for _, cidr := range p.CIDR {
+		if (cidr.IP.To4() != nil) == (f == IPv4) {
+			return true
+		}
+	}
+	return false
+}
+
+// Speaks returns true if p's addresses are announced with proto.
+func (p *Pool) Speaks(proto Proto) bool {
+	for _, pr := range p.protocols() {
+		if pr == proto {
+			return true
+		}
+	}
+	return false
+}
+
+// protocols returns all of p's protocols.
+func (p *Pool) protocols() []Proto {
+	if p.Protocols != nil {
+		return p.Protocols
+	}
+	return []Proto{p.Protocol}
+}
+
+// AllocateFrom returns the first pool in preferred that may be used
+// for automatic allocation of addresses of the given family, to a
+// service of the given class and labels. See EligiblePools for which
+// pools qualify. Besides the preference list and family, it takes the
+// service's class and labels, so that it never returns a pool that
+// would then refuse the service.
+func (c *Config) AllocateFrom(preferred []string, family IPFamily, class string, svcLabels map[string]string) (string, error) {
+	pools := c.EligiblePools(preferred, family, class, svcLabels)
+	if len(pools) == 0 {
+		return "", fmt.Errorf("no auto-assignable %s pool among %q", family, preferred)
+	}
+	return pools[0], nil
+}
+
+// EligiblePools returns the pools in preferred, in preference order,
+// that may be used for automatic allocation of addresses of the given
+// family, to a service of the given class and labels. Pools with
+// AutoAssign unset, that don't serve the class, or whose service
+// selectors don't match, are skipped, as are unknown names. If
+// preferred is empty, all pools are considered, in name order.
+func (c *Config) EligiblePools(preferred []string, family IPFamily, class string, svcLabels map[string]string) []string {
+	if len(preferred) == 0 {
+		preferred = c.PoolNames()
+	}
+	var ret []string
+	for _, name := range preferred {
+		pool := c.Pools[name]
+		if pool == nil || !pool.AutoAssign || !pool.HasFamily(family) || !pool.ServesClass(class) || !pool.SelectsService(svcLabels) {
+			continue
+		}
+		ret = append(ret, name)
+	}
+	return ret
+}
+
+// ServesClass returns true if p may allocate addresses to services
+// of the given class. The empty class is an unclassed service.
+func (p *Pool) ServesClass(class string) bool {
+	return p.ServiceClass == class
+}
+
+// allowsAggregationLength returns true if p's advertisements may use
+// aggregation length l.
+func (p *Pool) allowsAggregationLength(l int) bool {
+	if p.AllowedAggregationLengths == nil {
+		return true
+	}
+	for _, a := range p.AllowedAggregationLengths {
+		if a == l {
+			return true
+		}
+	}
+	return false
+}
+
+// SelectsService returns true if p may auto-assign addresses to a
+// service with the given labels.
+func (p *Pool) SelectsService(svcLabels map[string]string) bool {
+	if len(p.ServiceSelectors) == 0 {
+		return true
+	}
+	for _, sel := range p.ServiceSelectors {
+		if sel.Matches(labels.Set(svcLabels)) {
+			return true
+		}
 	}
+	return false
+}
 
-	return (uint32(a) << 16) + uint32(b), nil
+// SpeakerSelectsNode returns true if the speaker on a node with the
+// given labels should announce, per SpeakerNodeSelector.
+func (c *Config) SpeakerSelectsNode(nodeLabels map[string]string) bool {
+	return c.SpeakerNodeSelector == nil || c.SpeakerNodeSelector.Matches(labels.Set(nodeLabels))
 }
 
-func cidrsOverlap(a, b *net.IPNet) bool {
-	al, _ := a.Mask.Size()
-	bl, _ := b.Mask.Size()
-	if al == bl && a.IP.Equal(b.IP) {
-		return true
+// PinnedAddress returns the address pinned to service, as
+// "namespace/name", in any of c's pools, or nil if there is none.
+func (c *Config) PinnedAddress(service string) net.IP {
+	for _, p := range c.Pools {
+		for _, pin := range p.PinnedAddresses {
+			if pin.Service == service {
+				return pin.IP
+			}
+		}
+	}
+	return nil
+}
+
+// PinnedTo returns the service that ip is pinned to in p, or "" if
+// ip isn't pinned.
+func (p *Pool) PinnedTo(ip net.IP) string {
+	for _, pin := range p.PinnedAddresses {
+		if pin.IP.Equal(ip) {
+			return pin.Service
+		}
+	}
+	return ""
+}
+
+// SimulateAssignments checks the service assignments in current,
+// keyed by "namespace/name", against c, without applying anything.
+// An assignment is valid if the address is in one of c's pools, and
+// isn't reserved, excluded, avoided by AvoidBuggyIPs or pinned to
+// another service. Every assignment ends up in exactly one of valid
+// and invalid.
+func (c *Config) SimulateAssignments(current map[string]net.IP) (valid, invalid map[string]net.IP) {
+	valid, invalid = map[string]net.IP{}, map[string]net.IP{}
+	for svc, ip := range current {
+		if c.assignmentValid(svc, ip) {
+			valid[svc] = ip
+		} else {
+			invalid[svc] = ip
+		}
+	}
+	return valid, invalid
+}
+
+// assignmentValid returns true if ip could be allocated to svc from
+// one of c's pools.
+func (c *Config) assignmentValid(svc string, ip net.IP) bool {
+	for _, n := range c.ExcludeAddresses {
+		if n.Contains(ip) {
+			return false
+		}
 	}
-	if al > bl && b.Contains(a.IP) {
+	for _, p := range c.Pools {
+		if !poolContainsIP(p, ip) {
+			continue
+		}
+		if p.AvoidsIP(ip) {
+			return false
+		}
+		if other := p.PinnedTo(ip); other != "" && other != svc {
+			return false
+		}
 		return true
 	}
-	if bl > al && a.Contains(b.IP) {
+	return false
+}
+
+// NodePriority returns the leader election priority of a node with
+// the given labels, for the addresses of p. It is the highest
+// priority among the matching NodePriorities, or 0 if none match.
+func (p *Pool) NodePriority(nodeLabels map[string]string) int {
+	ret := 0
+	for _, np := range p.NodePriorities {
+		if np.Priority > ret && np.Selector.Matches(labels.Set(nodeLabels)) {
+			ret = np.Priority
+		}
+	}
+	return ret
+}
+
+// serviceScopesOverlap returns true if some set of service labels
+// is selected by both a and b.
+func serviceScopesOverlap(a, b *Pool) bool {
+	as, bs := a.ServiceSelectors, b.ServiceSelectors
+	if len(as) == 0 {
+		as = []labels.Selector{labels.Everything()}
+	}
+	if len(bs) == 0 {
+		bs = []labels.Selector{labels.Everything()}
+	}
+	for _, sa := range as {
+		for _, sb := range bs {
+			if selectorsOverlap(sa, sb) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// selectorsOverlap returns true if some set of labels matches both a
+// and b.
+func selectorsOverlap(a, b labels.Selector) bool {
+	ra, ok := a.Requirements()
+	if !ok {
+		return false
+	}
+	rb, ok := b.Requirements()
+	if !ok {
+		return false
+	}
+	byKey := map[string][]labels.Requirement{}
+	for _, r := range append(ra, rb...) {
+		byKey[r.Key()] = append(byKey[r.Key()], r)
+	}
+	// Requirements on different keys are independent, so the
+	// selectors overlap iff every key can satisfy all of its own.
+	for key, reqs := range byKey {
+		if !requirementsSatisfiable(key, reqs) {
+			return false
+		}
+	}
+	return true
+}
+
+// requirementsSatisfiable returns true if some value of label key,
+// or its absence, matches all of reqs.
+func requirementsSatisfiable(key string, reqs []labels.Requirement) bool {
+	// Every requirement only distinguishes between absence, the
+	// values it mentions, and (for gt/lt) the integers either side
+	// of them, so those are the only candidates worth trying.
+	vals := map[string]bool{}
+	for i := range reqs {
+		for _, v := range reqs[i].Values().List() {
+			vals[v] = true
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+				vals[strconv.FormatInt(n-1, 10)] = true
+				vals[strconv.FormatInt(n+1, 10)] = true
+			}
+		}
+	}
+	other := "x"
+	for vals[other] {
+		other += "x"
+	}
+	vals[other] = true
+
+	cands := []labels.Set{{}}
+	for v := range vals {
+		cands = append(cands, labels.Set{key: v})
+	}
+	for _, ls := range cands {
+		ok := true
+		for i := range reqs {
+			if !reqs[i].Matches(ls) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// PickWeightedPool picks one of the eligible pool names at random,
+// with probability proportional to the pool's weight. If none of the
+// eligible pools has a positive weight, all of them are equally
+// likely. Names not in c.Pools are ignored. Returns "" if there is
+// nothing to pick from.
+func (c *Config) PickWeightedPool(eligible []string) string {
+	var names []string
+	total := 0
+	for _, name := range eligible {
+		pool := c.Pools[name]
+		if pool == nil {
+			continue
+		}
+		names = append(names, name)
+		if pool.Weight > 0 {
+			total += pool.Weight
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	if total == 0 {
+		return names[rand.Intn(len(names))]
+	}
+
+	// The loop always returns, since n < total, but falling through
+	// to the last weighted pool keeps a bad total from crashing the
+	// controller.
+	n := rand.Intn(total)
+	last := ""
+	for _, name := range names {
+		if w := c.Pools[name].Weight; w > 0 {
+			last = name
+			n -= w
+			if n < 0 {
+				return name
+			}
+		}
+	}
+	return last
+}
+
+// isDocumentationASN returns true if asn is reserved for use in
+// documentation by RFC 5398.
+func isDocumentationASN(asn uint32) bool {
+	return (asn >= 64496 && asn <= 64511) || (asn >= 65536 && asn <= 65551)
+}
+
+// parseIPZone parses s as an IP address with an optional IPv6 zone
+// suffix, as in "fe80::1%eth0". It returns a nil IP if s is not in
+// that format.
+func parseIPZone(s string) (net.IP, string) {
+	zone := ""
+	if i := strings.LastIndex(s, "%"); i >= 0 {
+		s, zone = s[:i], s[i+1:]
+	}
+	ip := net.ParseIP(s)
+	if ip == nil || (zone != "" && ip.To4() != nil) {
+		return nil, ""
+	}
+	return ip, zone
+}
+
+// isInterfaceName returns true if s is a valid Linux network
+// interface name.
+func isInterfaceName(s string) bool {
+	// Linux limits interface names to IFNAMSIZ-1 bytes, and forbids
+	// slashes, whitespace and the special directory names.
+	if s == "" || len(s) > 15 || s == "." || s == ".." {
+		return false
+	}
+	return !strings.ContainsAny(s, "/: \t\n")
+}
+
+var hostnameLabelRe = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// dns1123LabelRe matches a DNS-1123 label, as used for Kubernetes
+// object names: like a hostname label, but lowercase only.
+var dns1123LabelRe = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// isHostname returns true if s is a syntactically valid DNS hostname,
+// per RFC 1123. All-numeric top-level labels are rejected, so that
+// malformed IPv4 addresses aren't mistaken for hostnames.
+func isHostname(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	labels := strings.Split(s, ".")
+	for _, l := range labels {
+		if !hostnameLabelRe.MatchString(l) {
+			return false
+		}
+	}
+	if _, err := strconv.Atoi(labels[len(labels)-1]); err == nil {
+		return false
+	}
+	return true
+}
+
+// TagCommunity returns the community identifying the pool with the
+// given name, within asn: <asn>:<low 16 bits of the FNV-1a hash of
+// name>.
+func TagCommunity(asn uint16, name string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return uint32(asn)<<16 | h.Sum32()&0xffff
+}
+
+// parseCommunityAliases resolves the community alias definitions in
+// raw. An alias is either a community literal, the name of another
+// alias, or a well-known community name.
+func parseCommunityAliases(raw map[string]string) (map[string]uint32, error) {
+	ret := map[string]uint32{}
+
+	var resolve func(name string, seen []string) (uint32, error)
+	resolve = func(name string, seen []string) (uint32, error) {
+		if v, ok := ret[name]; ok {
+			return v, nil
+		}
+		for _, s := range seen {
+			if s == name {
+				return 0, fmt.Errorf("community alias %q is defined in terms of itself (%s)", name, strings.Join(append(seen, name), " -> "))
+			}
+		}
+
+		var (
+			v   uint32
+			err error
+		)
+		target := raw[name]
+		if raw[target] != "" {
+			v, err = resolve(target, append(seen, name))
+		} else if wk, ok := wellKnownCommunities[target]; ok {
+			v = wk
+		} else if v, err = parseCommunity(target); err != nil {
+			err = fmt.Errorf("parsing community %q: %s", name, err)
+		}
+		if err != nil {
+			return 0, err
+		}
+		ret[name] = v
+		return v, nil
+	}
+
+	for _, n := range sortedKeys(raw) {
+		if _, err := resolve(n, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// resolveCommunity returns the value of c, which is either a key of
+// aliases, a well-known community name or a community literal.
+// Aliases take precedence over well-known names.
+func resolveCommunity(aliases map[string]uint32, c string) (uint32, error) {
+	if v, ok := aliases[c]; ok {
+		return v, nil
+	}
+	if v, ok := wellKnownCommunities[c]; ok {
+		return v, nil
+	}
+	return parseCommunity(c)
+}
+
+// sortedKeys returns the keys of m, in sorted order.
+func sortedKeys(m map[string]string) []string {
+	var ret []string
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func parseCommunity(c string) (uint32, error) {
+	fs := strings.Split(c, ":")
+	if len(fs) == 3 {
+		return 0, fmt.Errorf("%q is a large community, list it under large-communities instead", c)
+	}
+	if len(fs) != 2 {
+		return 0, fmt.Errorf("invalid community string %q", c)
+	}
+	a, err := strconv.ParseUint(fs[0], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid first section of community %q: %s", fs[0], err)
+	}
+	b, err := strconv.ParseUint(fs[1], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid second section of community %q: %s", fs[0], err)
+	}
+
+	return (uint32(a) << 16) + uint32(b), nil
+}
+
+func parseLargeCommunity(c string) (LargeCommunity, error) {
+	fs := strings.Split(c, ":")
+	if len(fs) == 2 {
+		return LargeCommunity{}, fmt.Errorf("%q is a standard community, list it under communities instead", c)
+	}
+	if len(fs) != 3 {
+		return LargeCommunity{}, fmt.Errorf("invalid large community string %q", c)
+	}
+	var vs [3]uint32
+	for i, f := range fs {
+		v, err := strconv.ParseUint(f, 10, 32)
+		if err != nil {
+			return LargeCommunity{}, fmt.Errorf("invalid section %d of large community %q: %s", i+1, c, err)
+		}
+		vs[i] = uint32(v)
+	}
+	return LargeCommunity{vs[0], vs[1], vs[2]}, nil
+}
+
+// parseCIDR parses s as a CIDR prefix. A bare IP address is
+// accepted as a prefix containing only that address.
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// parseRange parses an inclusive "<start>-<end>" address range into
+// the CIDRs that cover it.
+func parseRange(s string) ([]*net.IPNet, error) {
+	fs := strings.SplitN(s, "-", 2)
+	start, end := net.ParseIP(strings.TrimSpace(fs[0])), net.ParseIP(strings.TrimSpace(fs[1]))
+	if start == nil || end == nil {
+		return nil, errors.New("must be two IP addresses separated by -")
+	}
+	if (start.To4() == nil) != (end.To4() == nil) {
+		return nil, errors.New("start and end addresses are of different families")
+	}
+	ret := RangeToCIDRs(start, end)
+	if len(ret) == 0 {
+		return nil, errors.New("start address is after end address")
+	}
+	return ret, nil
+}
+
+// RangeToCIDRs returns the fewest CIDR prefixes that cover exactly
+// the addresses from start to end inclusive, in address order. It
+// returns nil if start and end are of different families, or start
+// is after end.
+func RangeToCIDRs(start, end net.IP) []*net.IPNet {
+	bits := 32
+	s, e := start.To4(), end.To4()
+	if s == nil || e == nil {
+		if s != nil || e != nil {
+			return nil
+		}
+		bits = 128
+		s, e = start.To16(), end.To16()
+		if s == nil || e == nil {
+			return nil
+		}
+	}
+	return rangeToCIDRs(new(big.Int).SetBytes(s), new(big.Int).SetBytes(e), bits, 0)
+}
+
+// ContainsCIDR returns true if n lies entirely within p's CIDRs. n
+// may span several adjacent CIDRs of the pool. Reserved addresses
+// are still part of the pool for this purpose.
+func (p *Pool) ContainsCIDR(n *net.IPNet) bool {
+	// Pool CIDRs don't overlap each other, and two CIDRs overlap
+	// only if one contains the other, so n is covered if the
+	// overlaps add up to all of n.
+	covered := big.NewInt(0)
+	for _, cidr := range p.CIDR {
+		if !cidrsOverlap(cidr, n) {
+			continue
+		}
+		nl, _ := n.Mask.Size()
+		cl, _ := cidr.Mask.Size()
+		if cl <= nl {
+			return true
+		}
+		covered.Add(covered, cidrSize(cidr, nil))
+	}
+	return covered.Cmp(cidrSize(n, nil)) == 0
+}
+
+// MaxEnumeratedAddresses is the largest pool, counted before
+// exclusions, that Pool.Addresses will enumerate.
+const MaxEnumeratedAddresses = 65536
+
+// Addresses returns every allocatable address in p, in the order of
+// p.CIDR. Reserved addresses are skipped, as are addresses avoided
+// by p.AvoidBuggyIPs. Pools spanning more than
+// MaxEnumeratedAddresses addresses are rejected with an error.
+func (p *Pool) Addresses() ([]net.IP, error) {
+	total := big.NewInt(0)
+	for _, cidr := range p.CIDR {
+		total.Add(total, cidrSize(cidr, nil))
+	}
+	if total.Cmp(big.NewInt(MaxEnumeratedAddresses)) > 0 {
+		return nil, fmt.Errorf("pool spans %s addresses, refusing to enumerate more than %d", total, MaxEnumeratedAddresses)
+	}
+
+	var ret []net.IP
+	for _, cidr := range p.CIDR {
+		for ip := cidr.IP.Mask(cidr.Mask); cidr.Contains(ip); ip = nextIP(ip) {
+			if p.AvoidsIP(ip) {
+				continue
+			}
+			reserved := false
+			for _, r := range p.Reserved {
+				if r.Contains(ip) {
+					reserved = true
+					break
+				}
+			}
+			if !reserved {
+				ret = append(ret, ip)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// HashedIP maps key, usually a service's namespace/name, to an
+// address of p. The address is picked by hashing key over all of p's
+// addresses. If the hash lands on a reserved address or one avoided
+// by AvoidBuggyIPs, the next allocatable address is returned instead,
+// wrapping around to the start of the pool. The result only depends
+// on key and p's configuration.
+func (p *Pool) HashedIP(key string) (net.IP, error) {
+	total := big.NewInt(0)
+	for _, cidr := range p.CIDR {
+		total.Add(total, cidrSize(cidr, nil))
+	}
+	if total.Sign() == 0 {
+		return nil, errors.New("pool has no addresses")
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	off := new(big.Int).Mod(new(big.Int).SetUint64(h.Sum64()), total)
+	start := 0
+	for {
+		sz := cidrSize(p.CIDR[start], nil)
+		if off.Cmp(sz) < 0 {
+			break
+		}
+		off.Sub(off, sz)
+		start++
+	}
+	first := addToIP(p.CIDR[start].IP.Mask(p.CIDR[start].Mask), off)
+
+	// Scan from first to the end of its CIDR, the other CIDRs, and
+	// finally the start of first's CIDR.
+	for i := 0; i <= len(p.CIDR); i++ {
+		cidr := p.CIDR[(start+i)%len(p.CIDR)]
+		ip := first
+		if i > 0 {
+			ip = cidr.IP.Mask(cidr.Mask)
+		}
+		for cidr.Contains(ip) {
+			if i == len(p.CIDR) && bytes.Compare(ip, first) >= 0 {
+				break
+			}
+			if r := p.reservedCIDR(ip); r != nil {
+				// Skip the whole reserved range at once, it may
+				// be big.
+				ip = nextIP(lastIP(r))
+				continue
+			}
+			if !p.AvoidsIP(ip) {
+				return ip, nil
+			}
+			ip = nextIP(ip)
+		}
+	}
+	return nil, errors.New("pool has no allocatable addresses")
+}
+
+// reservedCIDR returns the reserved CIDR of p that contains ip, or
+// nil if ip isn't reserved.
+func (p *Pool) reservedCIDR(ip net.IP) *net.IPNet {
+	for _, r := range p.Reserved {
+		if r.Contains(ip) {
+			return r
+		}
+	}
+	return nil
+}
+
+// addToIP returns ip plus off.
+func addToIP(ip net.IP, off *big.Int) net.IP {
+	n := new(big.Int).SetBytes(ip)
+	b := n.Add(n, off).Bytes()
+	ret := make(net.IP, len(ip))
+	copy(ret[len(ret)-len(b):], b)
+	return ret
+}
+
+// lastIP returns the last address of n.
+func lastIP(n *net.IPNet) net.IP {
+	ip := n.IP.Mask(n.Mask)
+	ret := make(net.IP, len(ip))
+	for i := range ip {
+		ret[i] = ip[i] | ^n.Mask[i]
+	}
+	return ret
+}
+
+// AvoidsIP returns true if ip must not be allocated from p because
+// of AvoidBuggyIPs, i.e. if it is an IPv4 address ending in .0 or
+// .255 that IncludeNetwork or IncludeBroadcast doesn't put back.
+func (p *Pool) AvoidsIP(ip net.IP) bool {
+	ip = ip.To4()
+	if !p.AvoidBuggyIPs || ip == nil {
+		return false
+	}
+	switch ip[3] {
+	case 0:
+		return !p.IncludeNetwork
+	case 255:
+		return !p.IncludeBroadcast
+	}
+	return false
+}
+
+// AggregateRoutes returns the fewest CIDR prefixes that cover exactly
+// ips, merging contiguous addresses into aggregates no shorter than
+// maxPrefixLen (the advertisement's aggregation length). ips should
+// all be of the same family. The result is in address order.
+func AggregateRoutes(ips []net.IP, maxPrefixLen int) []*net.IPNet {
+	type addr struct {
+		n    *big.Int
+		bits int
+	}
+	var addrs []addr
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			addrs = append(addrs, addr{new(big.Int).SetBytes(ip4), 32})
+		} else if ip16 := ip.To16(); ip16 != nil {
+			addrs = append(addrs, addr{new(big.Int).SetBytes(ip16), 128})
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		if addrs[i].bits != addrs[j].bits {
+			return addrs[i].bits < addrs[j].bits
+		}
+		return addrs[i].n.Cmp(addrs[j].n) < 0
+	})
+
+	var ret []*net.IPNet
+	one := big.NewInt(1)
+	for i := 0; i < len(addrs); {
+		// Find the run of contiguous (or duplicate) addresses
+		// starting at i.
+		lo, hi, bits := addrs[i].n, addrs[i].n, addrs[i].bits
+		j := i + 1
+		for ; j < len(addrs) && addrs[j].bits == bits; j++ {
+			d := new(big.Int).Sub(addrs[j].n, hi)
+			if d.Cmp(one) > 0 {
+				break
+			}
+			hi = addrs[j].n
+		}
+		ret = append(ret, rangeToCIDRs(lo, hi, bits, maxPrefixLen)...)
+		i = j
+	}
+	return ret
+}
+
+// rangeToCIDRs returns the CIDR prefixes, no shorter than
+// minPrefixLen, that exactly cover the addresses from lo to hi
+// inclusive, in an address family of the given bit size.
+func rangeToCIDRs(lo, hi *big.Int, bits, minPrefixLen int) []*net.IPNet {
+	maxHostBits := bits - minPrefixLen
+	if maxHostBits < 0 {
+		maxHostBits = 0
+	}
+	if maxHostBits > bits {
+		maxHostBits = bits
+	}
+
+	var ret []*net.IPNet
+	lo = new(big.Int).Set(lo)
+	for lo.Cmp(hi) <= 0 {
+		// Start from the biggest block that lo is aligned to, and
+		// shrink it until it fits before hi.
+		h := 0
+		for h < maxHostBits && lo.Bit(h) == 0 {
+			h++
+		}
+		for {
+			last := new(big.Int).Lsh(big.NewInt(1), uint(h))
+			last.Add(last, lo)
+			last.Sub(last, big.NewInt(1))
+			if last.Cmp(hi) <= 0 {
+				break
+			}
+			h--
+		}
+
+		ip := make(net.IP, bits/8)
+		b := lo.Bytes()
+		copy(ip[len(ip)-len(b):], b)
+		ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits-h, bits)})
+
+		lo.Add(lo, new(big.Int).Lsh(big.NewInt(1), uint(h)))
+	}
+	return ret
+}
+
+// nextIP returns the address following ip, wrapping around at the
+// end of the address space.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// Utilization returns the fraction of p's usable addresses in use,
+// given the number that are allocated. Addresses excluded by
+// AvoidBuggyIPs or reserved ranges are not counted as usable. A pool
+// with no usable addresses is always fully utilized.
+func (p *Pool) Utilization(allocated int) float64 {
+	sz := p.Size()
+	if sz.Sign() <= 0 {
+		return 1
+	}
+	f, _ := new(big.Float).SetInt(sz).Float64()
+	return float64(allocated) / f
+}
+
+// Size returns the number of addresses in p that can be allocated,
+// taking AvoidBuggyIPs and Reserved into account.
+func (p *Pool) Size() *big.Int {
+	total := big.NewInt(0)
+	for _, cidr := range p.CIDR {
+		total.Add(total, cidrSize(cidr, p))
+	}
+	for _, cidr := range p.Reserved {
+		total.Sub(total, cidrSize(cidr, p))
+	}
+	return total
+}
+
+// TotalAddresses returns the number of allocatable addresses across
+// all of c's pools, taking AvoidBuggyIPs and Reserved into account.
+// Pools can't overlap, so no address is counted twice. Addresses in
+// ExcludeAddresses are still counted, since services can request
+// them explicitly.
+func (c *Config) TotalAddresses() *big.Int {
+	total := big.NewInt(0)
+	for _, p := range c.Pools {
+		total.Add(total, p.Size())
+	}
+	return total
+}
+
+// advertisedCIDRs returns the CIDRs of p that ad applies to.
+func (p *Pool) advertisedCIDRs(ad *Advertisement) []*net.IPNet {
+	if ad.CIDR != nil {
+		return ad.CIDR
+	}
+	return p.CIDR
+}
+
+// CoversIP returns true if a applies to ip, an address of its pool.
+func (a *Advertisement) CoversIP(ip net.IP) bool {
+	if a.CIDR == nil {
 		return true
 	}
+	for _, n := range a.CIDR {
+		if n.Contains(ip) {
+			return true
+		}
+	}
 	return false
 }
+
+// MaxRoutes returns the number of distinct routes ad announces when
+// every address of p is allocated. CIDRs longer than the aggregation
+// length, such as the pieces of an unaligned range, are counted once
+// per covering aggregate.
+func (p *Pool) MaxRoutes(ad *Advertisement) *big.Int {
+	total := big.NewInt(0)
+	aggs := map[string]bool{}
+	for _, n := range p.advertisedCIDRs(ad) {
+		o, b := n.Mask.Size()
+		agg := ad.AggregationLength
+		if b == 128 {
+			agg = ad.AggregationLengthV6
+		}
+		if o <= agg {
+			total.Add(total, new(big.Int).Lsh(big.NewInt(1), uint(agg-o)))
+			continue
+		}
+		m := net.CIDRMask(agg, b)
+		aggs[(&net.IPNet{IP: n.IP.Mask(m), Mask: m}).String()] = true
+	}
+	return total.Add(total, big.NewInt(int64(len(aggs))))
+}
+
+// cidrSize returns the number of addresses in n, excluding those
+// avoided by p.AvoidBuggyIPs. p may be nil, to count every address.
+func cidrSize(n *net.IPNet, p *Pool) *big.Int {
+	o, b := n.Mask.Size()
+	sz := new(big.Int).Lsh(big.NewInt(1), uint(b-o))
+	ip := n.IP.To4()
+	if p == nil || !p.AvoidBuggyIPs || ip == nil {
+		return sz
+	}
+	if o <= 24 {
+		// Each /24 present in the range has one .0 and one .255
+		// address.
+		buggies := int64(0)
+		if !p.IncludeNetwork {
+			buggies++
+		}
+		if !p.IncludeBroadcast {
+			buggies++
+		}
+		return sz.Sub(sz, big.NewInt(buggies<<uint(24-o)))
+	}
+	// Ranges smaller than /24 contain a buggy IP at each end that
+	// falls on a /24 boundary. A /32 has only one address, which
+	// is both ends.
+	first := ip.Mask(n.Mask)
+	last := net.IPv4(first[0], first[1], first[2], first[3]|^n.Mask[len(n.Mask)-1])
+	if p.AvoidsIP(first) {
+		sz.Sub(sz, big.NewInt(1))
+	}
+	if !last.Equal(first) && p.AvoidsIP(last) {
+		sz.Sub(sz, big.NewInt(1))
+	}
+	return sz
+}
+
+// cidrsOverlap returns true if a and b share any addresses. The
+// comparison is between the masked networks, so host bits set in a
+// hand-built IPNet don't hide a duplicate.
+func cidrsOverlap(a, b *net.IPNet) bool {
+	// Two prefixes overlap exactly when one contains the other, so
+	// the shorter one contains the network address of the longer one.
+	return a.Contains(b.IP.Mask(b.Mask)) || b.Contains(a.IP.Mask(a.Mask))
+}
+
+// sortCIDRs sorts ns into canonical order: IPv4 before IPv6, then by
+// network address, then shorter prefixes first.
+func sortCIDRs(ns []*net.IPNet) {
+	sort.SliceStable(ns, func(i, j int) bool {
+		a, b := ns[i], ns[j]
+		if a4, b4 := a.IP.To4() != nil, b.IP.To4() != nil; a4 != b4 {
+			return a4
+		}
+		if c := bytes.Compare(a.IP.Mask(a.Mask).To16(), b.IP.Mask(b.Mask).To16()); c != 0 {
+			return c < 0
+		}
+		ao, _ := a.Mask.Size()
+		bo, _ := b.Mask.Size()
+		return ao < bo
+	})
+}
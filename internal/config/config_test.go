@@ -1,11 +1,15 @@
 package config
 
 import (
+	"fmt"
+	"math/big"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 func ipnet(s string) *net.IPNet {
@@ -16,34 +20,31 @@ func ipnet(s string) *net.IPNet {
 	return n
 }
 
-func TestParse(t *testing.T) {
-	tests := []struct {
-		desc string
-		raw  string
-		want *Config
-	}{
-		{
-			desc: "empty config",
-			raw:  "",
-			want: &Config{
-				Pools: map[string]*Pool{},
-			},
-		},
+func selector(s string) labels.Selector {
+	ret, err := labels.Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return ret
+}
 
-		{
-			desc: "invalid yaml",
-			raw:  "foo:<>$@$2r24j90",
-		},
+var selectorComparer = cmp.Comparer(func(a, b labels.Selector) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.String() == b.String()
+})
 
-		{
-			desc: "config using all features",
-			raw: `
+// allFeaturesConfig is the raw config of the "config using all
+// features" test.
+const allFeaturesConfig = `
 peers:
 - my-asn: 42
   peer-asn: 142
   peer-address: 1.2.3.4
   peer-port: 1179
   hold-time: 180s
+  connect-retry-time: 5s
 - my-asn: 100
   peer-asn: 200
   peer-address: 2.3.4.5
@@ -63,45 +64,93 @@ address-pools:
 - name: pool2
   cidr:
   - 30.0.0.0/8
-`,
+`
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		desc string
+		raw  string
+		want *Config
+	}{
+		{
+			desc: "empty config",
+			raw:  "",
+			want: &Config{
+				BGPListenPort: 179,
+				Pools:         map[string]*Pool{},
+			},
+		},
+
+		{
+			desc: "invalid yaml",
+			raw:  "foo:<>$@$2r24j90",
+		},
+
+		{
+			desc: "config using all features",
+			raw:  allFeaturesConfig,
 			want: &Config{
+				BGPListenPort:    179,
+				CommunityAliases: map[string]uint32{"bar": 64512<<16 | 1234},
 				Peers: []*Peer{
 					{
-						MyASN:    42,
-						ASN:      142,
-						Addr:     net.ParseIP("1.2.3.4"),
-						Port:     1179,
-						HoldTime: 180 * time.Second,
+						MyASN:            42,
+						ASN:              142,
+						Addr:             net.ParseIP("1.2.3.4"),
+						Port:             1179,
+						HoldTime:         180 * time.Second,
+						KeepaliveTime:    60 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 5 * time.Second,
+						Enabled:          true,
+						MRAI:             30 * time.Second,
 					},
 					{
-						MyASN:    100,
-						ASN:      200,
-						Addr:     net.ParseIP("2.3.4.5"),
-						Port:     179,
-						HoldTime: 90 * time.Second,
+						MyASN:            100,
+						ASN:              200,
+						Addr:             net.ParseIP("2.3.4.5"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             30 * time.Second,
 					},
 				},
 				Pools: map[string]*Pool{
 					"pool1": &Pool{
+						Protocol:      BGP,
+						AutoAssign:    true,
 						CIDR:          []*net.IPNet{ipnet("10.20.0.0/16"), ipnet("10.50.0.0/24")},
 						AvoidBuggyIPs: true,
 						Advertisements: []*Advertisement{
 							{
-								AggregationLength: 32,
-								LocalPref:         100,
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								LocalPref:           100,
 								Communities: map[uint32]bool{
 									0xfc0004d2: true,
 									0x04D20929: true,
 								},
+								LargeCommunities: map[LargeCommunity]bool{},
 							},
 							{
-								AggregationLength: 24,
-								Communities:       map[uint32]bool{},
+								AggregationLength:   24,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities:         map[uint32]bool{},
+								LargeCommunities:    map[LargeCommunity]bool{},
 							},
 						},
 					},
 					"pool2": &Pool{
-						CIDR: []*net.IPNet{ipnet("30.0.0.0/8")},
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("30.0.0.0/8")},
 					},
 				},
 			},
@@ -116,13 +165,19 @@ peers:
   peer-address: 1.2.3.4
 `,
 			want: &Config{
+				BGPListenPort: 179,
 				Peers: []*Peer{
 					{
-						MyASN:    42,
-						ASN:      42,
-						Addr:     net.ParseIP("1.2.3.4"),
-						Port:     179,
-						HoldTime: 90 * time.Second,
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("1.2.3.4"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             5 * time.Second,
 					},
 				},
 				Pools: map[string]*Pool{},
@@ -130,254 +185,5979 @@ peers:
 		},
 
 		{
-			desc: "invalid peer-address",
+			desc: "peer by hostname",
 			raw: `
 peers:
 - my-asn: 42
   peer-asn: 42
-  peer-address: 1.2.3.400
+  peer-address: router-1.example.com
 `,
+			want: &Config{
+				BGPListenPort: 179,
+				Peers: []*Peer{
+					{
+						MyASN:            42,
+						ASN:              42,
+						AddrHostname:     "router-1.example.com",
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             5 * time.Second,
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
 		},
 
 		{
-			desc: "invalid my-asn",
+			desc: "invalid peer hostname",
 			raw: `
 peers:
-- peer-asn: 42
-  peer-address: 1.2.3.4
+- my-asn: 42
+  peer-asn: 42
+  peer-address: router_1.-example.com
 `,
 		},
 
 		{
-			desc: "invalid peer-asn",
+			desc: "link-local peer with zone",
 			raw: `
 peers:
 - my-asn: 42
-  peer-address: 1.2.3.4
+  peer-asn: 42
+  peer-address: fe80::1%eth0
 `,
+			want: &Config{
+				BGPListenPort: 179,
+				Peers: []*Peer{
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("fe80::1"),
+						Zone:             "eth0",
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             5 * time.Second,
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
 		},
 
 		{
-			desc: "invalid hold time (wrong format)",
+			desc: "link-local peer without zone",
 			raw: `
 peers:
 - my-asn: 42
   peer-asn: 42
-  peer-address: 1.2.3.4
-  hold-time: foo
+  peer-address: fe80::1
 `,
 		},
 
 		{
-			desc: "invalid hold time (too short)",
+			desc: "link-local peer with invalid zone",
 			raw: `
 peers:
 - my-asn: 42
   peer-asn: 42
-  peer-address: 1.2.3.4
-  hold-time: 1s
+  peer-address: fe80::1%this/is/not/an/interface
 `,
 		},
 
 		{
-			desc: "no pool name",
+			desc: "zone on global address",
 			raw: `
-address-pools:
--
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 2001:db8::1%eth0
 `,
 		},
 
 		{
-			desc: "address pool with no addresses",
+			desc: "peer in VRF",
 			raw: `
-address-pools:
-- name: pool1
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  vrf: red
 `,
 			want: &Config{
-				Pools: map[string]*Pool{
-					"pool1": &Pool{},
+				BGPListenPort: 179,
+				Peers: []*Peer{
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("1.2.3.4"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             5 * time.Second,
+						VRF:              "red",
+					},
 				},
+				Pools: map[string]*Pool{},
 			},
 		},
 
 		{
-			desc: "invalid pool CIDR",
+			desc: "peer originating a default route",
 			raw: `
-address-pools:
-- name: pool1
-  cidr:
-  - 100.200.300.400/24
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  originate-default: true
 `,
+			want: &Config{
+				BGPListenPort: 179,
+				Peers: []*Peer{
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("1.2.3.4"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             5 * time.Second,
+						OriginateDefault: true,
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
 		},
 
 		{
-			desc: "invalid pool CIDR prefix length",
+			desc: "peer with 4-byte ASNs disabled",
 			raw: `
-address-pools:
-- name: pool1
-  cidr:
-  - 1.2.3.0/33
+peers:
+- my-asn: 42
+  peer-asn: 65535
+  peer-address: 1.2.3.4
+  disable-4byte-asn: true
 `,
+			want: &Config{
+				BGPListenPort: 179,
+				Peers: []*Peer{
+					{
+						MyASN:            42,
+						ASN:              65535,
+						Addr:             net.ParseIP("1.2.3.4"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             30 * time.Second,
+						Disable4ByteASN:  true,
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
 		},
 
 		{
-			desc: "simple advertisement",
+			desc: "peer with route refresh disabled",
 			raw: `
-address-pools:
-- name: pool1
-  advertisements:
-  -
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  route-refresh: false
 `,
 			want: &Config{
-				Pools: map[string]*Pool{
-					"pool1": &Pool{
-						Advertisements: []*Advertisement{
-							{
-								AggregationLength: 32,
-								Communities:       map[uint32]bool{},
-							},
-						},
+				BGPListenPort: 179,
+				Peers: []*Peer{
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("1.2.3.4"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             5 * time.Second,
 					},
 				},
+				Pools: map[string]*Pool{},
 			},
 		},
 
 		{
-			desc: "bad aggregation length (too long)",
+			desc: "peer with graceful restart",
 			raw: `
-address-pools:
-- name: pool1
-  advertisements:
-  - aggregation-length: 33
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  graceful-restart:
+    enabled: true
+    stale-time: 120s
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.5
+  graceful-restart:
+    enabled: true
 `,
+			want: &Config{
+				BGPListenPort: 179,
+				Peers: []*Peer{
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("1.2.3.4"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             5 * time.Second,
+						GracefulRestart:  &GracefulRestart{StaleTime: 120 * time.Second},
+					},
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("1.2.3.5"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             5 * time.Second,
+						GracefulRestart:  &GracefulRestart{StaleTime: 360 * time.Second},
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
 		},
 
 		{
-			desc: "bad aggregation length (incompatible with CIDR)",
+			desc: "graceful restart stale time out of range",
 			raw: `
-address-pools:
-- name: pool1
-  cidr:
-  - 10.20.30.40/24
-  - 1.2.3.0/28
-  advertisements:
-  - aggregation-length: 26
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  graceful-restart:
+    enabled: true
+    stale-time: 5000s
 `,
 		},
 
 		{
-			desc: "bad community literal (wrong format)",
+			desc: "stale time with graceful restart disabled",
 			raw: `
-address-pools:
-- name: pool1
-  advertisements:
-  - communities: ["1234"]
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  graceful-restart:
+    stale-time: 120s
 `,
 		},
 
 		{
-			desc: "bad community literal (asn part doesn't fit)",
+			desc: "peer with capabilities",
 			raw: `
-address-pools:
-- name: pool1
-  advertisements:
-  - communities: ["99999999:1"]
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  capabilities: ["add-path", "extended-nexthop", "add-path"]
 `,
+			want: &Config{
+				BGPListenPort: 179,
+				Peers: []*Peer{
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("1.2.3.4"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             5 * time.Second,
+						Capabilities: map[Capability]bool{
+							CapabilityAddPath:         true,
+							CapabilityExtendedNextHop: true,
+						},
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
 		},
 
 		{
-			desc: "bad community literal (community# part doesn't fit)",
+			desc: "unknown capability",
 			raw: `
-address-pools:
-- name: pool1
-  advertisements:
-  - communities: ["1:99999999"]
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  capabilities: ["add-path", "time-travel"]
 `,
 		},
 
 		{
-			desc: "bad community ref (unknown ref)",
+			desc: "peers with add-paths",
 			raw: `
-address-pools:
-- name: pool1
-  advertisements:
-  - communities: ["flarb"]
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  add-paths: receive
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.5
+  add-paths: send
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.6
+  add-paths: both
 `,
+			want: &Config{
+				BGPListenPort: 179,
+				Peers: []*Peer{
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("1.2.3.4"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             5 * time.Second,
+						Capabilities:     map[Capability]bool{CapabilityAddPath: true},
+						AddPaths:         AddPathsReceive,
+					},
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("1.2.3.5"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             5 * time.Second,
+						Capabilities:     map[Capability]bool{CapabilityAddPath: true},
+						AddPaths:         AddPathsSend,
+					},
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("1.2.3.6"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             5 * time.Second,
+						Capabilities:     map[Capability]bool{CapabilityAddPath: true},
+						AddPaths:         AddPathsBoth,
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
 		},
 
 		{
-			desc: "bad community ref (ref asn doesn't fit)",
+			desc: "invalid add-paths mode",
 			raw: `
-communities:
-  flarb: 99999999:1
-address-pools:
-- name: pool1
-  advertisements:
-  - communities: ["flarb"]
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  add-paths: sideways
 `,
 		},
 
 		{
-			desc: "bad community ref (ref community# doesn't fit)",
+			desc: "non-boolean route refresh",
 			raw: `
-communities:
-  flarb: 1:99999999
-address-pools:
-- name: pool1
-  advertisements:
-  - communities: ["flarb"]
-`,
-		},
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  route-refresh: sometimes
+`,
+		},
+
+		{
+			desc: "peer communities",
+			raw: `
+communities:
+  site: 64512:7
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  communities: ["site", "1234:2345", "no-export"]
+`,
+			want: &Config{
+				BGPListenPort:    179,
+				CommunityAliases: map[string]uint32{"site": 64512<<16 | 7},
+				Peers: []*Peer{
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("1.2.3.4"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             5 * time.Second,
+						Communities: map[uint32]bool{
+							0xFC000007: true,
+							0x04D20929: true,
+							0xFFFFFF01: true,
+						},
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
+		},
+
+		{
+			desc: "malformed peer community",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  communities: ["1234:99999"]
+`,
+		},
+
+		{
+			desc: "peer strip communities",
+			raw: `
+communities:
+  internal: 64512:100
+peers:
+- my-asn: 42
+  peer-asn: 43
+  peer-address: 1.2.3.4
+  strip-communities: ["internal", "64512:101"]
+`,
+			want: &Config{
+				BGPListenPort:    179,
+				CommunityAliases: map[string]uint32{"internal": 64512<<16 | 100},
+				Peers: []*Peer{
+					{
+						MyASN:            42,
+						ASN:              43,
+						Addr:             net.ParseIP("1.2.3.4"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             30 * time.Second,
+						StripCommunities: map[uint32]bool{
+							0xFC000064: true,
+							0xFC000065: true,
+						},
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
+		},
+
+		{
+			desc: "malformed peer strip community",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 43
+  peer-address: 1.2.3.4
+  strip-communities: ["64512"]
+`,
+		},
+
+		{
+			desc: "peer both adds and strips a community",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 43
+  peer-address: 1.2.3.4
+  communities: ["64512:100"]
+  strip-communities: ["64512:100"]
+`,
+		},
+
+		{
+			desc: "4-byte ASN with 4-byte ASNs disabled",
+			raw: `
+peers:
+- my-asn: 4200000000
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  disable-4byte-asn: true
+`,
+		},
+
+		{
+			desc: "default route with only layer2 pools",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  originate-default: true
+address-pools:
+- name: pool1
+  protocol: layer2
+  cidr:
+  - 10.20.0.0/24
+`,
+		},
+
+		{
+			desc: "passive peer",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  passive: true
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 2.3.4.5
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Peers: []*Peer{
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("1.2.3.4"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						Passive:          true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             5 * time.Second,
+					},
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("2.3.4.5"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             5 * time.Second,
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
+		},
+
+		{
+			desc: "peer with TTL security",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  min-ttl: 254
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Peers: []*Peer{
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("1.2.3.4"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						MinTTL:           254,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             5 * time.Second,
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
+		},
+
+		{
+			desc: "invalid min-ttl",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  min-ttl: 256
+`,
+		},
+
+		{
+			desc: "max prefix actions",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  max-prefixes: 100
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.5
+  max-prefixes: 200
+  max-prefixes-action: restart
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.6
+  max-prefixes: 300
+  max-prefixes-action: disable
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Peers: []*Peer{
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("1.2.3.4"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						MaxPrefixes:      MaxPrefixes{Limit: 100, Action: MaxPrefixesWarn},
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             5 * time.Second,
+					},
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("1.2.3.5"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						MaxPrefixes:      MaxPrefixes{Limit: 200, Action: MaxPrefixesRestart},
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             5 * time.Second,
+					},
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("1.2.3.6"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						MaxPrefixes:      MaxPrefixes{Limit: 300, Action: MaxPrefixesDisable},
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             5 * time.Second,
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
+		},
+
+		{
+			desc: "invalid max-prefixes-action",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  max-prefixes: 100
+  max-prefixes-action: explode
+`,
+		},
+
+		{
+			desc: "max-prefixes-action without limit",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  max-prefixes-action: warn
+`,
+		},
+
+		{
+			desc: "passive peer by hostname",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: router-1.example.com
+  passive: true
+`,
+		},
+
+		{
+			desc: "invalid VRF name",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  vrf: red/blue
+`,
+		},
+
+		{
+			desc: "invalid peer-address",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.400
+`,
+		},
+
+		{
+			desc: "invalid my-asn",
+			raw: `
+peers:
+- peer-asn: 42
+  peer-address: 1.2.3.4
+`,
+		},
+
+		{
+			desc: "invalid peer-asn",
+			raw: `
+peers:
+- my-asn: 42
+  peer-address: 1.2.3.4
+`,
+		},
+
+		{
+			desc: "invalid hold time (wrong format)",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  hold-time: foo
+`,
+		},
+
+		{
+			desc: "invalid hold time (too short)",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  hold-time: 1s
+`,
+		},
+
+		{
+			desc: "hold time in whole seconds",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  hold-time: 90000ms
+  keepalive-time: 30s
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Peers: []*Peer{
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("1.2.3.4"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             5 * time.Second,
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
+		},
+
+		{
+			desc: "invalid hold time (fractional second)",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  hold-time: 90500ms
+`,
+		},
+
+		{
+			desc: "invalid keepalive time (fractional second)",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  keepalive-time: 1.5s
+`,
+		},
+
+		{
+			desc: "global timers inherited and overridden",
+			raw: `
+hold-time: 30s
+keepalive-time: 5s
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 2.3.4.5
+  hold-time: 60s
+  keepalive-time: 20s
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Peers: []*Peer{
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("1.2.3.4"),
+						Port:             179,
+						HoldTime:         30 * time.Second,
+						KeepaliveTime:    5 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             5 * time.Second,
+					},
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("2.3.4.5"),
+						Port:             179,
+						HoldTime:         60 * time.Second,
+						KeepaliveTime:    20 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             5 * time.Second,
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
+		},
+
+		{
+			desc: "invalid global hold time (too short)",
+			raw: `
+hold-time: 1s
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+`,
+		},
+
+		{
+			desc: "invalid global keepalive time (not below hold time)",
+			raw: `
+hold-time: 30s
+keepalive-time: 30s
+`,
+		},
+
+		{
+			desc: "invalid keepalive time (not below hold time)",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  hold-time: 30s
+  keepalive-time: 40s
+`,
+		},
+
+		{
+			desc: "inherited keepalive time not below peer's hold time",
+			raw: `
+keepalive-time: 20s
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  hold-time: 15s
+`,
+		},
+
+		{
+			desc: "min-route-advertisement-interval",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 142
+  peer-address: 1.2.3.4
+  min-route-advertisement-interval: 10s
+- my-asn: 42
+  peer-asn: 142
+  peer-address: 2.3.4.5
+  min-route-advertisement-interval: 0s
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Peers: []*Peer{
+					{
+						MyASN:            42,
+						ASN:              142,
+						Addr:             net.ParseIP("1.2.3.4"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             10 * time.Second,
+					},
+					{
+						MyASN:            42,
+						ASN:              142,
+						Addr:             net.ParseIP("2.3.4.5"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
+		},
+
+		{
+			desc: "all peers disabled with a bgp pool",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  enabled: false
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+- name: pool2
+  protocol: layer2
+  cidr:
+  - 10.30.0.0/24
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Peers: []*Peer{
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("1.2.3.4"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						MRAI:             5 * time.Second,
+					},
+				},
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.20.0.0/24")},
+					},
+					"pool2": &Pool{
+						Protocol:   Layer2,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.30.0.0/24")},
+					},
+				},
+				Warnings: []string{
+					`bgp address pool "pool1" can't be announced, all peers are disabled`,
+				},
+			},
+		},
+
+		{
+			desc: "some peers disabled",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  enabled: false
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 2.3.4.5
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Peers: []*Peer{
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("1.2.3.4"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						MRAI:             5 * time.Second,
+					},
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("2.3.4.5"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						MRAI:             5 * time.Second,
+						Enabled:          true,
+					},
+				},
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.20.0.0/24")},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "peer group with only a disabled peer",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  peer-group: tor
+  enabled: false
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 2.3.4.5
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  advertisements:
+  - peer-groups: ["tor"]
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Peers: []*Peer{
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("1.2.3.4"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						MRAI:             5 * time.Second,
+						PeerGroup:        "tor",
+					},
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("2.3.4.5"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						MRAI:             5 * time.Second,
+						Enabled:          true,
+					},
+				},
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.20.0.0/24")},
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Communities:         map[uint32]bool{},
+								LargeCommunities:    map[LargeCommunity]bool{},
+								PeerGroups:          []string{"tor"},
+								Origin:              OriginIGP,
+								Enabled:             true,
+							},
+						},
+					},
+				},
+				Warnings: []string{
+					`advertisement #1 of pool "pool1" can't be announced, all peers of its peer groups are disabled`,
+				},
+			},
+		},
+
+		{
+			desc: "invalid min-route-advertisement-interval (negative)",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  min-route-advertisement-interval: -5s
+`,
+		},
+
+		{
+			desc: "invalid connect retry time (zero)",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  connect-retry-time: 0s
+`,
+		},
+
+		{
+			desc: "invalid connect retry time (negative)",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  connect-retry-time: -5s
+`,
+		},
+
+		{
+			desc: "excluded addresses",
+			raw: `
+exclude-addresses:
+- 10.20.0.1/32
+- 10.30.0.0/24
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/16
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.20.0.0/16")},
+					},
+				},
+				ExcludeAddresses: []*net.IPNet{ipnet("10.20.0.1/32"), ipnet("10.30.0.0/24")},
+			},
+		},
+
+		{
+			desc: "invalid excluded CIDR",
+			raw: `
+exclude-addresses:
+- 10.20.0.300/32
+`,
+		},
+
+		{
+			desc: "graceful shutdown time",
+			raw: `
+graceful-shutdown-time: 30s
+`,
+			want: &Config{
+				BGPListenPort:        179,
+				Pools:                map[string]*Pool{},
+				GracefulShutdownTime: 30 * time.Second,
+			},
+		},
+
+		{
+			desc: "negative graceful shutdown time",
+			raw: `
+graceful-shutdown-time: -30s
+`,
+		},
+
+		{
+			desc: "invalid graceful shutdown time",
+			raw: `
+graceful-shutdown-time: soon
+`,
+		},
+
+		{
+			desc: "reload min interval",
+			raw: `
+reload-min-interval: 10s
+`,
+			want: &Config{
+				BGPListenPort:     179,
+				Pools:             map[string]*Pool{},
+				ReloadMinInterval: 10 * time.Second,
+			},
+		},
+
+		{
+			desc: "negative reload min interval",
+			raw: `
+reload-min-interval: -10s
+`,
+		},
+
+		{
+			desc: "pool announce delay",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  announce-delay: 250ms
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:      BGP,
+						AutoAssign:    true,
+						CIDR:          []*net.IPNet{ipnet("10.20.0.0/24")},
+						AnnounceDelay: 250 * time.Millisecond,
+					},
+				},
+			},
+		},
+
+		{
+			desc: "negative pool announce delay",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  announce-delay: -1s
+`,
+		},
+
+		{
+			desc: "custom BGP listen port",
+			raw: `
+bgp-listen-port: 1179
+`,
+			want: &Config{
+				BGPListenPort: 1179,
+				Pools:         map[string]*Pool{},
+			},
+		},
+
+		{
+			desc: "BGP listen port out of range",
+			raw: `
+bgp-listen-port: 65536
+`,
+		},
+
+		{
+			desc: "BGP listen port zero",
+			raw: `
+bgp-listen-port: 0
+`,
+		},
+
+		{
+			desc: "confederation",
+			raw: `
+confederation:
+  confed-id: 100
+  members: [42, 43]
+peers:
+- my-asn: 42
+  peer-asn: 43
+  peer-address: 1.2.3.4
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Confederation: &Confederation{
+					ID:      100,
+					Members: []uint32{42, 43},
+				},
+				Peers: []*Peer{
+					{
+						MyASN:            42,
+						ASN:              43,
+						Addr:             net.ParseIP("1.2.3.4"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             30 * time.Second,
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
+		},
+
+		{
+			desc: "peer outside confederation",
+			raw: `
+confederation:
+  confed-id: 100
+  members: [42, 43]
+peers:
+- my-asn: 44
+  peer-asn: 43
+  peer-address: 1.2.3.4
+`,
+		},
+
+		{
+			desc: "advertisement rule",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 43
+  peer-address: 1.2.3.4
+  peer-group: tor
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+rules:
+- pool: pool1
+  peer-group: tor
+  condition: service-count > 3
+  action: advertise
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Peers: []*Peer{
+					{
+						MyASN:            42,
+						ASN:              43,
+						Addr:             net.ParseIP("1.2.3.4"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             30 * time.Second,
+						PeerGroup:        "tor",
+					},
+				},
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.20.0.0/24")},
+					},
+				},
+				Rules: []*Rule{
+					{
+						Pool:      "pool1",
+						PeerGroup: "tor",
+						Condition: Condition{Metric: MetricServiceCount, Op: OpGreater, Value: 3},
+						Action:    ActionAdvertise,
+					},
+				},
+			},
+		},
+
+		{
+			desc: "speaker node selector",
+			raw: `
+speaker-node-selector: metallb.universe.tf/bgp=true,!edge
+`,
+			want: &Config{
+				BGPListenPort:       179,
+				Pools:               map[string]*Pool{},
+				SpeakerNodeSelector: selector("metallb.universe.tf/bgp=true,!edge"),
+			},
+		},
+
+		{
+			desc: "malformed speaker node selector",
+			raw: `
+speaker-node-selector: bgp in (true
+`,
+		},
+
+		{
+			desc: "pool reference in exclude-addresses",
+			raw: `
+exclude-addresses:
+- 10.0.0.1
+- pool:reserved
+address-pools:
+- name: reserved
+  cidr:
+  - 10.20.0.0/24
+  - 10.30.0.0/24
+`,
+			want: &Config{
+				BGPListenPort:    179,
+				ExcludeAddresses: []*net.IPNet{ipnet("10.0.0.1/32"), ipnet("10.20.0.0/24"), ipnet("10.30.0.0/24")},
+				Pools: map[string]*Pool{
+					"reserved": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.20.0.0/24"), ipnet("10.30.0.0/24")},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "dangling pool reference in exclude-addresses",
+			raw: `
+exclude-addresses:
+- pool:missing
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+`,
+		},
+
+		{
+			desc: "passive peer port collides with custom listen port",
+			raw: `
+bgp-listen-port: 1179
+peers:
+- my-asn: 42
+  peer-asn: 43
+  peer-address: 1.2.3.4
+  peer-port: 1179
+  passive: true
+`,
+			want: &Config{
+				BGPListenPort: 1179,
+				Peers: []*Peer{
+					{
+						MyASN:            42,
+						ASN:              43,
+						Addr:             net.ParseIP("1.2.3.4"),
+						Port:             1179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             30 * time.Second,
+						Passive:          true,
+					},
+				},
+				Pools: map[string]*Pool{},
+				Warnings: []string{
+					`passive peer "1.2.3.4" has peer-port 1179, the same as bgp-listen-port, but peer-port is the router's port, not the one MetalLB listens on`,
+				},
+			},
+		},
+
+		{
+			desc: "named peers",
+			raw: `
+peers:
+- name: tor-1
+  my-asn: 42
+  peer-asn: 43
+  peer-address: 1.2.3.4
+- my-asn: 42
+  peer-asn: 43
+  peer-address: 1.2.3.5
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Peers: []*Peer{
+					{
+						Name:             "tor-1",
+						MyASN:            42,
+						ASN:              43,
+						Addr:             net.ParseIP("1.2.3.4"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             30 * time.Second,
+					},
+					{
+						MyASN:            42,
+						ASN:              43,
+						Addr:             net.ParseIP("1.2.3.5"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             30 * time.Second,
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
+		},
+
+		{
+			desc: "duplicate peer names",
+			raw: `
+peers:
+- name: tor-1
+  my-asn: 42
+  peer-asn: 43
+  peer-address: 1.2.3.4
+- name: tor-1
+  my-asn: 42
+  peer-asn: 43
+  peer-address: 1.2.3.5
+`,
+		},
+
+		{
+			desc: "peer name not a DNS-1123 label",
+			raw: `
+peers:
+- name: Tor_1
+  my-asn: 42
+  peer-asn: 43
+  peer-address: 1.2.3.4
+`,
+		},
+
+		{
+			desc: "rule with unknown action",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+rules:
+- pool: pool1
+  condition: service-count > 3
+  action: shout
+`,
+		},
+
+		{
+			desc: "rule with unknown metric",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+rules:
+- pool: pool1
+  condition: peer-count > 3
+  action: withdraw
+`,
+		},
+
+		{
+			desc: "rule for unknown pool",
+			raw: `
+rules:
+- pool: pool1
+  condition: service-count > 3
+  action: withdraw
+`,
+		},
+
+		{
+			desc: "confederation without members",
+			raw: `
+confederation:
+  confed-id: 100
+`,
+		},
+
+		{
+			desc: "dampening",
+			raw: `
+dampening:
+  suppress-threshold: 3000
+  reuse-threshold: 1000
+  half-life: 5m
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools:         map[string]*Pool{},
+				Dampening: &Dampening{
+					SuppressThreshold: 3000,
+					ReuseThreshold:    1000,
+					HalfLife:          5 * time.Minute,
+					MaxSuppressTime:   60 * time.Minute,
+				},
+			},
+		},
+
+		{
+			desc: "dampening with defaults",
+			raw: `
+dampening: {}
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools:         map[string]*Pool{},
+				Dampening: &Dampening{
+					SuppressThreshold: 2000,
+					ReuseThreshold:    750,
+					HalfLife:          15 * time.Minute,
+					MaxSuppressTime:   60 * time.Minute,
+				},
+			},
+		},
+
+		{
+			desc: "dampening reuse above suppress",
+			raw: `
+dampening:
+  suppress-threshold: 1000
+  reuse-threshold: 2000
+`,
+		},
+
+		{
+			desc: "dampening reuse equal to suppress",
+			raw: `
+dampening:
+  suppress-threshold: 1000
+  reuse-threshold: 1000
+`,
+		},
+
+		{
+			desc: "dampening zero half-life",
+			raw: `
+dampening:
+  half-life: 0s
+`,
+		},
+
+		{
+			desc: "dampening max-suppress-time below half-life",
+			raw: `
+dampening:
+  half-life: 30m
+  max-suppress-time: 10m
+`,
+		},
+
+		{
+			desc: "no pool name",
+			raw: `
+address-pools:
+-
+`,
+		},
+
+		{
+			desc: "address pool with no addresses",
+			raw: `
+address-pools:
+- name: pool1
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+					},
+				},
+			},
+		},
+
+		{
+			desc: "address pool with reserved addresses",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  reserved-addresses:
+  - 10.20.0.1/32
+  - 10.20.0.128/25
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.20.0.0/24")},
+						Reserved:   []*net.IPNet{ipnet("10.20.0.1/32"), ipnet("10.20.0.128/25")},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "invalid reserved CIDR",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  reserved-addresses:
+  - 10.20.0.1/33
+`,
+		},
+
+		{
+			desc: "reserved CIDR outside of pool",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  reserved-addresses:
+  - 10.20.0.0/16
+`,
+		},
+
+		{
+			desc: "overlapping reserved CIDRs",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  reserved-addresses:
+  - 10.20.0.0/25
+  - 10.20.0.1/32
+`,
+		},
+
+		{
+			desc: "address pool exhausted by avoid-buggy-ips and reserved addresses",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/30
+  - 10.20.1.255/32
+  avoid-buggy-ips: true
+  reserved-addresses:
+  - 10.20.0.1/32
+  - 10.20.0.2/31
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:      BGP,
+						AutoAssign:    true,
+						CIDR:          []*net.IPNet{ipnet("10.20.0.0/30"), ipnet("10.20.1.255/32")},
+						AvoidBuggyIPs: true,
+						Reserved:      []*net.IPNet{ipnet("10.20.0.1/32"), ipnet("10.20.0.2/31")},
+					},
+				},
+				Warnings: []string{
+					`address pool "pool1" has no usable addresses after avoid-buggy-ips and reserved-addresses are applied`,
+				},
+			},
+		},
+
+		{
+			desc: "peer address inside address pool",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 10.20.0.1
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/16
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Peers: []*Peer{
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("10.20.0.1"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             5 * time.Second,
+					},
+				},
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.20.0.0/16")},
+					},
+				},
+				Warnings: []string{
+					`peer address "10.20.0.1" is inside address pool "pool1", and could be allocated to a service`,
+				},
+			},
+		},
+
+		{
+			desc: "peer address inside reserved range",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 10.20.0.1
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/16
+  reserved-addresses:
+  - 10.20.0.0/24
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Peers: []*Peer{
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("10.20.0.1"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             5 * time.Second,
+					},
+				},
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.20.0.0/16")},
+						Reserved:   []*net.IPNet{ipnet("10.20.0.0/24")},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "allocation strategies",
+			raw: `
+address-pools:
+- name: pool1
+  allocation-strategy: lowest
+- name: pool2
+  allocation-strategy: highest
+- name: pool3
+  allocation-strategy: random
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:           BGP,
+						AutoAssign:         true,
+						AllocationStrategy: AllocateLowest,
+					},
+					"pool2": &Pool{
+						Protocol:           BGP,
+						AutoAssign:         true,
+						AllocationStrategy: AllocateHighest,
+					},
+					"pool3": &Pool{
+						Protocol:           BGP,
+						AutoAssign:         true,
+						AllocationStrategy: AllocateRandom,
+					},
+				},
+			},
+		},
+
+		{
+			desc: "invalid allocation strategy",
+			raw: `
+address-pools:
+- name: pool1
+  allocation-strategy: sideways
+`,
+		},
+
+		{
+			desc: "pool weights",
+			raw: `
+address-pools:
+- name: pool1
+  weight: 3
+- name: pool2
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						Weight:     3,
+					},
+					"pool2": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+					},
+				},
+			},
+		},
+
+		{
+			desc: "pool service class",
+			raw: `
+address-pools:
+- name: pool1
+  service-class: premium
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:     BGP,
+						AutoAssign:   true,
+						ServiceClass: "premium",
+					},
+				},
+			},
+		},
+
+		{
+			desc: "pool without auto-assign",
+			raw: `
+address-pools:
+- name: pool1
+  auto-assign: false
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol: BGP,
+					},
+				},
+			},
+		},
+
+		{
+			desc: "system pool",
+			raw: `
+address-pools:
+- name: health
+  system: true
+  cidr:
+  - 10.20.0.10/32
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"health": &Pool{
+						Protocol: BGP,
+						System:   true,
+						CIDR:     []*net.IPNet{ipnet("10.20.0.10/32")},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "auto-assign system pool",
+			raw: `
+address-pools:
+- name: health
+  system: true
+  auto-assign: true
+  cidr:
+  - 10.20.0.10/32
+`,
+		},
+
+		{
+			desc: "empty pool service class",
+			raw: `
+address-pools:
+- name: pool1
+  service-class: ""
+`,
+		},
+
+		{
+			desc: "pool with allowed communities",
+			raw: `
+communities:
+  bar: 64512:1234
+address-pools:
+- name: pool1
+  allowed-communities:
+  - 1234:2345
+  - bar
+  - no-export
+`,
+			want: &Config{
+				BGPListenPort:    179,
+				CommunityAliases: map[string]uint32{"bar": 64512<<16 | 1234},
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						AllowedCommunities: map[uint32]bool{
+							0x04D20929: true,
+							0xFC0004D2: true,
+							0xFFFFFF01: true,
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "malformed allowed community",
+			raw: `
+address-pools:
+- name: pool1
+  allowed-communities:
+  - 1234
+`,
+		},
+
+		{
+			desc: "pool including network addresses",
+			raw: `
+address-pools:
+- name: pool1
+  avoid-buggy-ips: true
+  include-network: true
+  cidr:
+  - 10.20.0.0/24
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:       BGP,
+						AutoAssign:     true,
+						AvoidBuggyIPs:  true,
+						IncludeNetwork: true,
+						CIDR:           []*net.IPNet{ipnet("10.20.0.0/24")},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "include-broadcast in IPv6 pool",
+			raw: `
+address-pools:
+- name: pool1
+  avoid-buggy-ips: true
+  include-broadcast: true
+  cidr:
+  - 2001:db8::/64
+`,
+		},
+
+		{
+			desc: "dual-stack pool",
+			raw: `
+address-pools:
+- name: pool1
+  ip-family: dual
+  cidr:
+  - 10.20.0.0/24
+  - 2001:db8::/64
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						IPFamily:   DualStack,
+						CIDR:       []*net.IPNet{ipnet("10.20.0.0/24"), ipnet("2001:db8::/64")},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "dual-stack pool with only IPv4 CIDRs",
+			raw: `
+address-pools:
+- name: pool1
+  ip-family: dual
+  cidr:
+  - 10.20.0.0/24
+`,
+		},
+
+		{
+			desc: "IPv4 pool with IPv6 CIDR",
+			raw: `
+address-pools:
+- name: pool1
+  ip-family: ipv4
+  cidr:
+  - 2001:db8::/64
+`,
+		},
+
+		{
+			desc: "unknown ip-family",
+			raw: `
+address-pools:
+- name: pool1
+  ip-family: ipx
+`,
+		},
+
+		{
+			desc: "negative pool weight",
+			raw: `
+address-pools:
+- name: pool1
+  weight: -1
+`,
+		},
+
+		{
+			desc: "layer2 pool with node selectors",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  cidr:
+  - 10.20.0.0/24
+  node-selectors:
+  - role=edge-gateway
+  - rack in (r1, r2),!drained
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   Layer2,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.20.0.0/24")},
+						NodeSelectors: []labels.Selector{
+							selector("role=edge-gateway"),
+							selector("rack in (r1, r2),!drained"),
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "pool with address range",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.10 - 10.20.0.17
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR: []*net.IPNet{
+							ipnet("10.20.0.10/31"),
+							ipnet("10.20.0.12/30"),
+							ipnet("10.20.0.16/31"),
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "reversed address range",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.17-10.20.0.10
+`,
+		},
+
+		{
+			desc: "address range with invalid end",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.10-10.20.0
+`,
+		},
+
+		{
+			desc: "pool with pinned address",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  reserved-addresses:
+  - 10.20.0.0/28
+  pinned-addresses:
+  - address: 10.20.0.53
+    service: kube-system/dns
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.20.0.0/24")},
+						Reserved:   []*net.IPNet{ipnet("10.20.0.0/28")},
+						PinnedAddresses: []PinnedAddress{
+							{IP: net.ParseIP("10.20.0.53").To4(), Service: "kube-system/dns"},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "pinned address inside reserved range",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  reserved-addresses:
+  - 10.20.0.0/28
+  pinned-addresses:
+  - address: 10.20.0.5
+    service: kube-system/dns
+`,
+		},
+
+		{
+			desc: "pinned address outside pool",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  pinned-addresses:
+  - address: 10.30.0.5
+    service: kube-system/dns
+`,
+		},
+
+		{
+			desc: "pinned service without namespace",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  pinned-addresses:
+  - address: 10.20.0.5
+    service: dns
+`,
+		},
+
+		{
+			desc: "service pinned twice",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  pinned-addresses:
+  - address: 10.20.0.5
+    service: kube-system/dns
+- name: pool2
+  cidr:
+  - 10.30.0.0/24
+  pinned-addresses:
+  - address: 10.30.0.5
+    service: kube-system/dns
+`,
+		},
+
+		{
+			desc: "pool with service selectors",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  service-selectors:
+  - tier=frontend
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:         BGP,
+						AutoAssign:       true,
+						CIDR:             []*net.IPNet{ipnet("10.20.0.0/24")},
+						ServiceSelectors: []labels.Selector{selector("tier=frontend")},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "invalid service selector",
+			raw: `
+address-pools:
+- name: pool1
+  service-selectors:
+  - tier==front=end
+`,
+		},
+
+		{
+			desc: "layer2 pool with node priorities",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  cidr:
+  - 10.20.0.0/24
+  node-priorities:
+  - node-selector: rack=r1
+    priority: 10
+  - node-selector: role=edge
+    priority: 0
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   Layer2,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.20.0.0/24")},
+						NodePriorities: []NodePriority{
+							{Selector: selector("rack=r1"), Priority: 10},
+							{Selector: selector("role=edge"), Priority: 0},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "layer2 pool with interface-selection auto",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  cidr:
+  - 10.20.0.0/24
+  interface-selection: auto
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:           Layer2,
+						AutoAssign:         true,
+						CIDR:               []*net.IPNet{ipnet("10.20.0.0/24")},
+						InterfaceSelection: InterfaceAuto,
+					},
+				},
+			},
+		},
+
+		{
+			desc: "layer2 pool with interface-selection explicit",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  cidr:
+  - 10.20.0.0/24
+  interface-selection: explicit
+  interfaces: ["eth0", "bond0.100"]
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:           Layer2,
+						AutoAssign:         true,
+						CIDR:               []*net.IPNet{ipnet("10.20.0.0/24")},
+						InterfaceSelection: InterfaceExplicit,
+						Interfaces:         []string{"eth0", "bond0.100"},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "explicit interface-selection without interfaces",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  interface-selection: explicit
+`,
+		},
+
+		{
+			desc: "interfaces with auto interface-selection",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  interface-selection: auto
+  interfaces: ["eth0"]
+`,
+		},
+
+		{
+			desc: "unknown interface-selection",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  interface-selection: magic
+`,
+		},
+
+		{
+			desc: "interface-selection on bgp pool",
+			raw: `
+address-pools:
+- name: pool1
+  interface-selection: auto
+`,
+		},
+
+		{
+			desc: "negative node priority",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  node-priorities:
+  - node-selector: rack=r1
+    priority: -1
+`,
+		},
+
+		{
+			desc: "node priorities on bgp pool",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  node-priorities:
+  - node-selector: rack=r1
+    priority: 10
+`,
+		},
+
+		{
+			desc: "invalid node selector",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  node-selectors:
+  - role==edge=gateway
+`,
+		},
+
+		{
+			desc: "node selectors on bgp pool",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  node-selectors:
+  - role=edge-gateway
+`,
+		},
+
+		{
+			desc: "advertisements on layer2 pool",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  advertisements:
+  -
+`,
+		},
+
+		{
+			desc: "CIDRs in listed order",
+			raw: `
+address-pools:
+- name: pool1
+  cidr-order: listed
+  cidr:
+  - 10.30.0.0/24
+  - 10.20.0.0/24
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.30.0.0/24"), ipnet("10.20.0.0/24")},
+						CIDROrder:  CIDROrderListed,
+					},
+				},
+			},
+		},
+
+		{
+			desc: "unknown cidr-order",
+			raw: `
+address-pools:
+- name: pool1
+  cidr-order: random
+`,
+		},
+
+		{
+			desc: "duplicate CIDR listed out of order",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  - 10.10.0.0/24
+  - 10.20.0.0/24
+`,
+		},
+
+		{
+			desc: "unknown protocol",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: carrier-pigeon
+`,
+		},
+
+		{
+			desc: "single protocol in a list",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: [layer2]
+  cidr:
+  - 10.20.0.0/24
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   Layer2,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.20.0.0/24")},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "pool with both protocols",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: [bgp, layer2]
+  cidr:
+  - 10.20.0.0/24
+  node-selectors:
+  - role=edge
+  advertisements:
+  - localpref: 100
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:      BGP,
+						Protocols:     []Proto{BGP, Layer2},
+						AutoAssign:    true,
+						CIDR:          []*net.IPNet{ipnet("10.20.0.0/24")},
+						NodeSelectors: []labels.Selector{selector("role=edge")},
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								LocalPref:           100,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities:         map[uint32]bool{},
+								LargeCommunities:    map[LargeCommunity]bool{},
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "unknown protocol in a list",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: [layer2, carrier-pigeon]
+`,
+		},
+
+		{
+			desc: "duplicate protocol in a list",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: [layer2, layer2]
+  advertisements:
+  - localpref: 100
+`,
+		},
+
+		{
+			desc: "empty protocol list",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: []
+`,
+		},
+
+		{
+			desc: "bare IPs in pool CIDRs",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.5
+  - 2001:db8::1
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.20.0.5/32"), ipnet("2001:db8::1/128")},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "invalid bare IP in pool CIDRs",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.500
+`,
+		},
+
+		{
+			desc: "invalid pool CIDR",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 100.200.300.400/24
+`,
+		},
+
+		{
+			desc: "invalid pool CIDR prefix length",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 1.2.3.0/33
+`,
+		},
+
+		{
+			desc: "advertisement to peer group",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  peer-group: tor
+address-pools:
+- name: pool1
+  advertisements:
+  - peer-groups: ["tor"]
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Peers: []*Peer{
+					{
+						MyASN:            42,
+						ASN:              42,
+						Addr:             net.ParseIP("1.2.3.4"),
+						Port:             179,
+						HoldTime:         90 * time.Second,
+						KeepaliveTime:    30 * time.Second,
+						RouteRefresh:     true,
+						ConnectRetryTime: 2 * time.Second,
+						Enabled:          true,
+						MRAI:             5 * time.Second,
+						PeerGroup:        "tor",
+					},
+				},
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities:         map[uint32]bool{},
+								LargeCommunities:    map[LargeCommunity]bool{},
+								PeerGroups:          []string{"tor"},
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "advertisement to peer group with no peers",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  peer-group: tor
+address-pools:
+- name: pool1
+  advertisements:
+  - peer-groups: ["spine"]
+`,
+		},
+
+		{
+			desc: "advertisement to IBGP peers only",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - no-advertise-ebgp: true
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities:         map[uint32]bool{},
+								LargeCommunities:    map[LargeCommunity]bool{},
+								NoAdvertiseEBGP:     true,
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "non-boolean no-advertise-ebgp",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - no-advertise-ebgp: sometimes
+`,
+		},
+
+		{
+			desc: "localpref 0",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - localpref: 0
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								LocalPref:           0,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities:         map[uint32]bool{},
+								LargeCommunities:    map[LargeCommunity]bool{},
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "localpref 100",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - localpref: 100
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								LocalPref:           100,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities:         map[uint32]bool{},
+								LargeCommunities:    map[LargeCommunity]bool{},
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "global localpref inherited and overridden",
+			raw: `
+localpref: 200
+address-pools:
+- name: pool1
+  advertisements:
+  -
+  - localpref: 100
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								LocalPref:           200,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities:         map[uint32]bool{},
+								LargeCommunities:    map[LargeCommunity]bool{},
+							},
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								LocalPref:           100,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities:         map[uint32]bool{},
+								LargeCommunities:    map[LargeCommunity]bool{},
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "invalid global localpref (too large)",
+			raw: `
+localpref: 4294967296
+`,
+		},
+
+		{
+			desc: "invalid global localpref (negative)",
+			raw: `
+localpref: -1
+`,
+		},
+
+		{
+			desc: "advertisement within allowed aggregation lengths",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  - 2001:db8::/64
+  allowed-aggregation-lengths: [24, 32, 64]
+  advertisements:
+  - aggregation-length: 24
+    aggregation-length-v6: 64
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:                  BGP,
+						AutoAssign:                true,
+						CIDR:                      []*net.IPNet{ipnet("10.20.0.0/24"), ipnet("2001:db8::/64")},
+						AllowedAggregationLengths: []int{24, 32, 64},
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   24,
+								AggregationLengthV6: 64,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities:         map[uint32]bool{},
+								LargeCommunities:    map[LargeCommunity]bool{},
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "advertisement outside allowed aggregation lengths",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  allowed-aggregation-lengths: [24]
+  advertisements:
+  - aggregation-length: 32
+`,
+		},
+
+		{
+			desc: "IPv6 advertisement outside allowed aggregation lengths",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 2001:db8::/64
+  allowed-aggregation-lengths: [32, 64]
+  advertisements:
+  -
+`,
+		},
+
+		{
+			desc: "negative localpref",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - localpref: -1
+`,
+		},
+
+		{
+			desc: "localpref too large",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - localpref: 4294967296
+`,
+		},
+
+		{
+			desc: "unknown advertisement key",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - future-feature: true
+    localpref: 100
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								LocalPref:           100,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities:         map[uint32]bool{},
+								LargeCommunities:    map[LargeCommunity]bool{},
+							},
+						},
+					},
+				},
+				Warnings: []string{
+					`unknown key "future-feature" in advertisement #1 of pool "pool1"`,
+				},
+			},
+		},
+
+		{
+			desc: "simple advertisement",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  -
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities:         map[uint32]bool{},
+								LargeCommunities:    map[LargeCommunity]bool{},
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "pool-level communities",
+			raw: `
+communities:
+  bar: 64512:1234
+address-pools:
+- name: pool1
+  communities: ["bar"]
+  advertisements:
+  - communities: ["1234:2345"]
+  - aggregation-length: 24
+    communities: ["bar"]
+  -
+`,
+			want: &Config{
+				BGPListenPort:    179,
+				CommunityAliases: map[string]uint32{"bar": 64512<<16 | 1234},
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities: map[uint32]bool{
+									0xfc0004d2: true,
+									0x04D20929: true,
+								},
+								LargeCommunities: map[LargeCommunity]bool{},
+							},
+							{
+								AggregationLength:   24,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities: map[uint32]bool{
+									0xfc0004d2: true,
+								},
+								LargeCommunities: map[LargeCommunity]bool{},
+							},
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities: map[uint32]bool{
+									0xfc0004d2: true,
+								},
+								LargeCommunities: map[LargeCommunity]bool{},
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "pool tag community",
+			raw: `
+address-pools:
+- name: pool1
+  tag-community-asn: 64512
+  advertisements:
+  - communities: ["1234:2345"]
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:        BGP,
+						AutoAssign:      true,
+						TagCommunityASN: 64512,
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities: map[uint32]bool{
+									0xfc009336: true,
+									0x04D20929: true,
+								},
+								LargeCommunities: map[LargeCommunity]bool{},
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "tag community ASN too large",
+			raw: `
+address-pools:
+- name: pool1
+  tag-community-asn: 65536
+  advertisements:
+  -
+`,
+		},
+
+		{
+			desc: "large communities",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - large-communities: ["64512:1:2", "4200000000:3:4"]
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities:         map[uint32]bool{},
+								LargeCommunities: map[LargeCommunity]bool{
+									{64512, 1, 2}:      true,
+									{4200000000, 3, 4}: true,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "removed communities",
+			raw: `
+communities:
+  bar: 64512:1234
+address-pools:
+- name: pool1
+  communities: ["bar"]
+  advertisements:
+  - remove-communities: ["bar", "no-export"]
+`,
+			want: &Config{
+				BGPListenPort:    179,
+				CommunityAliases: map[string]uint32{"bar": 64512<<16 | 1234},
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities:         map[uint32]bool{},
+								LargeCommunities:    map[LargeCommunity]bool{},
+								RemoveCommunities: map[uint32]bool{
+									0xFC0004D2: true,
+									0xFFFFFF01: true,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "disabled advertisement",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - enabled: false
+    communities: ["64512:1"]
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Communities: map[uint32]bool{
+									0xFC000001: true,
+								},
+								LargeCommunities: map[LargeCommunity]bool{},
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "IPv6 next-hops",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - next-hop: 2001:db8::1
+    next-hop-link-local: fe80::1
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities:         map[uint32]bool{},
+								LargeCommunities:    map[LargeCommunity]bool{},
+								NextHop:             net.ParseIP("2001:db8::1"),
+								NextHopLinkLocal:    net.ParseIP("fe80::1"),
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "global address as link-local next-hop",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - next-hop: 2001:db8::1
+    next-hop-link-local: 2001:db8::2
+`,
+		},
+
+		{
+			desc: "link-local address as global next-hop",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - next-hop: fe80::1
+`,
+		},
+
+		{
+			desc: "link-local next-hop without global next-hop",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - next-hop-link-local: fe80::1
+`,
+		},
+
+		{
+			desc: "disabled advertisement with invalid community",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - enabled: false
+    communities: ["64512"]
+`,
+		},
+
+		{
+			desc: "malformed removed community",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - remove-communities: ["64512"]
+`,
+		},
+
+		{
+			desc: "community both added and removed",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - communities: ["64512:1"]
+    remove-communities: ["64512:1"]
+`,
+		},
+
+		{
+			desc: "large community in communities",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - communities: ["64512:1:2"]
+`,
+		},
+
+		{
+			desc: "standard community in large-communities",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - large-communities: ["64512:1"]
+`,
+		},
+
+		{
+			desc: "community alias in large-communities",
+			raw: `
+communities:
+  bar: 64512:1234
+address-pools:
+- name: pool1
+  advertisements:
+  - large-communities: ["bar"]
+`,
+		},
+
+		{
+			desc: "bad large community (section doesn't fit)",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - large-communities: ["1:2:4294967296"]
+`,
+		},
+
+		{
+			desc: "global defaults merged into pools",
+			raw: `
+avoid-buggy-ips: true
+default-communities: ["no-export"]
+default-aggregation-length: 24
+address-pools:
+- name: pool1
+  cidr: ["10.20.0.0/16"]
+  communities: ["1234:2345"]
+  advertisements:
+  -
+  - aggregation-length: 32
+- name: pool2
+  cidr: ["10.30.0.0/16"]
+  avoid-buggy-ips: false
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:      BGP,
+						AutoAssign:    true,
+						CIDR:          []*net.IPNet{ipnet("10.20.0.0/16")},
+						AvoidBuggyIPs: true,
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   24,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities: map[uint32]bool{
+									0xFFFFFF01: true,
+									0x04D20929: true,
+								},
+								LargeCommunities: map[LargeCommunity]bool{},
+							},
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities: map[uint32]bool{
+									0xFFFFFF01: true,
+									0x04D20929: true,
+								},
+								LargeCommunities: map[LargeCommunity]bool{},
+							},
+						},
+					},
+					"pool2": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.30.0.0/16")},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "explicitly empty communities clear inherited ones",
+			raw: `
+default-communities: ["no-export"]
+address-pools:
+- name: pool1
+  cidr: ["10.20.0.0/16"]
+  communities: ["1234:2345"]
+  advertisements:
+  - communities: []
+  - aggregation-length: 32
+  - communities: ["1:2"]
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.20.0.0/16")},
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities:         map[uint32]bool{},
+								LargeCommunities:    map[LargeCommunity]bool{},
+							},
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities: map[uint32]bool{
+									0xFFFFFF01: true,
+									0x04D20929: true,
+								},
+								LargeCommunities: map[LargeCommunity]bool{},
+							},
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities: map[uint32]bool{
+									0xFFFFFF01: true,
+									0x04D20929: true,
+									0x00010002: true,
+								},
+								LargeCommunities: map[LargeCommunity]bool{},
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "bad default community",
+			raw: `
+default-communities: ["flarb"]
+`,
+		},
+
+		{
+			desc: "bad pool-level community",
+			raw: `
+address-pools:
+- name: pool1
+  communities: ["flarb"]
+  advertisements:
+  -
+`,
+		},
+
+		{
+			desc: "blackhole advertisement",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - blackhole: true
+    communities: ["1234:2345"]
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities: map[uint32]bool{
+									0x04D20929:         true,
+									BlackholeCommunity: true,
+								},
+								LargeCommunities: map[LargeCommunity]bool{},
+								Blackhole:        true,
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "advertisement selecting CIDRs",
+			raw: `
+default-aggregation-length: 24
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  - 2001:db8::/64
+  advertisements:
+  - cidr: ["2001:db8::/64"]
+    aggregation-length-v6: 64
+  - cidr: ["10.20.0.0/26"]
+    aggregation-length: 26
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.20.0.0/24"), ipnet("2001:db8::/64")},
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 64,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities:         map[uint32]bool{},
+								LargeCommunities:    map[LargeCommunity]bool{},
+								CIDR:                []*net.IPNet{ipnet("2001:db8::/64")},
+							},
+							{
+								AggregationLength:   26,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities:         map[uint32]bool{},
+								LargeCommunities:    map[LargeCommunity]bool{},
+								CIDR:                []*net.IPNet{ipnet("10.20.0.0/26")},
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "advertisement selecting IPv6 CIDR with IPv4 aggregation length",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  - 2001:db8::/64
+  advertisements:
+  - cidr: ["2001:db8::/64"]
+    aggregation-length: 24
+`,
+		},
+
+		{
+			desc: "huge aggregation length",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  advertisements:
+  - aggregation-length: 100000000000
+`,
+		},
+
+		{
+			desc: "advertisement selecting no CIDRs",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  advertisements:
+  - cidr: []
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.20.0.0/24")},
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities:         map[uint32]bool{},
+								LargeCommunities:    map[LargeCommunity]bool{},
+								CIDR:                []*net.IPNet{},
+							},
+						},
+					},
+				},
+				Warnings: []string{
+					`advertisement #1 of pool "pool1" produces no routes`,
+				},
+			},
+		},
+
+		{
+			desc: "advertisement selecting CIDR outside the pool",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  advertisements:
+  - cidr: ["10.30.0.0/24"]
+`,
+		},
+
+		{
+			desc: "local-only advertisements",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - local-only: true
+  - local-only: true
+    communities: ["no-export", "65535:65281"]
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities: map[uint32]bool{
+									0xFFFFFF01: true,
+								},
+								LargeCommunities: map[LargeCommunity]bool{},
+								LocalOnly:        true,
+							},
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities: map[uint32]bool{
+									0xFFFFFF01: true,
+								},
+								LargeCommunities: map[LargeCommunity]bool{},
+								LocalOnly:        true,
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "local-only advertisement on layer2 pool",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  advertisements:
+  - local-only: true
+`,
+		},
+
+		{
+			desc: "local-only advertisement removing no-export",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - local-only: true
+    remove-communities: ["no-export"]
+`,
+		},
+
+		{
+			desc: "blackhole advertisement on layer2 pool",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  advertisements:
+  - blackhole: true
+`,
+		},
+
+		{
+			desc: "advertisement origins",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - origin: igp
+  - origin: egp
+  - origin: incomplete
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Communities:         map[uint32]bool{},
+								LargeCommunities:    map[LargeCommunity]bool{},
+								Origin:              OriginIGP,
+								Enabled:             true,
+							},
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Communities:         map[uint32]bool{},
+								LargeCommunities:    map[LargeCommunity]bool{},
+								Origin:              OriginEGP,
+								Enabled:             true,
+							},
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Communities:         map[uint32]bool{},
+								LargeCommunities:    map[LargeCommunity]bool{},
+								Origin:              OriginIncomplete,
+								Enabled:             true,
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "invalid advertisement origin",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - origin: unknown
+`,
+		},
+
+		{
+			desc: "bad aggregation length (too long)",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - aggregation-length: 33
+`,
+		},
+
+		{
+			desc: "bad aggregation length (incompatible with CIDR)",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.30.40/24
+  - 1.2.3.0/28
+  advertisements:
+  - aggregation-length: 26
+`,
+		},
+
+		{
+			desc: "dual-stack aggregation lengths",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.30.0/24
+  - 2001:db8::/64
+  advertisements:
+  - aggregation-length: 24
+    aggregation-length-v6: 64
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.20.30.0/24"), ipnet("2001:db8::/64")},
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   24,
+								AggregationLengthV6: 64,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities:         map[uint32]bool{},
+								LargeCommunities:    map[LargeCommunity]bool{},
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "advertisement types",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.30.0/24
+  advertisements:
+  - advertisement-type: host
+  - advertisement-type: aggregate
+    aggregation-length: 24
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.20.30.0/24")},
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities:         map[uint32]bool{},
+								LargeCommunities:    map[LargeCommunity]bool{},
+								Type:                AdvertiseHost,
+							},
+							{
+								AggregationLength:   24,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities:         map[uint32]bool{},
+								LargeCommunities:    map[LargeCommunity]bool{},
+								Type:                AdvertiseAggregate,
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "summary route plus host routes",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.30.0/24
+  advertisements:
+  - aggregate: true
+    aggregation-length: 24
+  - aggregate: false
+`,
+			want: &Config{
+				BGPListenPort: 179,
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.20.30.0/24")},
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   24,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities:         map[uint32]bool{},
+								LargeCommunities:    map[LargeCommunity]bool{},
+								Type:                AdvertiseAggregate,
+							},
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities:         map[uint32]bool{},
+								LargeCommunities:    map[LargeCommunity]bool{},
+								Type:                AdvertiseHost,
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "two aggregate advertisements",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.30.0/24
+  advertisements:
+  - aggregate: true
+    aggregation-length: 24
+  - advertisement-type: aggregate
+    aggregation-length: 28
+`,
+		},
+
+		{
+			desc: "aggregate conflicts with advertisement-type",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.30.0/24
+  advertisements:
+  - aggregate: true
+    advertisement-type: host
+`,
+		},
+
+		{
+			desc: "host advertisement with aggregation",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.30.0/24
+  advertisements:
+  - advertisement-type: host
+    aggregation-length: 24
+`,
+		},
+
+		{
+			desc: "aggregate advertisement without aggregation",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.30.0/24
+  advertisements:
+  - advertisement-type: aggregate
+`,
+		},
+
+		{
+			desc: "unknown advertisement type",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - advertisement-type: sideways
+`,
+		},
+
+		{
+			desc: "bad v4 aggregation length in dual-stack pool",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.30.0/24
+  - 2001:db8::/64
+  advertisements:
+  - aggregation-length: 20
+    aggregation-length-v6: 64
+`,
+		},
+
+		{
+			desc: "bad v6 aggregation length in dual-stack pool",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.30.0/24
+  - 2001:db8::/64
+  advertisements:
+  - aggregation-length: 24
+    aggregation-length-v6: 48
+`,
+		},
+
+		{
+			desc: "bad v6 aggregation length (too long)",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 2001:db8::/64
+  advertisements:
+  - aggregation-length-v6: 129
+`,
+		},
+
+		{
+			desc: "bad community literal (wrong format)",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - communities: ["1234"]
+`,
+		},
+
+		{
+			desc: "bad community literal (asn part doesn't fit)",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - communities: ["99999999:1"]
+`,
+		},
+
+		{
+			desc: "bad community literal (community# part doesn't fit)",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - communities: ["1:99999999"]
+`,
+		},
+
+		{
+			desc: "bad community ref (unknown ref)",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - communities: ["flarb"]
+`,
+		},
+
+		{
+			desc: "bad community ref (ref asn doesn't fit)",
+			raw: `
+communities:
+  flarb: 99999999:1
+address-pools:
+- name: pool1
+  advertisements:
+  - communities: ["flarb"]
+`,
+		},
+
+		{
+			desc: "bad community ref (ref community# doesn't fit)",
+			raw: `
+communities:
+  flarb: 1:99999999
+address-pools:
+- name: pool1
+  advertisements:
+  - communities: ["flarb"]
+`,
+		},
+
+		{
+			desc: "chained community aliases",
+			raw: `
+communities:
+  region-x: 64512:1234
+  site-a: region-x
+  rack-1: site-a
+address-pools:
+- name: pool1
+  advertisements:
+  - communities: ["rack-1"]
+`,
+			want: &Config{
+				BGPListenPort:    179,
+				CommunityAliases: map[string]uint32{"region-x": 64512<<16 | 1234, "site-a": 64512<<16 | 1234, "rack-1": 64512<<16 | 1234},
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities: map[uint32]bool{
+									0xfc0004d2: true,
+								},
+								LargeCommunities: map[LargeCommunity]bool{},
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "well-known community names",
+			raw: `
+communities:
+  no-peer: 1234:1
+  quiet: no-advertise
+address-pools:
+- name: pool1
+  advertisements:
+  - communities: ["no-export", "quiet", "no-peer"]
+`,
+			want: &Config{
+				BGPListenPort:    179,
+				CommunityAliases: map[string]uint32{"no-peer": 1234<<16 | 1, "quiet": 0xFFFFFF02},
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol:   BGP,
+						AutoAssign: true,
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Origin:              OriginIGP,
+								Enabled:             true,
+								Communities: map[uint32]bool{
+									0xFFFFFF01: true,
+									0xFFFFFF02: true,
+									0x04D20001: true,
+								},
+								LargeCommunities: map[LargeCommunity]bool{},
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "cyclic community aliases",
+			raw: `
+communities:
+  site-a: site-b
+  site-b: site-c
+  site-c: site-a
+`,
+		},
+
+		{
+			desc: "self-referential community alias",
+			raw: `
+communities:
+  site-a: site-a
+`,
+		},
+
+		{
+			desc: "duplicate pool definition",
+			raw: `
+address-pools:
+- name: pool1
+- name: pool1
+- name: pool2
+`,
+		},
+
+		{
+			desc: "duplicate CIDRs",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.0.0.0/8
+- name: pool2
+  cidr:
+  - 10.0.0.0/8
+`,
+		},
+
+		{
+			desc: "overlapping CIDRs",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.0.0.0/8
+- name: pool2
+  cidr:
+  - 10.0.0.0/16
+`,
+		},
+
+		{
+			desc: "duplicate CIDRs with host bits set",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.30.40/24
+- name: pool2
+  cidr:
+  - 10.20.30.0/24
+`,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := Parse([]byte(test.raw))
+		if err != nil && test.want != nil {
+			t.Errorf("%q: parse failed: %s", test.desc, err)
+			continue
+		}
+		if test.want == nil && err == nil {
+			t.Errorf("%q: parse unexpectedly succeeded", test.desc)
+			continue
+		}
+		if diff := cmp.Diff(test.want, got, selectorComparer); diff != "" {
+			t.Errorf("%q: parse returned wrong result (-want, +got)\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestParseWithOptions(t *testing.T) {
+	tests := []struct {
+		desc    string
+		raw     string
+		opts    ParseOptions
+		wantErr bool
+	}{
+		{
+			desc: "documentation ASN allowed by default",
+			raw: `
+peers:
+- my-asn: 64496
+  peer-asn: 42
+  peer-address: 1.2.3.4
+`,
+		},
+
+		{
+			desc: "documentation local ASN rejected",
+			raw: `
+peers:
+- my-asn: 64496
+  peer-asn: 42
+  peer-address: 1.2.3.4
+`,
+			opts:    ParseOptions{RejectDocumentationASN: true},
+			wantErr: true,
+		},
+
+		{
+			desc: "documentation peer ASN rejected",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 65551
+  peer-address: 1.2.3.4
+`,
+			opts:    ParseOptions{RejectDocumentationASN: true},
+			wantErr: true,
+		},
+
+		{
+			desc: "regular ASNs accepted",
+			raw: `
+peers:
+- my-asn: 64512
+  peer-asn: 64495
+  peer-address: 1.2.3.4
+`,
+			opts: ParseOptions{RejectDocumentationASN: true},
+		},
+
+		{
+			desc: "pool with no usable addresses is a warning by default",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.0.0.0/32
+  avoid-buggy-ips: true
+`,
+		},
+
+		{
+			desc: "pool with no usable addresses rejected in strict mode",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.0.0.0/32
+  avoid-buggy-ips: true
+`,
+			opts:    ParseOptions{Strict: true},
+			wantErr: true,
+		},
+
+		{
+			desc: "pool with usable addresses accepted in strict mode",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.0.0.0/31
+  avoid-buggy-ips: true
+`,
+			opts: ParseOptions{Strict: true},
+		},
+
+		{
+			desc: "peer inside address pool rejected in strict mode",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 10.20.0.1
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/16
+`,
+			opts:    ParseOptions{Strict: true},
+			wantErr: true,
+		},
+
+		{
+			desc: "unknown advertisement key rejected in strict mode",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - future-feature: true
+`,
+			opts:    ParseOptions{Strict: true},
+			wantErr: true,
+		},
+
+		{
+			desc: "unknown advertisement key ignored in strict mode if asked",
+			raw: `
+address-pools:
+- name: pool1
+  advertisements:
+  - future-feature: true
+`,
+			opts: ParseOptions{Strict: true, IgnoreUnknownAdvertisementKeys: true},
+		},
+
+		{
+			desc: "shadowing well-known community allowed",
+			raw: `
+communities:
+  no-export: 65535:65281
+`,
+			opts: ParseOptions{AllowWellKnownShadowing: true},
+		},
+
+		{
+			desc: "shadowing well-known community rejected",
+			raw: `
+communities:
+  no-export: 65535:65281
+`,
+			wantErr: true,
+		},
+
+		{
+			desc: "default route with bgp pools is a warning by default",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  originate-default: true
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+`,
+		},
+
+		{
+			desc: "default route with bgp pools rejected in strict mode",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  originate-default: true
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+`,
+			opts:    ParseOptions{Strict: true},
+			wantErr: true,
+		},
+
+		{
+			desc: "auto-assign pools with disjoint service selectors",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  service-selectors:
+  - tier=frontend
+- name: pool2
+  cidr:
+  - 10.30.0.0/24
+  service-selectors:
+  - tier=backend
+`,
+			opts: ParseOptions{Strict: true},
+		},
+
+		{
+			desc: "auto-assign pools with overlapping service selectors rejected in strict mode",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  service-selectors:
+  - tier=frontend
+- name: pool2
+  cidr:
+  - 10.30.0.0/24
+  service-selectors:
+  - team=web
+`,
+			opts:    ParseOptions{Strict: true},
+			wantErr: true,
+		},
+
+		{
+			desc: "selector pool overlapping unrestricted pool rejected in strict mode",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  service-selectors:
+  - tier=frontend
+- name: pool2
+  cidr:
+  - 10.30.0.0/24
+`,
+			opts:    ParseOptions{Strict: true},
+			wantErr: true,
+		},
+
+		{
+			desc: "overlapping service selectors on manually assigned pool",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  service-selectors:
+  - tier=frontend
+- name: pool2
+  cidr:
+  - 10.30.0.0/24
+  auto-assign: false
+`,
+			opts: ParseOptions{Strict: true},
+		},
+
+		{
+			desc: "non-shadowing alias accepted without shadowing allowed",
+			raw: `
+communities:
+  dont-export: no-export
+`,
+		},
+	}
+
+	for _, test := range tests {
+		_, err := ParseWithOptions([]byte(test.raw), test.opts)
+		if test.wantErr && err == nil {
+			t.Errorf("%q: parse unexpectedly succeeded", test.desc)
+		}
+		if !test.wantErr && err != nil {
+			t.Errorf("%q: parse failed: %s", test.desc, err)
+		}
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	raw := []byte(`
+peers:
+- my-asn: ${SITE_ASN}
+  peer-asn: 42
+  peer-address: ${PEER}
+`)
+	opts := ParseOptions{
+		ExpandEnv: true,
+		Env: map[string]string{
+			"SITE_ASN": "64512",
+			"PEER":     "1.2.3.4",
+		},
+	}
+	cfg, err := ParseWithOptions(raw, opts)
+	if err != nil {
+		t.Fatalf("parse failed: %s", err)
+	}
+	if len(cfg.Peers) != 1 || cfg.Peers[0].MyASN != 64512 || !cfg.Peers[0].Addr.Equal(net.ParseIP("1.2.3.4")) {
+		t.Errorf("variables not substituted, got peers %v", cfg.Peers)
+	}
+
+	delete(opts.Env, "PEER")
+	if _, err := ParseWithOptions(raw, opts); err == nil || !strings.Contains(err.Error(), "PEER") {
+		t.Errorf("parse with undefined variable didn't fail with an error naming it, got %v", err)
+	}
+
+	// Without ExpandEnv, placeholders are left alone.
+	if _, err := ParseWithOptions(raw, ParseOptions{}); err == nil {
+		t.Errorf("parse without ExpandEnv unexpectedly succeeded")
+	}
+}
+
+func TestReady(t *testing.T) {
+	if ready, reason := (&Config{}).Ready(); ready || reason == "" {
+		t.Errorf("empty config: got Ready() = (%v, %q), want not ready with a reason", ready, reason)
+	}
+
+	cfg, err := Parse([]byte(`
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/16
+`))
+	if err != nil {
+		t.Fatalf("parse failed: %s", err)
+	}
+	if ready, reason := cfg.Ready(); !ready {
+		t.Errorf("minimal config not ready: %s", reason)
+	}
+}
+
+func TestValidateAgainstNodes(t *testing.T) {
+	cfg := &Config{
+		Pools: map[string]*Pool{
+			"pool1": &Pool{
+				Protocol:      Layer2,
+				NodeSelectors: []labels.Selector{selector("role=edge"), selector("rack in (r3)")},
+			},
+			"pool2": &Pool{
+				Protocol:      Layer2,
+				NodeSelectors: []labels.Selector{selector("!drained")},
+			},
+		},
+	}
+	nodes := []map[string]string{
+		{"role": "edge", "rack": "r1"},
+		{"role": "worker", "rack": "r2", "drained": "true"},
+	}
+
+	want := []string{`node selector "rack in (r3)" of pool "pool1" matches no nodes`}
+	if diff := cmp.Diff(want, cfg.ValidateAgainstNodes(nodes)); diff != "" {
+		t.Errorf("wrong warnings (-want +got)\n%s", diff)
+	}
+
+	want = []string{
+		`node selector "role=edge" of pool "pool1" matches no nodes`,
+		`node selector "rack in (r3)" of pool "pool1" matches no nodes`,
+		`node selector "!drained" of pool "pool2" matches no nodes`,
+	}
+	if diff := cmp.Diff(want, cfg.ValidateAgainstNodes(nil)); diff != "" {
+		t.Errorf("wrong warnings without nodes (-want +got)\n%s", diff)
+	}
+
+	cfg = &Config{
+		SpeakerNodeSelector: selector("bgp=true"),
+		Peers:               []*Peer{{MyASN: 42, ASN: 42, Addr: net.ParseIP("1.2.3.4"), Enabled: true}},
+		Pools: map[string]*Pool{
+			"pool1": &Pool{Protocol: BGP},
+			"pool2": &Pool{Protocol: Layer2},
+		},
+	}
+	if diff := cmp.Diff([]string(nil), cfg.ValidateAgainstNodes([]map[string]string{{"bgp": "true"}})); diff != "" {
+		t.Errorf("wrong warnings with a selected speaker node (-want +got)\n%s", diff)
+	}
+	cfg.Peers[0].Enabled = false
+	if diff := cmp.Diff([]string(nil), cfg.ValidateAgainstNodes(nodes)); diff != "" {
+		t.Errorf("wrong warnings with only a disabled peer (-want +got)\n%s", diff)
+	}
+	cfg.Peers[0].Enabled = true
+	want = []string{`speaker node selector "bgp=true" matches no nodes, so bgp pool "pool1" can't be announced`}
+	if diff := cmp.Diff(want, cfg.ValidateAgainstNodes(nodes)); diff != "" {
+		t.Errorf("wrong warnings without speaker nodes (-want +got)\n%s", diff)
+	}
+}
+
+func TestMaxPeers(t *testing.T) {
+	const limit = 5
+	peers := func(n int) []byte {
+		raw := "peers:\n"
+		for i := 0; i < n; i++ {
+			raw += fmt.Sprintf("- my-asn: 42\n  peer-asn: 42\n  peer-address: 10.0.0.%d\n", i+1)
+		}
+		return []byte(raw)
+	}
+
+	if _, err := ParseWithOptions(peers(limit), ParseOptions{MaxPeers: limit}); err != nil {
+		t.Errorf("parse with %d peers failed: %s", limit, err)
+	}
+	if _, err := ParseWithOptions(peers(limit+1), ParseOptions{MaxPeers: limit}); err == nil {
+		t.Errorf("parse with %d peers unexpectedly succeeded", limit+1)
+	}
+	if _, err := ParseWithOptions(peers(limit+1), ParseOptions{}); err != nil {
+		t.Errorf("parse with %d peers and no limit failed: %s", limit+1, err)
+	}
+}
+
+func TestWarnCommunityASNMismatch(t *testing.T) {
+	raw := []byte(`
+peers:
+- my-asn: 64512
+  peer-asn: 42
+  peer-address: 1.2.3.4
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  advertisements:
+  - communities: ["64512:1", "65000:2", "no-export"]
+`)
+	want := []string{"community 65000:2 uses ASN 65000, which is not the my-asn of any peer"}
+
+	cfg, err := ParseWithOptions(raw, ParseOptions{WarnCommunityASNMismatch: true})
+	if err != nil {
+		t.Fatalf("parse failed: %s", err)
+	}
+	if diff := cmp.Diff(want, cfg.Warnings); diff != "" {
+		t.Errorf("wrong warnings (-want +got)\n%s", diff)
+	}
+
+	cfg, err = ParseWithOptions(raw, ParseOptions{})
+	if err != nil {
+		t.Fatalf("parse failed: %s", err)
+	}
+	if len(cfg.Warnings) != 0 {
+		t.Errorf("got warnings %q with the check disabled", cfg.Warnings)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		desc    string
+		cfg     *Config
+		wantErr bool
+	}{
+		{
+			desc: "empty config",
+			cfg:  &Config{},
+		},
+
+		{
+			desc: "valid config",
+			cfg: &Config{
+				Peers: []*Peer{
+					{
+						MyASN:        42,
+						ASN:          142,
+						Addr:         net.ParseIP("1.2.3.4"),
+						HoldTime:     90 * time.Second,
+						RouteRefresh: true,
+						Enabled:      true,
+					},
+				},
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol: BGP,
+						CIDR:     []*net.IPNet{ipnet("10.20.0.0/16")},
+						Advertisements: []*Advertisement{
+							{
+								AggregationLength: 24,
+							},
+						},
+					},
+					"pool2": &Pool{
+						Protocol: BGP,
+						CIDR:     []*net.IPNet{ipnet("10.30.0.0/16")},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "duplicate CIDRs with host bits set",
+			cfg: &Config{
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol: BGP,
+						CIDR:     []*net.IPNet{{IP: net.ParseIP("10.20.30.40").To4(), Mask: net.CIDRMask(24, 32)}},
+					},
+					"pool2": &Pool{
+						Protocol: BGP,
+						CIDR:     []*net.IPNet{ipnet("10.20.30.0/24")},
+					},
+				},
+			},
+			wantErr: true,
+		},
+
+		{
+			desc: "overlapping CIDRs between pools",
+			cfg: &Config{
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol: BGP,
+						CIDR:     []*net.IPNet{ipnet("10.0.0.0/8")},
+					},
+					"pool2": &Pool{
+						Protocol: BGP,
+						CIDR:     []*net.IPNet{ipnet("10.20.0.0/16")},
+					},
+				},
+			},
+			wantErr: true,
+		},
+
+		{
+			desc: "overlapping CIDRs within a pool",
+			cfg: &Config{
+				Pools: map[string]*Pool{
+					"pool1": &Pool{
+						Protocol: BGP,
+						CIDR:     []*net.IPNet{ipnet("10.20.0.0/16"), ipnet("10.20.30.0/24")},
+					},
+				},
+			},
+			wantErr: true,
+		},
+
+		{
+			desc: "peer without address",
+			cfg: &Config{
+				Peers: []*Peer{
+					{
+						MyASN:   42,
+						ASN:     142,
+						Enabled: true,
+					},
+				},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		test.cfg.ApplyDefaults()
+		_, err := test.cfg.Validate()
+		if test.wantErr && err == nil {
+			t.Errorf("%q: validate unexpectedly succeeded", test.desc)
+		}
+		if !test.wantErr && err != nil {
+			t.Errorf("%q: validate failed: %s", test.desc, err)
+		}
+	}
+}
+
+func TestApplyDefaults(t *testing.T) {
+	cfg := &Config{
+		Peers: []*Peer{
+			{
+				MyASN:    42,
+				ASN:      142,
+				Addr:     net.ParseIP("1.2.3.4"),
+				HoldTime: 90 * time.Second,
+				Enabled:  true,
+			},
+		},
+		Pools: map[string]*Pool{
+			"pool1": &Pool{
+				Protocol:       BGP,
+				CIDR:           []*net.IPNet{ipnet("10.20.0.0/24")},
+				Advertisements: []*Advertisement{{AggregationLength: 32}},
+			},
+		},
+	}
+	if _, err := cfg.Validate(); err == nil {
+		t.Errorf("validate accepted a config with zero connect retry time")
+	}
+	if p := cfg.Peers[0]; p.Port != 0 || p.ConnectRetryTime != 0 {
+		t.Errorf("validate modified the config")
+	}
+
+	cfg.ApplyDefaults()
+	p := cfg.Peers[0]
+	if p.Port != 179 || p.KeepaliveTime != 30*time.Second || p.ConnectRetryTime != 2*time.Second || cfg.BGPListenPort != 179 {
+		t.Errorf("wrong peer defaults: port %d, keepalive %s, connect retry %s, listen port %d", p.Port, p.KeepaliveTime, p.ConnectRetryTime, cfg.BGPListenPort)
+	}
+	if got := cfg.Pools["pool1"].Advertisements[0].Origin; got != OriginIGP {
+		t.Errorf("wrong default origin %q", got)
+	}
+
+	// The peer's address is inside the pool's range now.
+	cfg.Peers[0].Addr = net.ParseIP("10.20.0.5")
+	warnings, err := cfg.Validate()
+	if err != nil {
+		t.Fatalf("validate failed: %s", err)
+	}
+	want := []string{`peer address "10.20.0.5" is inside address pool "pool1", and could be allocated to a service`}
+	if diff := cmp.Diff(want, warnings); diff != "" {
+		t.Errorf("wrong warnings (-want +got)\n%s", diff)
+	}
+}
+
+func TestPickWeightedPool(t *testing.T) {
+	cfg := &Config{
+		Pools: map[string]*Pool{
+			"pool1": &Pool{Weight: 1},
+			"pool2": &Pool{Weight: 3},
+			"pool3": &Pool{},
+		},
+	}
+
+	tests := []struct {
+		desc     string
+		eligible []string
+		want     map[string]float64
+	}{
+		{
+			desc:     "weighted",
+			eligible: []string{"pool1", "pool2", "pool3"},
+			want:     map[string]float64{"pool1": 0.25, "pool2": 0.75},
+		},
+		{
+			desc:     "only one eligible",
+			eligible: []string{"pool1"},
+			want:     map[string]float64{"pool1": 1},
+		},
+		{
+			desc:     "no positive weights",
+			eligible: []string{"pool3"},
+			want:     map[string]float64{"pool3": 1},
+		},
+		{
+			desc:     "unknown pools ignored",
+			eligible: []string{"pool2", "nope"},
+			want:     map[string]float64{"pool2": 1},
+		},
+		{
+			desc: "nothing eligible",
+			want: map[string]float64{"": 1},
+		},
+	}
+
+	const n = 10000
+	for _, test := range tests {
+		got := map[string]int{}
+		for i := 0; i < n; i++ {
+			got[cfg.PickWeightedPool(test.eligible)]++
+		}
+		for name := range got {
+			if _, ok := test.want[name]; !ok {
+				t.Errorf("%q: picked unexpected pool %q", test.desc, name)
+			}
+		}
+		for name, frac := range test.want {
+			if f := float64(got[name]) / n; f < frac-0.05 || f > frac+0.05 {
+				t.Errorf("%q: picked %q %.2f of the time, want %.2f", test.desc, name, f, frac)
+			}
+		}
+	}
+}
+
+func TestAllocateFrom(t *testing.T) {
+	cfg := &Config{
+		Pools: map[string]*Pool{
+			"v4": &Pool{
+				CIDR:       []*net.IPNet{ipnet("10.0.0.0/24")},
+				AutoAssign: true,
+			},
+			"v4-manual": &Pool{
+				CIDR: []*net.IPNet{ipnet("10.0.1.0/24")},
+			},
+			"v6": &Pool{
+				CIDR:       []*net.IPNet{ipnet("2001:db8::/64")},
+				AutoAssign: true,
+			},
+			"dual": &Pool{
+				CIDR:       []*net.IPNet{ipnet("10.0.2.0/24"), ipnet("2001:db8:1::/64")},
+				AutoAssign: true,
+			},
+			"frontend": &Pool{
+				CIDR:             []*net.IPNet{ipnet("10.0.3.0/24")},
+				AutoAssign:       true,
+				ServiceSelectors: []labels.Selector{selector("tier=frontend")},
+			},
+			"premium": &Pool{
+				CIDR:         []*net.IPNet{ipnet("10.0.4.0/24")},
+				AutoAssign:   true,
+				ServiceClass: "premium",
+			},
+		},
+	}
+
+	tests := []struct {
+		desc      string
+		preferred []string
+		family    IPFamily
+		class     string
+		labels    map[string]string
+		want      string
+	}{
+		{
+			desc:      "first preference",
+			preferred: []string{"v4", "dual"},
+			family:    IPv4,
+			want:      "v4",
+		},
+		{
+			desc:      "preference order respected",
+			preferred: []string{"dual", "v4"},
+			family:    IPv4,
+			want:      "dual",
+		},
+		{
+			desc:      "non-auto-assign pool skipped",
+			preferred: []string{"v4-manual", "v4"},
+			family:    IPv4,
+			want:      "v4",
+		},
+		{
+			desc:      "family mismatch skipped",
+			preferred: []string{"v4", "v6"},
+			family:    IPv6,
+			want:      "v6",
+		},
+		{
+			desc:      "unknown pool skipped",
+			preferred: []string{"nope", "v6"},
+			family:    IPv6,
+			want:      "v6",
+		},
+		{
+			desc:   "no preference uses name order",
+			family: IPv6,
+			want:   "dual",
+		},
+		{
+			desc:      "service selector matches",
+			preferred: []string{"frontend", "v4"},
+			family:    IPv4,
+			labels:    map[string]string{"tier": "frontend"},
+			want:      "frontend",
+		},
+		{
+			desc:      "service selector doesn't match",
+			preferred: []string{"frontend", "v4"},
+			family:    IPv4,
+			labels:    map[string]string{"tier": "backend"},
+			want:      "v4",
+		},
+		{
+			desc:      "other service class skipped",
+			preferred: []string{"premium", "v4"},
+			family:    IPv4,
+			want:      "v4",
+		},
+		{
+			desc:      "service class matches",
+			preferred: []string{"v4", "premium"},
+			family:    IPv4,
+			class:     "premium",
+			want:      "premium",
+		},
+		{
+			desc:      "nothing eligible",
+			preferred: []string{"v4-manual", "v6"},
+			family:    IPv4,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := cfg.AllocateFrom(test.preferred, test.family, test.class, test.labels)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%q: AllocateFrom unexpectedly returned %q", test.desc, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: AllocateFrom failed: %s", test.desc, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q: got pool %q, want %q", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestEligiblePools(t *testing.T) {
+	cfg := &Config{
+		Pools: map[string]*Pool{
+			"a": &Pool{CIDR: []*net.IPNet{ipnet("10.0.0.0/24")}, AutoAssign: true},
+			"b": &Pool{CIDR: []*net.IPNet{ipnet("10.0.1.0/24")}, AutoAssign: true, ServiceClass: "premium"},
+			"c": &Pool{CIDR: []*net.IPNet{ipnet("10.0.2.0/24")}, AutoAssign: true},
+		},
+	}
+	want := []string{"c", "a"}
+	if diff := cmp.Diff(want, cfg.EligiblePools([]string{"c", "b", "nope", "a"}, IPv4, "", nil)); diff != "" {
+		t.Errorf("wrong pools (-want +got)\n%s", diff)
+	}
+}
+
+func TestServesClass(t *testing.T) {
+	tests := []struct {
+		poolClass string
+		svcClass  string
+		want      bool
+	}{
+		{"", "", true},
+		{"premium", "premium", true},
+		{"premium", "", false},
+		{"", "premium", false},
+		{"premium", "basic", false},
+	}
+
+	for _, test := range tests {
+		p := &Pool{ServiceClass: test.poolClass}
+		if got := p.ServesClass(test.svcClass); got != test.want {
+			t.Errorf("pool class %q serving service class %q: got %v, want %v", test.poolClass, test.svcClass, got, test.want)
+		}
+	}
+}
+
+func TestSpeakerSelectsNode(t *testing.T) {
+	c := &Config{}
+	if !c.SpeakerSelectsNode(nil) {
+		t.Errorf("config without speaker node selector doesn't select node")
+	}
+	c.SpeakerNodeSelector = selector("bgp=true")
+	if !c.SpeakerSelectsNode(map[string]string{"bgp": "true"}) {
+		t.Errorf("node with bgp=true not selected")
+	}
+	if c.SpeakerSelectsNode(map[string]string{"bgp": "false"}) {
+		t.Errorf("node with bgp=false selected")
+	}
+}
+
+func TestSelectorsOverlap(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"", "", true},
+		{"tier=frontend", "", true},
+		{"tier=frontend", "tier=frontend", true},
+		{"tier=frontend", "tier=backend", false},
+		{"tier=frontend", "team=web", true},
+		{"tier in (a, b)", "tier in (b, c)", true},
+		{"tier in (a, b)", "tier in (c, d)", false},
+		{"tier in (a, b)", "tier notin (a, b)", false},
+		{"tier in (a, b)", "tier notin (a)", true},
+		{"tier", "!tier", false},
+		{"!tier", "tier!=frontend", true},
+		{"tier!=frontend", "tier!=backend", true},
+		{"tier=frontend,team=web", "team=db", false},
+		{"size>5", "size<7", true},
+		{"size>5", "size<6", false},
+	}
+
+	for _, test := range tests {
+		if got := selectorsOverlap(selector(test.a), selector(test.b)); got != test.want {
+			t.Errorf("selectorsOverlap(%q, %q): got %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestNodePriority(t *testing.T) {
+	p := &Pool{
+		NodePriorities: []NodePriority{
+			{Selector: selector("rack=r1"), Priority: 10},
+			{Selector: selector("role=edge"), Priority: 20},
+		},
+	}
+	tests := []struct {
+		labels map[string]string
+		want   int
+	}{
+		{nil, 0},
+		{map[string]string{"rack": "r2"}, 0},
+		{map[string]string{"rack": "r1"}, 10},
+		{map[string]string{"rack": "r1", "role": "edge"}, 20},
+	}
+
+	for _, test := range tests {
+		if got := p.NodePriority(test.labels); got != test.want {
+			t.Errorf("priority of node %v: got %d, want %d", test.labels, got, test.want)
+		}
+	}
+}
+
+func TestTagCommunity(t *testing.T) {
+	// The tag is part of what routers see, so it must never change
+	// for a given pool name.
+	tests := []struct {
+		asn  uint16
+		name string
+		want uint32
+	}{
+		{64512, "pool1", 64512<<16 | 37686},
+		{64512, "pool2", 64512<<16 | 37283},
+		{100, "pool1", 100<<16 | 37686},
+	}
+
+	for _, test := range tests {
+		if got := TagCommunity(test.asn, test.name); got != test.want {
+			t.Errorf("TagCommunity(%d, %q): got %d:%d, want %d:%d", test.asn, test.name, got>>16, got&0xffff, test.want>>16, test.want&0xffff)
+		}
+	}
+}
+
+func TestSortedCommunities(t *testing.T) {
+	// The first advertisement of pool1 in the "config using all
+	// features" test.
+	ad := &Advertisement{
+		Communities: map[uint32]bool{
+			0xfc0004d2: true,
+			0x04D20929: true,
+		},
+	}
+	want := []uint32{0x04D20929, 0xfc0004d2}
+	if diff := cmp.Diff(want, ad.SortedCommunities()); diff != "" {
+		t.Errorf("wrong communities (-want +got)\n%s", diff)
+	}
+}
+
+func TestSendsTo(t *testing.T) {
+	ibgp := &Peer{MyASN: 64512, ASN: 64512}
+	ibgpTor := &Peer{MyASN: 64512, ASN: 64512, PeerGroup: "tor"}
+	ebgp := &Peer{MyASN: 64512, ASN: 64513}
+	ebgpTor := &Peer{MyASN: 64512, ASN: 64513, PeerGroup: "tor"}
+
+	tests := []struct {
+		desc string
+		ad   *Advertisement
+		want []*Peer
+	}{
+		{
+			desc: "all peers",
+			ad:   &Advertisement{},
+			want: []*Peer{ibgp, ibgpTor, ebgp, ebgpTor},
+		},
+		{
+			desc: "IBGP only",
+			ad:   &Advertisement{NoAdvertiseEBGP: true},
+			want: []*Peer{ibgp, ibgpTor},
+		},
+		{
+			desc: "peer group",
+			ad:   &Advertisement{PeerGroups: []string{"tor"}},
+			want: []*Peer{ibgpTor, ebgpTor},
+		},
+		{
+			desc: "peer group, IBGP only",
+			ad:   &Advertisement{PeerGroups: []string{"tor"}, NoAdvertiseEBGP: true},
+			want: []*Peer{ibgpTor},
+		},
+	}
+
+	for _, test := range tests {
+		var got []*Peer
+		for _, p := range []*Peer{ibgp, ibgpTor, ebgp, ebgpTor} {
+			if test.ad.SendsTo(p) {
+				got = append(got, p)
+			}
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("%q: wrong peers (-want +got)\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestCoversIP(t *testing.T) {
+	ad := &Advertisement{}
+	if !ad.CoversIP(net.ParseIP("10.20.0.1")) {
+		t.Errorf("advertisement without CIDRs doesn't cover 10.20.0.1")
+	}
+	ad.CIDR = []*net.IPNet{ipnet("10.20.0.0/26")}
+	if !ad.CoversIP(net.ParseIP("10.20.0.1")) {
+		t.Errorf("advertisement for 10.20.0.0/26 doesn't cover 10.20.0.1")
+	}
+	if ad.CoversIP(net.ParseIP("10.20.0.100")) {
+		t.Errorf("advertisement for 10.20.0.0/26 covers 10.20.0.100")
+	}
+}
+
+func TestEffectiveForPeer(t *testing.T) {
+	ad := &Advertisement{
+		AggregationLength: 32,
+		LocalPref:         100,
+	}
+
+	ibgp := ad.EffectiveForPeer(&Peer{MyASN: 64512, ASN: 64512})
+	if ibgp.LocalPref != 100 {
+		t.Errorf("IBGP peer got localpref %d, want 100", ibgp.LocalPref)
+	}
+	ebgp := ad.EffectiveForPeer(&Peer{MyASN: 64512, ASN: 64513})
+	if ebgp.LocalPref != 0 {
+		t.Errorf("EBGP peer got localpref %d, want 0", ebgp.LocalPref)
+	}
+	if ebgp.AggregationLength != 32 {
+		t.Errorf("EBGP peer got aggregation length %d, want 32", ebgp.AggregationLength)
+	}
+	if ad.LocalPref != 100 {
+		t.Errorf("EffectiveForPeer modified the original advertisement")
+	}
+}
+
+func TestPoolContainsCIDR(t *testing.T) {
+	pool := &Pool{
+		CIDR: []*net.IPNet{
+			ipnet("10.0.0.0/24"),
+			ipnet("10.0.2.0/25"),
+			ipnet("10.0.2.128/25"),
+			ipnet("2001:db8::/64"),
+		},
+	}
+
+	tests := []struct {
+		desc string
+		cidr string
+		want bool
+	}{
+		{"fully contained subnet", "10.0.0.64/26", true},
+		{"same as pool CIDR", "10.0.0.0/24", true},
+		{"single address", "10.0.0.1/32", true},
+		{"spans adjacent pool CIDRs", "10.0.2.0/24", true},
+		{"partially overlapping", "10.0.0.0/23", false},
+		{"disjoint", "192.168.0.0/24", false},
+		{"contained v6 subnet", "2001:db8::/96", true},
+		{"partially overlapping v6", "2001:db8::/48", false},
+	}
+
+	for _, test := range tests {
+		if got := pool.ContainsCIDR(ipnet(test.cidr)); got != test.want {
+			t.Errorf("%q: ContainsCIDR(%q) = %v, want %v", test.desc, test.cidr, got, test.want)
+		}
+	}
+}
 
+func TestPoolUtilization(t *testing.T) {
+	tests := []struct {
+		desc      string
+		pool      *Pool
+		allocated int
+		want      float64
+	}{
 		{
-			desc: "duplicate pool definition",
-			raw: `
-address-pools:
-- name: pool1
-- name: pool1
-- name: pool2
-`,
+			desc:      "half-full /24",
+			pool:      &Pool{CIDR: []*net.IPNet{ipnet("10.0.0.0/24")}},
+			allocated: 128,
+			want:      0.5,
+		},
+		{
+			desc: "half-full /24 with buggy IPs and reserved addresses",
+			pool: &Pool{
+				CIDR:          []*net.IPNet{ipnet("10.0.0.0/24")},
+				AvoidBuggyIPs: true,
+				Reserved:      []*net.IPNet{ipnet("10.0.0.1/32"), ipnet("10.0.0.2/32")},
+			},
+			allocated: 126,
+			want:      0.5,
+		},
+		{
+			desc:      "full /30",
+			pool:      &Pool{CIDR: []*net.IPNet{ipnet("10.0.0.0/30")}},
+			allocated: 4,
+			want:      1,
+		},
+		{
+			desc:      "empty /30",
+			pool:      &Pool{CIDR: []*net.IPNet{ipnet("10.0.0.0/30")}},
+			allocated: 0,
+			want:      0,
+		},
+		{
+			desc: "no usable addresses",
+			pool: &Pool{},
+			want: 1,
 		},
+	}
+
+	for _, test := range tests {
+		if got := test.pool.Utilization(test.allocated); got != test.want {
+			t.Errorf("%q: got utilization %v, want %v", test.desc, got, test.want)
+		}
+	}
+}
 
+func TestPoolSize(t *testing.T) {
+	// Two addresses ending in .0, and one ending in .255.
+	cidrs := []*net.IPNet{ipnet("10.0.0.0/24"), ipnet("10.0.1.0/31")}
+	tests := []struct {
+		desc               string
+		network, broadcast bool
+		want               int64
+	}{
 		{
-			desc: "duplicate CIDRs",
-			raw: `
+			desc: "avoid both",
+			want: 255,
+		},
+		{
+			desc:    "include network",
+			network: true,
+			want:    257,
+		},
+		{
+			desc:      "include broadcast",
+			broadcast: true,
+			want:      256,
+		},
+		{
+			desc:      "include both",
+			network:   true,
+			broadcast: true,
+			want:      258,
+		},
+	}
+
+	for _, test := range tests {
+		pool := &Pool{
+			CIDR:             cidrs,
+			AvoidBuggyIPs:    true,
+			IncludeNetwork:   test.network,
+			IncludeBroadcast: test.broadcast,
+		}
+		if got := pool.Size().Int64(); got != test.want {
+			t.Errorf("%q: got %d usable addresses, want %d", test.desc, got, test.want)
+		}
+		addrs, err := pool.Addresses()
+		if err != nil {
+			t.Fatalf("%q: Addresses failed: %s", test.desc, err)
+		}
+		if int64(len(addrs)) != test.want {
+			t.Errorf("%q: Addresses returned %d addresses, want %d", test.desc, len(addrs), test.want)
+		}
+	}
+}
+
+func TestSimulateAssignments(t *testing.T) {
+	cfg, err := Parse([]byte(`
+exclude-addresses:
+- 10.0.0.50
 address-pools:
 - name: pool1
   cidr:
-  - 10.0.0.0/8
+  - 10.0.0.0/24
+  avoid-buggy-ips: true
+  reserved-addresses:
+  - 10.0.0.128/25
+  pinned-addresses:
+  - address: 10.0.0.53
+    service: kube-system/dns
 - name: pool2
   cidr:
-  - 10.0.0.0/8
-`,
-		},
+  - 2001:db8::/64
+`))
+	if err != nil {
+		t.Fatalf("parse failed: %s", err)
+	}
 
-		{
-			desc: "overlapping CIDRs",
-			raw: `
+	current := map[string]net.IP{
+		"default/web":     net.ParseIP("10.0.0.10"),
+		"default/web6":    net.ParseIP("2001:db8::10"),
+		"kube-system/dns": net.ParseIP("10.0.0.53"),
+		"default/outside": net.ParseIP("10.1.0.1"),
+		"default/broken":  net.ParseIP("10.0.0.0"),
+		"default/res":     net.ParseIP("10.0.0.200"),
+		"default/excl":    net.ParseIP("10.0.0.50"),
+		"default/thief":   net.ParseIP("10.0.0.53"),
+	}
+	wantValid := map[string]net.IP{
+		"default/web":     net.ParseIP("10.0.0.10"),
+		"default/web6":    net.ParseIP("2001:db8::10"),
+		"kube-system/dns": net.ParseIP("10.0.0.53"),
+	}
+	wantInvalid := map[string]net.IP{
+		"default/outside": net.ParseIP("10.1.0.1"),
+		"default/broken":  net.ParseIP("10.0.0.0"),
+		"default/res":     net.ParseIP("10.0.0.200"),
+		"default/excl":    net.ParseIP("10.0.0.50"),
+		"default/thief":   net.ParseIP("10.0.0.53"),
+	}
+
+	valid, invalid := cfg.SimulateAssignments(current)
+	if diff := cmp.Diff(wantValid, valid); diff != "" {
+		t.Errorf("wrong valid assignments (-want +got)\n%s", diff)
+	}
+	if diff := cmp.Diff(wantInvalid, invalid); diff != "" {
+		t.Errorf("wrong invalid assignments (-want +got)\n%s", diff)
+	}
+}
+
+func TestTotalAddresses(t *testing.T) {
+	cfg, err := Parse([]byte(`
 address-pools:
-- name: pool1
+- name: v4
   cidr:
-  - 10.0.0.0/8
-- name: pool2
+  - 10.0.0.0/24
+  - 10.0.1.0/30
+  avoid-buggy-ips: true
+  reserved-addresses:
+  - 10.0.0.128/26
+- name: v6
   cidr:
-  - 10.0.0.0/16
-`,
+  - 2001:db8::/64
+  - 2001:db8:1::/120
+- name: empty
+`))
+	if err != nil {
+		t.Fatalf("parse failed: %s", err)
+	}
+
+	// v4: 256 + 4 addresses, minus .0 and .255 of the /24, the .0
+	// of the /30, and the 64 reserved ones. v6: 2^64 + 256.
+	want := new(big.Int).Lsh(big.NewInt(1), 64)
+	want.Add(want, big.NewInt(256+256+4-3-64))
+	if got := cfg.TotalAddresses(); got.Cmp(want) != 0 {
+		t.Errorf("TotalAddresses() = %s, want %s", got, want)
+	}
+	if got := (&Config{}).TotalAddresses(); got.Sign() != 0 {
+		t.Errorf("TotalAddresses() of empty config = %s, want 0", got)
+	}
+}
+
+func TestAggregateRoutes(t *testing.T) {
+	ipRange := func(first string, n int) []net.IP {
+		var ret []net.IP
+		ip := net.ParseIP(first).To4()
+		for i := 0; i < n; i++ {
+			ret = append(ret, ip)
+			ip = nextIP(ip)
+		}
+		return ret
+	}
+
+	tests := []struct {
+		desc         string
+		ips          []net.IP
+		maxPrefixLen int
+		want         []*net.IPNet
+	}{
+		{
+			desc:         "contiguous block",
+			ips:          ipRange("10.0.0.16", 16),
+			maxPrefixLen: 24,
+			want:         []*net.IPNet{ipnet("10.0.0.16/28")},
+		},
+		{
+			desc:         "sparse addresses",
+			ips:          []net.IP{net.ParseIP("10.0.0.9"), net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.5")},
+			maxPrefixLen: 24,
+			want:         []*net.IPNet{ipnet("10.0.0.1/32"), ipnet("10.0.0.5/32"), ipnet("10.0.0.9/32")},
+		},
+		{
+			desc:         "bounded by aggregation length",
+			ips:          ipRange("10.0.0.16", 16),
+			maxPrefixLen: 30,
+			want:         []*net.IPNet{ipnet("10.0.0.16/30"), ipnet("10.0.0.20/30"), ipnet("10.0.0.24/30"), ipnet("10.0.0.28/30")},
+		},
+		{
+			desc:         "unaligned run with duplicates",
+			ips:          append(ipRange("10.0.0.3", 6), net.ParseIP("10.0.0.4")),
+			maxPrefixLen: 24,
+			want:         []*net.IPNet{ipnet("10.0.0.3/32"), ipnet("10.0.0.4/30"), ipnet("10.0.0.8/32")},
+		},
+		{
+			desc:         "IPv6",
+			ips:          []net.IP{net.ParseIP("2001:db8::"), net.ParseIP("2001:db8::1")},
+			maxPrefixLen: 64,
+			want:         []*net.IPNet{ipnet("2001:db8::/127")},
 		},
 	}
 
 	for _, test := range tests {
-		got, err := Parse([]byte(test.raw))
-		if err != nil && test.want != nil {
-			t.Errorf("%q: parse failed: %s", test.desc, err)
+		got := AggregateRoutes(test.ips, test.maxPrefixLen)
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("%q: wrong routes (-want +got)\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestRangeToCIDRs(t *testing.T) {
+	tests := []struct {
+		desc       string
+		start, end string
+		want       []*net.IPNet
+	}{
+		{
+			desc:  "unaligned range",
+			start: "192.168.1.10",
+			end:   "192.168.1.250",
+			want: []*net.IPNet{
+				ipnet("192.168.1.10/31"),
+				ipnet("192.168.1.12/30"),
+				ipnet("192.168.1.16/28"),
+				ipnet("192.168.1.32/27"),
+				ipnet("192.168.1.64/26"),
+				ipnet("192.168.1.128/26"),
+				ipnet("192.168.1.192/27"),
+				ipnet("192.168.1.224/28"),
+				ipnet("192.168.1.240/29"),
+				ipnet("192.168.1.248/31"),
+				ipnet("192.168.1.250/32"),
+			},
+		},
+		{
+			desc:  "aligned range",
+			start: "10.0.0.0",
+			end:   "10.0.255.255",
+			want:  []*net.IPNet{ipnet("10.0.0.0/16")},
+		},
+		{
+			desc:  "single address",
+			start: "10.0.0.1",
+			end:   "10.0.0.1",
+			want:  []*net.IPNet{ipnet("10.0.0.1/32")},
+		},
+		{
+			desc:  "IPv6",
+			start: "2001:db8::1",
+			end:   "2001:db8::3",
+			want:  []*net.IPNet{ipnet("2001:db8::1/128"), ipnet("2001:db8::2/127")},
+		},
+		{
+			desc:  "reversed",
+			start: "10.0.0.2",
+			end:   "10.0.0.1",
+		},
+		{
+			desc:  "mixed families",
+			start: "10.0.0.1",
+			end:   "2001:db8::1",
+		},
+	}
+
+	for _, test := range tests {
+		got := RangeToCIDRs(net.ParseIP(test.start), net.ParseIP(test.end))
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("%q: wrong CIDRs (-want +got)\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestPoolMaxRoutes(t *testing.T) {
+	rangePool := &Pool{CIDR: RangeToCIDRs(net.ParseIP("192.168.1.10"), net.ParseIP("192.168.1.250"))}
+	tests := []struct {
+		desc   string
+		pool   *Pool
+		aggLen int
+		want   int64
+	}{
+		{"host routes for a range", rangePool, 32, 241},
+		{"range covered by one aggregate", rangePool, 24, 1},
+		{"range split across two aggregates", rangePool, 25, 2},
+		{"CIDR split by aggregation length", &Pool{CIDR: []*net.IPNet{ipnet("10.0.0.0/24")}}, 26, 4},
+	}
+
+	for _, test := range tests {
+		ad := &Advertisement{AggregationLength: test.aggLen, AggregationLengthV6: 128}
+		if got := test.pool.MaxRoutes(ad); got.Cmp(big.NewInt(test.want)) != 0 {
+			t.Errorf("%q: got %s routes, want %d", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestPoolHashedIP(t *testing.T) {
+	p := &Pool{CIDR: []*net.IPNet{ipnet("10.0.0.0/24")}}
+
+	// The mapping is part of the user-visible behavior, so pin it.
+	for key, want := range map[string]string{
+		"default/web": "10.0.0.187",
+		"default/db":  "10.0.0.37",
+	} {
+		for i := 0; i < 2; i++ {
+			ip, err := p.HashedIP(key)
+			if err != nil {
+				t.Fatalf("HashedIP(%q): %s", key, err)
+			}
+			if ip.String() != want {
+				t.Errorf("HashedIP(%q) = %q, want %q", key, ip, want)
+			}
+		}
+	}
+
+	// Reserved and buggy addresses are skipped, wrapping around the
+	// end of the pool.
+	p = &Pool{
+		CIDR:          []*net.IPNet{ipnet("10.0.0.0/24")},
+		Reserved:      []*net.IPNet{ipnet("10.0.0.184/29")},
+		AvoidBuggyIPs: true,
+	}
+	if ip, err := p.HashedIP("default/web"); err != nil || ip.String() != "10.0.0.192" {
+		t.Errorf("HashedIP with reserved addresses = %q (err %v), want 10.0.0.192", ip, err)
+	}
+	p.Reserved = []*net.IPNet{ipnet("10.0.0.128/25")}
+	if ip, err := p.HashedIP("default/web"); err != nil || ip.String() != "10.0.0.1" {
+		t.Errorf("HashedIP wrapping around = %q (err %v), want 10.0.0.1", ip, err)
+	}
+
+	p.Reserved = []*net.IPNet{ipnet("10.0.0.0/24")}
+	if ip, err := p.HashedIP("default/web"); err == nil {
+		t.Errorf("HashedIP in fully reserved pool returned %q", ip)
+	}
+}
+
+func TestPoolAddresses(t *testing.T) {
+	tests := []struct {
+		desc string
+		pool *Pool
+		want []net.IP
+	}{
+		{
+			desc: "plain /30",
+			pool: &Pool{
+				CIDR: []*net.IPNet{ipnet("10.0.0.0/30")},
+			},
+			want: []net.IP{
+				net.ParseIP("10.0.0.0").To4(),
+				net.ParseIP("10.0.0.1").To4(),
+				net.ParseIP("10.0.0.2").To4(),
+				net.ParseIP("10.0.0.3").To4(),
+			},
+		},
+		{
+			desc: "/30 with buggy IPs and reserved address",
+			pool: &Pool{
+				CIDR:          []*net.IPNet{ipnet("10.0.0.0/30")},
+				AvoidBuggyIPs: true,
+				Reserved:      []*net.IPNet{ipnet("10.0.0.2/32")},
+			},
+			want: []net.IP{
+				net.ParseIP("10.0.0.1").To4(),
+				net.ParseIP("10.0.0.3").To4(),
+			},
+		},
+		{
+			desc: "multiple CIDRs",
+			pool: &Pool{
+				CIDR:          []*net.IPNet{ipnet("10.0.0.252/30"), ipnet("2001:db8::/127")},
+				AvoidBuggyIPs: true,
+			},
+			want: []net.IP{
+				net.ParseIP("10.0.0.252").To4(),
+				net.ParseIP("10.0.0.253").To4(),
+				net.ParseIP("10.0.0.254").To4(),
+				net.ParseIP("2001:db8::"),
+				net.ParseIP("2001:db8::1"),
+			},
+		},
+		{
+			desc: "too big",
+			pool: &Pool{
+				CIDR: []*net.IPNet{ipnet("10.0.0.0/15")},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		got, err := test.pool.Addresses()
+		if err != nil {
+			if test.want != nil {
+				t.Errorf("%q: Addresses failed: %s", test.desc, err)
+			}
 			continue
 		}
-		if test.want == nil && err == nil {
-			t.Errorf("%q: parse unexpectedly succeeded", test.desc)
+		if test.want == nil {
+			t.Errorf("%q: Addresses unexpectedly succeeded", test.desc)
 			continue
 		}
 		if diff := cmp.Diff(test.want, got); diff != "" {
-			t.Errorf("%q: parse returned wrong result (-want, +got)\n%s", test.desc, diff)
+			t.Errorf("%q: wrong addresses (-want +got)\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestParseErrorLines(t *testing.T) {
+	tests := []struct {
+		desc string
+		raw  string
+		want string
+	}{
+		{
+			desc: "syntax error on first line",
+			raw:  "a: b: c\n",
+			want: "line 1:",
+		},
+		{
+			desc: "tab indentation",
+			raw:  "peers:\n- my-asn: 42\n\tpeer-asn: 42\n",
+			want: "line 3:",
+		},
+		{
+			desc: "unterminated flow sequence",
+			raw:  "peers:\n- my-asn: 42\n  peer-asn: [\n",
+			want: "line 3:",
+		},
+		{
+			desc: "error further down",
+			raw:  "peers:\n- my-asn: 42\n  peer-asn: 42\naddress-pools:\n- name: pool1\n  cidr:\n   - 10.20.0.0/24\n  - 10.30.0.0/24\n",
+			want: "line 8:",
+		},
+		{
+			desc: "type error",
+			raw:  "peers:\n- my-asn: 42\n  peer-asn: foo\n",
+			want: "line 3:",
+		},
+	}
+
+	for _, test := range tests {
+		_, err := Parse([]byte(test.raw))
+		if err == nil {
+			t.Errorf("%q: parse unexpectedly succeeded", test.desc)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: error %q does not mention %q", test.desc, err, test.want)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	mustParse := func(raw string) *Config {
+		cfg, err := Parse([]byte(raw))
+		if err != nil {
+			t.Fatalf("parse %q: %s", raw, err)
+		}
+		return cfg
+	}
+
+	old := mustParse(`
+peers:
+- peer-address: 1.2.3.4
+  peer-asn: 42
+  my-asn: 100
+  hold-time: 90s
+- peer-address: 1.2.3.5
+  peer-asn: 42
+  my-asn: 100
+address-pools:
+- name: pool1
+  protocol: bgp
+  cidr:
+  - 10.20.0.0/16
+- name: pool2
+  protocol: bgp
+  cidr:
+  - 30.0.0.0/8
+`)
+	cfg := mustParse(`
+peers:
+- peer-address: 1.2.3.4
+  peer-asn: 42
+  my-asn: 100
+  hold-time: 180s
+- peer-address: 1.2.3.6
+  peer-asn: 42
+  my-asn: 100
+address-pools:
+- name: pool1
+  protocol: bgp
+  cidr:
+  - 10.20.0.0/16
+- name: pool3
+  protocol: bgp
+  cidr:
+  - 40.0.0.0/8
+`)
+
+	want := ConfigDiff{
+		AddedPeers:   []*Peer{cfg.Peers[1]},
+		RemovedPeers: []*Peer{old.Peers[1]},
+		ChangedPeers: []*Peer{cfg.Peers[0]},
+		AddedPools:   []string{"pool3"},
+		RemovedPools: []string{"pool2"},
+	}
+	if diff := cmp.Diff(want, cfg.Diff(old)); diff != "" {
+		t.Errorf("wrong diff (-want +got)\n%s", diff)
+	}
+
+	if diff := cmp.Diff(ConfigDiff{}, cfg.Diff(cfg)); diff != "" {
+		t.Errorf("diff against self is not empty (-want +got)\n%s", diff)
+	}
+
+	want = ConfigDiff{
+		AddedPeers: cfg.Peers,
+		AddedPools: []string{"pool1", "pool3"},
+	}
+	if diff := cmp.Diff(want, cfg.Diff(nil)); diff != "" {
+		t.Errorf("wrong diff against nil config (-want +got)\n%s", diff)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	mustParse := func(raw string) *Config {
+		cfg, err := Parse([]byte(raw))
+		if err != nil {
+			t.Fatalf("parse %q: %s", raw, err)
 		}
+		return cfg
+	}
+
+	a := mustParse(`
+address-pools:
+- name: pool1
+  cidr:
+  - 2001:db8::/64
+  - 10.30.0.0/24
+  - 10.20.0.0/24
+`)
+	b := mustParse(`
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  - 2001:db8::/64
+  - 10.30.0.0/24
+`)
+	c := mustParse(`
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  - 10.30.0.0/24
+`)
+
+	want := []*net.IPNet{ipnet("10.20.0.0/24"), ipnet("10.30.0.0/24"), ipnet("2001:db8::/64")}
+	if diff := cmp.Diff(want, a.Pools["pool1"].CIDR); diff != "" {
+		t.Errorf("pool CIDRs not sorted (-want +got)\n%s", diff)
+	}
+	if !a.Equal(b) {
+		t.Errorf("configs listing the same CIDRs in different orders are not equal")
+	}
+	if a.Equal(c) {
+		t.Errorf("configs with different CIDRs are equal")
 	}
 }
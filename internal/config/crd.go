@@ -0,0 +1,604 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// CRD objects describe the configuration as several Kubernetes custom
+// resources, instead of a single ConfigMap. They only cover the
+// commonly used settings, see ToCRDs.
+
+// CRDAPIVersion is the API group and version of MetalLB's custom
+// resources.
+const CRDAPIVersion = "metallb.io/v1beta1"
+
+// CRDNamespace is the namespace that MetalLB's custom resources live
+// in.
+const CRDNamespace = "metallb-system"
+
+// IPAddressPool is the custom resource for an address pool.
+type IPAddressPool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec IPAddressPoolSpec `json:"spec"`
+}
+
+// IPAddressPoolSpec is the specification of an IPAddressPool.
+type IPAddressPoolSpec struct {
+	// CIDRs and address ranges, as in the pool's cidr setting.
+	Addresses     []string `json:"addresses"`
+	Protocol      Proto    `json:"protocol"`
+	AutoAssign    *bool    `json:"autoAssign,omitempty"`
+	AvoidBuggyIPs bool     `json:"avoidBuggyIPs,omitempty"`
+	// As in the pool's reserved-addresses setting.
+	ReservedAddresses []string `json:"reservedAddresses,omitempty"`
+	// All the protocols of a pool announced with more than one, as in
+	// Pool.Protocols. Protocol is then the first of them.
+	Protocols []Proto `json:"protocols,omitempty"`
+}
+
+// BGPPeer is the custom resource for a BGP peer.
+type BGPPeer struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec BGPPeerSpec `json:"spec"`
+}
+
+// BGPPeerSpec is the specification of a BGPPeer. Durations that can
+// be zero are pointers, nil means the default. A zero ConnectRetryTime
+// means the default.
+type BGPPeerSpec struct {
+	MyASN uint32 `json:"myASN"`
+	ASN   uint32 `json:"peerASN"`
+	// IP address, with an optional %zone, or hostname.
+	Address string `json:"peerAddress"`
+	Port    uint16 `json:"peerPort,omitempty"`
+	// Zero disables keepalives and the hold timer.
+	HoldTime         *metav1.Duration `json:"holdTime,omitempty"`
+	KeepaliveTime    *metav1.Duration `json:"keepaliveTime,omitempty"`
+	ConnectRetryTime metav1.Duration  `json:"connectRetryTime,omitempty"`
+	// Minimum route advertisement interval. Zero disables it.
+	MRAI      *metav1.Duration `json:"minRouteAdvertisementInterval,omitempty"`
+	Passive   bool             `json:"passive,omitempty"`
+	MinTTL    uint8            `json:"minTTL,omitempty"`
+	PeerGroup string           `json:"peerGroup,omitempty"`
+}
+
+// Community is the custom resource for a set of community aliases.
+type Community struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec CommunitySpec `json:"spec"`
+}
+
+// CommunitySpec is the specification of a Community.
+type CommunitySpec struct {
+	Communities []CommunityAlias `json:"communities"`
+}
+
+// CommunityAlias is a name for a BGP community, as in the communities
+// setting.
+type CommunityAlias struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// BGPAdvertisement is the custom resource for an advertisement of
+// one or more pools.
+type BGPAdvertisement struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec BGPAdvertisementSpec `json:"spec"`
+}
+
+// BGPAdvertisementSpec is the specification of a BGPAdvertisement.
+// Zero aggregation lengths mean the default.
+type BGPAdvertisementSpec struct {
+	// Names of the IPAddressPools to advertise.
+	IPAddressPools      []string `json:"ipAddressPools"`
+	AggregationLength   int      `json:"aggregationLength,omitempty"`
+	AggregationLengthV6 int      `json:"aggregationLengthV6,omitempty"`
+	LocalPref           uint32   `json:"localPref,omitempty"`
+	// Communities in <asn>:<community number> form, or aliases.
+	Communities     []string `json:"communities,omitempty"`
+	PeerGroups      []string `json:"peerGroups,omitempty"`
+	NoAdvertiseEBGP bool     `json:"noAdvertiseEBGP,omitempty"`
+	// The CIDRs of the pools to advertise, as in the advertisement's
+	// cidr setting. Empty means all of them.
+	CIDRs []string `json:"cidrs,omitempty"`
+}
+
+// DeepCopyObject implements runtime.Object.
+func (p *IPAddressPool) DeepCopyObject() runtime.Object {
+	ret := *p
+	p.ObjectMeta.DeepCopyInto(&ret.ObjectMeta)
+	ret.Spec.Addresses = copyStrings(p.Spec.Addresses)
+	ret.Spec.ReservedAddresses = copyStrings(p.Spec.ReservedAddresses)
+	if p.Spec.AutoAssign != nil {
+		autoAssign := *p.Spec.AutoAssign
+		ret.Spec.AutoAssign = &autoAssign
+	}
+	if p.Spec.Protocols != nil {
+		ret.Spec.Protocols = append([]Proto(nil), p.Spec.Protocols...)
+	}
+	return &ret
+}
+
+// DeepCopyObject implements runtime.Object.
+func (p *BGPPeer) DeepCopyObject() runtime.Object {
+	ret := *p
+	p.ObjectMeta.DeepCopyInto(&ret.ObjectMeta)
+	ret.Spec.HoldTime = copyDuration(p.Spec.HoldTime)
+	ret.Spec.KeepaliveTime = copyDuration(p.Spec.KeepaliveTime)
+	ret.Spec.MRAI = copyDuration(p.Spec.MRAI)
+	return &ret
+}
+
+// DeepCopyObject implements runtime.Object.
+func (c *Community) DeepCopyObject() runtime.Object {
+	ret := *c
+	c.ObjectMeta.DeepCopyInto(&ret.ObjectMeta)
+	if c.Spec.Communities != nil {
+		ret.Spec.Communities = append([]CommunityAlias{}, c.Spec.Communities...)
+	}
+	return &ret
+}
+
+// DeepCopyObject implements runtime.Object.
+func (a *BGPAdvertisement) DeepCopyObject() runtime.Object {
+	ret := *a
+	a.ObjectMeta.DeepCopyInto(&ret.ObjectMeta)
+	ret.Spec.IPAddressPools = copyStrings(a.Spec.IPAddressPools)
+	ret.Spec.Communities = copyStrings(a.Spec.Communities)
+	ret.Spec.PeerGroups = copyStrings(a.Spec.PeerGroups)
+	ret.Spec.CIDRs = copyStrings(a.Spec.CIDRs)
+	return &ret
+}
+
+// isDNS1123Subdomain returns true if s is a valid Kubernetes object
+// name.
+func isDNS1123Subdomain(s string) bool {
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for _, l := range strings.Split(s, ".") {
+		if !dns1123LabelRe.MatchString(l) {
+			return false
+		}
+	}
+	return true
+}
+
+func copyStrings(ss []string) []string {
+	if ss == nil {
+		return nil
+	}
+	return append([]string{}, ss...)
+}
+
+func copyDuration(d *metav1.Duration) *metav1.Duration {
+	if d == nil {
+		return nil
+	}
+	ret := *d
+	return &ret
+}
+
+// crdMeta returns the TypeMeta and ObjectMeta of a custom resource of
+// the given kind and name.
+func crdMeta(kind, name string) (metav1.TypeMeta, metav1.ObjectMeta) {
+	return metav1.TypeMeta{APIVersion: CRDAPIVersion, Kind: kind},
+		metav1.ObjectMeta{Namespace: CRDNamespace, Name: name}
+}
+
+// ToCRDs converts c into the equivalent custom resources: a BGPPeer
+// per peer, named after the peer or "peer-<n>", a Community holding
+// the community aliases, then an IPAddressPool per pool followed by a
+// BGPAdvertisement per advertisement of the pool, named
+// "<pool>-<n>". Disabled peers and advertisements, and advertisements
+// that select no CIDRs, announce nothing and are left out.
+//
+// Pool and default communities are already merged into each
+// advertisement, so advertisements list all their communities by
+// value. Settings that only constrain what Parse accepts (e.g.
+// allowed-communities or ip-family) are dropped, the resulting
+// objects already satisfy them. ToCRDs returns an error if c uses any
+// other setting that the custom resources can't express, rather than
+// produce objects that behave differently. Pool names must be valid
+// object names, i.e. DNS-1123 subdomains.
+func (c *Config) ToCRDs() ([]runtime.Object, error) {
+	if err := c.checkCRDCompatible(); err != nil {
+		return nil, err
+	}
+
+	var ret []runtime.Object
+
+	for i, p := range c.Peers {
+		// BGPPeer can't express a disabled peer, and keeping it
+		// would enable it.
+		if !p.Enabled {
+			continue
+		}
+		name := p.Name
+		if name == "" {
+			name = fmt.Sprintf("peer-%d", i+1)
+		}
+		addr := p.AddrHostname
+		if p.Addr != nil {
+			addr = p.Addr.String()
+			if p.Zone != "" {
+				addr += "%" + p.Zone
+			}
+		}
+		peer := &BGPPeer{
+			Spec: BGPPeerSpec{
+				MyASN:            p.MyASN,
+				ASN:              p.ASN,
+				Address:          addr,
+				Port:             p.Port,
+				HoldTime:         &metav1.Duration{Duration: p.HoldTime},
+				KeepaliveTime:    &metav1.Duration{Duration: p.KeepaliveTime},
+				ConnectRetryTime: metav1.Duration{Duration: p.ConnectRetryTime},
+				MRAI:             &metav1.Duration{Duration: p.MRAI},
+				Passive:          p.Passive,
+				MinTTL:           p.MinTTL,
+				PeerGroup:        p.PeerGroup,
+			},
+		}
+		peer.TypeMeta, peer.ObjectMeta = crdMeta("BGPPeer", name)
+		ret = append(ret, peer)
+	}
+
+	if len(c.CommunityAliases) > 0 {
+		comm := &Community{}
+		comm.TypeMeta, comm.ObjectMeta = crdMeta("Community", "communities")
+		var names []string
+		for name := range c.CommunityAliases {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			comm.Spec.Communities = append(comm.Spec.Communities, CommunityAlias{
+				Name:  name,
+				Value: communityString(c.CommunityAliases[name]),
+			})
+		}
+		ret = append(ret, comm)
+	}
+
+	for _, name := range c.PoolNames() {
+		if !isDNS1123Subdomain(name) {
+			return nil, fmt.Errorf("pool name %q is not a valid object name", name)
+		}
+		p := c.Pools[name]
+		autoAssign := p.AutoAssign
+		pool := &IPAddressPool{
+			Spec: IPAddressPoolSpec{
+				Protocol:      p.Protocol,
+				AutoAssign:    &autoAssign,
+				AvoidBuggyIPs: p.AvoidBuggyIPs,
+				Protocols:     p.Protocols,
+			},
+		}
+		pool.TypeMeta, pool.ObjectMeta = crdMeta("IPAddressPool", name)
+		for _, n := range p.CIDR {
+			pool.Spec.Addresses = append(pool.Spec.Addresses, n.String())
+		}
+		for _, n := range p.Reserved {
+			pool.Spec.ReservedAddresses = append(pool.Spec.ReservedAddresses, n.String())
+		}
+		ret = append(ret, pool)
+
+		for i, a := range p.Advertisements {
+			if !a.Enabled || (a.CIDR != nil && len(a.CIDR) == 0) {
+				continue
+			}
+			ad := &BGPAdvertisement{
+				Spec: BGPAdvertisementSpec{
+					IPAddressPools:      []string{name},
+					AggregationLength:   a.AggregationLength,
+					AggregationLengthV6: a.AggregationLengthV6,
+					LocalPref:           a.LocalPref,
+					PeerGroups:          copyStrings(a.PeerGroups),
+					NoAdvertiseEBGP:     a.NoAdvertiseEBGP,
+				},
+			}
+			ad.TypeMeta, ad.ObjectMeta = crdMeta("BGPAdvertisement", fmt.Sprintf("%s-%d", name, i+1))
+			if len(a.Communities) > 0 {
+				ad.Spec.Communities = communityStrings(a.Communities)
+			}
+			if a.CIDR != nil {
+				// As in the config file, aggregation lengths are
+				// only given for the selected families.
+				hasV4, hasV6 := false, false
+				for _, n := range a.CIDR {
+					ad.Spec.CIDRs = append(ad.Spec.CIDRs, n.String())
+					if n.IP.To4() != nil {
+						hasV4 = true
+					} else {
+						hasV6 = true
+					}
+				}
+				if !hasV4 {
+					ad.Spec.AggregationLength = 0
+				}
+				if !hasV6 {
+					ad.Spec.AggregationLengthV6 = 0
+				}
+			}
+			ret = append(ret, ad)
+		}
+	}
+
+	return ret, nil
+}
+
+// checkCRDCompatible returns an error for the first setting of c that
+// changes MetalLB's behavior, but that the custom resources can't
+// express.
+func (c *Config) checkCRDCompatible() error {
+	unsupported := func(what string) error {
+		return fmt.Errorf("%s has no custom resource equivalent", what)
+	}
+	switch {
+	case len(c.ExcludeAddresses) > 0:
+		return unsupported("exclude-addresses")
+	case c.GracefulShutdownTime != 0:
+		return unsupported("graceful-shutdown-time")
+	case c.ReloadMinInterval != 0:
+		return unsupported("reload-min-interval")
+	case c.BGPListenPort != 0 && c.BGPListenPort != 179:
+		return unsupported("bgp-listen-port")
+	case c.Dampening != nil:
+		return unsupported("dampening")
+	case c.Confederation != nil:
+		return unsupported("confederation")
+	case len(c.Rules) > 0:
+		return unsupported("rules")
+	case c.SpeakerNodeSelector != nil:
+		return unsupported("speaker-node-selector")
+	}
+
+	for i, p := range c.Peers {
+		if !p.Enabled {
+			continue
+		}
+		what := ""
+		switch {
+		case p.MaxPrefixes.Limit != 0:
+			what = "max-prefixes"
+		case p.VRF != "":
+			what = "vrf"
+		case p.OriginateDefault:
+			what = "originate-default"
+		case p.Disable4ByteASN:
+			what = "disable-4byte-asn"
+		case !p.RouteRefresh:
+			what = "route-refresh"
+		case len(p.Communities) > 0:
+			what = "communities"
+		case len(p.StripCommunities) > 0:
+			what = "strip-communities"
+		case p.GracefulRestart != nil:
+			what = "graceful-restart"
+		case len(p.Capabilities) > 0:
+			what = "capabilities"
+		case p.AddPaths != "":
+			what = "add-paths"
+		}
+		if what != "" {
+			return unsupported(fmt.Sprintf("%s of peer #%d", what, i+1))
+		}
+	}
+
+	for _, name := range c.PoolNames() {
+		p := c.Pools[name]
+		what := ""
+		switch {
+		case p.AvoidBuggyIPs && (p.IncludeNetwork || p.IncludeBroadcast):
+			what = "include-network or include-broadcast"
+		case len(p.PinnedAddresses) > 0:
+			what = "pinned-addresses"
+		case p.AllocationStrategy != "" && p.AllocationStrategy != AllocateLowest:
+			what = "allocation-strategy"
+		case p.CIDROrder == CIDROrderListed:
+			what = "cidr-order"
+		case len(p.NodeSelectors) > 0:
+			what = "node-selectors"
+		case len(p.NodePriorities) > 0:
+			what = "node-priorities"
+		case p.InterfaceSelection != "" || len(p.Interfaces) > 0:
+			what = "interface settings"
+		case len(p.ServiceSelectors) > 0:
+			what = "service-selectors"
+		case p.Weight != 0:
+			what = "weight"
+		case p.AnnounceDelay != 0:
+			what = "announce-delay"
+		case p.ServiceClass != "":
+			what = "service-class"
+		}
+		if what != "" {
+			return unsupported(fmt.Sprintf("%s of pool %q", what, name))
+		}
+		for i, a := range p.Advertisements {
+			if !a.Enabled {
+				continue
+			}
+			switch {
+			case len(a.LargeCommunities) > 0:
+				what = "large-communities"
+			case a.Origin != "" && a.Origin != OriginIGP:
+				what = "origin"
+			case a.NextHop != nil || a.NextHopLinkLocal != nil:
+				what = "next-hop"
+			}
+			if what != "" {
+				return unsupported(fmt.Sprintf("%s of advertisement #%d of pool %q", what, i+1, name))
+			}
+		}
+	}
+	return nil
+}
+
+// FromCRDs converts custom resources back into a Config, with the same
+// defaults and validation as Parse. It is the reverse of ToCRDs, and
+// also accepts Community objects, whose aliases the advertisements
+// may use. Every BGPAdvertisement must refer to existing
+// IPAddressPools, and becomes an advertisement of each of them.
+func FromCRDs(objs []runtime.Object) (*Config, error) {
+	var (
+		peers       []interface{}
+		pools       []map[string]interface{}
+		poolsByName = map[string]map[string]interface{}{}
+		ads         []*BGPAdvertisement
+		communities = map[string]string{}
+	)
+	for _, obj := range objs {
+		switch o := obj.(type) {
+		case *BGPPeer:
+			peer := map[string]interface{}{
+				"name":         o.Name,
+				"my-asn":       o.Spec.MyASN,
+				"peer-asn":     o.Spec.ASN,
+				"peer-address": o.Spec.Address,
+			}
+			if o.Spec.Port != 0 {
+				peer["peer-port"] = o.Spec.Port
+			}
+			if o.Spec.HoldTime != nil {
+				peer["hold-time"] = o.Spec.HoldTime.Duration.String()
+			}
+			if o.Spec.KeepaliveTime != nil {
+				peer["keepalive-time"] = o.Spec.KeepaliveTime.Duration.String()
+			}
+			if o.Spec.ConnectRetryTime.Duration != 0 {
+				peer["connect-retry-time"] = o.Spec.ConnectRetryTime.Duration.String()
+			}
+			if o.Spec.MRAI != nil {
+				peer["min-route-advertisement-interval"] = o.Spec.MRAI.Duration.String()
+			}
+			if o.Spec.Passive {
+				peer["passive"] = true
+			}
+			if o.Spec.MinTTL != 0 {
+				peer["min-ttl"] = o.Spec.MinTTL
+			}
+			if o.Spec.PeerGroup != "" {
+				peer["peer-group"] = o.Spec.PeerGroup
+			}
+			peers = append(peers, peer)
+		case *IPAddressPool:
+			if poolsByName[o.Name] != nil {
+				return nil, fmt.Errorf("duplicate IPAddressPool %q", o.Name)
+			}
+			pool := map[string]interface{}{
+				"name":            o.Name,
+				"protocol":        o.Spec.Protocol,
+				"cidr":            o.Spec.Addresses,
+				"avoid-buggy-ips": o.Spec.AvoidBuggyIPs,
+			}
+			if o.Spec.AutoAssign != nil {
+				pool["auto-assign"] = *o.Spec.AutoAssign
+			}
+			if len(o.Spec.Protocols) > 0 {
+				pool["protocol"] = o.Spec.Protocols
+			}
+			if len(o.Spec.ReservedAddresses) > 0 {
+				pool["reserved-addresses"] = o.Spec.ReservedAddresses
+			}
+			pools = append(pools, pool)
+			poolsByName[o.Name] = pool
+		case *Community:
+			for _, c := range o.Spec.Communities {
+				if _, ok := communities[c.Name]; ok {
+					return nil, fmt.Errorf("duplicate definition of community alias %q in Community %q", c.Name, o.Name)
+				}
+				communities[c.Name] = c.Value
+			}
+		case *BGPAdvertisement:
+			ads = append(ads, o)
+		default:
+			return nil, fmt.Errorf("unsupported object of type %T", obj)
+		}
+	}
+
+	// Advertisements are attached once all the pools are known, so
+	// that the objects can come in any order.
+	for _, o := range ads {
+		if len(o.Spec.IPAddressPools) == 0 {
+			return nil, fmt.Errorf("BGPAdvertisement %q selects no IPAddressPools", o.Name)
+		}
+		ad := map[string]interface{}{}
+		if o.Spec.AggregationLength != 0 {
+			ad["aggregation-length"] = o.Spec.AggregationLength
+		}
+		if o.Spec.AggregationLengthV6 != 0 {
+			ad["aggregation-length-v6"] = o.Spec.AggregationLengthV6
+		}
+		if o.Spec.LocalPref != 0 {
+			ad["localpref"] = o.Spec.LocalPref
+		}
+		if len(o.Spec.Communities) > 0 {
+			ad["communities"] = o.Spec.Communities
+		}
+		if len(o.Spec.PeerGroups) > 0 {
+			ad["peer-groups"] = o.Spec.PeerGroups
+		}
+		if o.Spec.NoAdvertiseEBGP {
+			ad["no-advertise-ebgp"] = true
+		}
+		if len(o.Spec.CIDRs) > 0 {
+			ad["cidr"] = o.Spec.CIDRs
+		}
+		for _, name := range o.Spec.IPAddressPools {
+			pool := poolsByName[name]
+			if pool == nil {
+				return nil, fmt.Errorf("BGPAdvertisement %q refers to unknown IPAddressPool %q", o.Name, name)
+			}
+			poolAds, _ := pool["advertisements"].([]interface{})
+			pool["advertisements"] = append(poolAds, ad)
+		}
+	}
+
+	raw := map[string]interface{}{}
+	if len(peers) > 0 {
+		raw["peers"] = peers
+	}
+	if len(pools) > 0 {
+		raw["address-pools"] = pools
+	}
+	if len(communities) > 0 {
+		raw["communities"] = communities
+	}
+	// JSON is a subset of YAML, so Parse can read it directly.
+	bs, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(bs)
+}
@@ -0,0 +1,464 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// timeComparer compares the optional timestamps in ObjectMeta, whose
+// own Equal method doesn't cope with nil.
+var timeComparer = cmp.Comparer(func(a, b *metav1.Time) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Time.Equal(b.Time)
+})
+
+func crdObjectMeta(name string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{Namespace: CRDNamespace, Name: name}
+}
+
+func crdTypeMeta(kind string) metav1.TypeMeta {
+	return metav1.TypeMeta{APIVersion: CRDAPIVersion, Kind: kind}
+}
+
+// allFeaturesCRDs returns the custom resources for allFeaturesConfig.
+func allFeaturesCRDs() []runtime.Object {
+	yes := true
+	return []runtime.Object{
+		&BGPPeer{
+			TypeMeta:   crdTypeMeta("BGPPeer"),
+			ObjectMeta: crdObjectMeta("peer-1"),
+			Spec: BGPPeerSpec{
+				MyASN:            42,
+				ASN:              142,
+				Address:          "1.2.3.4",
+				Port:             1179,
+				HoldTime:         &metav1.Duration{Duration: 180 * time.Second},
+				KeepaliveTime:    &metav1.Duration{Duration: 60 * time.Second},
+				ConnectRetryTime: metav1.Duration{Duration: 5 * time.Second},
+				MRAI:             &metav1.Duration{Duration: 30 * time.Second},
+			},
+		},
+		&BGPPeer{
+			TypeMeta:   crdTypeMeta("BGPPeer"),
+			ObjectMeta: crdObjectMeta("peer-2"),
+			Spec: BGPPeerSpec{
+				MyASN:            100,
+				ASN:              200,
+				Address:          "2.3.4.5",
+				Port:             179,
+				HoldTime:         &metav1.Duration{Duration: 90 * time.Second},
+				KeepaliveTime:    &metav1.Duration{Duration: 30 * time.Second},
+				ConnectRetryTime: metav1.Duration{Duration: 2 * time.Second},
+				MRAI:             &metav1.Duration{Duration: 30 * time.Second},
+			},
+		},
+		&Community{
+			TypeMeta:   crdTypeMeta("Community"),
+			ObjectMeta: crdObjectMeta("communities"),
+			Spec: CommunitySpec{
+				Communities: []CommunityAlias{{Name: "bar", Value: "64512:1234"}},
+			},
+		},
+		&IPAddressPool{
+			TypeMeta:   crdTypeMeta("IPAddressPool"),
+			ObjectMeta: crdObjectMeta("pool1"),
+			Spec: IPAddressPoolSpec{
+				Addresses:     []string{"10.20.0.0/16", "10.50.0.0/24"},
+				Protocol:      BGP,
+				AutoAssign:    &yes,
+				AvoidBuggyIPs: true,
+			},
+		},
+		&BGPAdvertisement{
+			TypeMeta:   crdTypeMeta("BGPAdvertisement"),
+			ObjectMeta: crdObjectMeta("pool1-1"),
+			Spec: BGPAdvertisementSpec{
+				IPAddressPools:      []string{"pool1"},
+				AggregationLength:   32,
+				AggregationLengthV6: 128,
+				LocalPref:           100,
+				Communities:         []string{"1234:2345", "64512:1234"},
+			},
+		},
+		&BGPAdvertisement{
+			TypeMeta:   crdTypeMeta("BGPAdvertisement"),
+			ObjectMeta: crdObjectMeta("pool1-2"),
+			Spec: BGPAdvertisementSpec{
+				IPAddressPools:      []string{"pool1"},
+				AggregationLength:   24,
+				AggregationLengthV6: 128,
+			},
+		},
+		&IPAddressPool{
+			TypeMeta:   crdTypeMeta("IPAddressPool"),
+			ObjectMeta: crdObjectMeta("pool2"),
+			Spec: IPAddressPoolSpec{
+				Addresses:  []string{"30.0.0.0/8"},
+				Protocol:   BGP,
+				AutoAssign: &yes,
+			},
+		},
+	}
+}
+
+func TestToCRDs(t *testing.T) {
+	cfg, err := Parse([]byte(allFeaturesConfig))
+	if err != nil {
+		t.Fatalf("parse failed: %s", err)
+	}
+	got, err := cfg.ToCRDs()
+	if err != nil {
+		t.Fatalf("ToCRDs failed: %s", err)
+	}
+	if diff := cmp.Diff(allFeaturesCRDs(), got, timeComparer); diff != "" {
+		t.Errorf("wrong CRDs (-want +got)\n%s", diff)
+	}
+}
+
+func TestToCRDsInvalidName(t *testing.T) {
+	cfg, err := Parse([]byte(`
+address-pools:
+- name: Pool_1
+  cidr:
+  - 10.20.0.0/24
+`))
+	if err != nil {
+		t.Fatalf("parse failed: %s", err)
+	}
+	if _, err := cfg.ToCRDs(); err == nil {
+		t.Errorf("ToCRDs accepted pool name that isn't a valid object name")
+	}
+}
+
+func TestToCRDsOptions(t *testing.T) {
+	cfg, err := Parse([]byte(`
+peers:
+- my-asn: 42
+  peer-asn: 142
+  peer-address: 1.2.3.4
+  min-route-advertisement-interval: 0s
+  min-ttl: 254
+address-pools:
+- name: pool1
+  protocol: bgp
+  cidr:
+  - 10.20.0.0/24
+  - 10.30.0.0/24
+  - 2001:db8::/64
+  reserved-addresses:
+  - 10.20.0.1/32
+  advertisements:
+  - aggregation-length: 24
+    no-advertise-ebgp: true
+    cidr:
+    - 10.30.0.0/24
+  - enabled: false
+  - aggregation-length-v6: 64
+    cidr:
+    - 2001:db8::/64
+`))
+	if err != nil {
+		t.Fatalf("parse failed: %s", err)
+	}
+	got, err := cfg.ToCRDs()
+	if err != nil {
+		t.Fatalf("ToCRDs failed: %s", err)
+	}
+	yes := true
+	want := []runtime.Object{
+		&BGPPeer{
+			TypeMeta:   crdTypeMeta("BGPPeer"),
+			ObjectMeta: crdObjectMeta("peer-1"),
+			Spec: BGPPeerSpec{
+				MyASN:            42,
+				ASN:              142,
+				Address:          "1.2.3.4",
+				Port:             179,
+				HoldTime:         &metav1.Duration{Duration: 90 * time.Second},
+				KeepaliveTime:    &metav1.Duration{Duration: 30 * time.Second},
+				ConnectRetryTime: metav1.Duration{Duration: 2 * time.Second},
+				MRAI:             &metav1.Duration{},
+				MinTTL:           254,
+			},
+		},
+		&IPAddressPool{
+			TypeMeta:   crdTypeMeta("IPAddressPool"),
+			ObjectMeta: crdObjectMeta("pool1"),
+			Spec: IPAddressPoolSpec{
+				Addresses:         []string{"10.20.0.0/24", "10.30.0.0/24", "2001:db8::/64"},
+				Protocol:          BGP,
+				AutoAssign:        &yes,
+				ReservedAddresses: []string{"10.20.0.1/32"},
+			},
+		},
+		&BGPAdvertisement{
+			TypeMeta:   crdTypeMeta("BGPAdvertisement"),
+			ObjectMeta: crdObjectMeta("pool1-1"),
+			Spec: BGPAdvertisementSpec{
+				IPAddressPools:    []string{"pool1"},
+				AggregationLength: 24,
+				NoAdvertiseEBGP:   true,
+				CIDRs:             []string{"10.30.0.0/24"},
+			},
+		},
+		&BGPAdvertisement{
+			TypeMeta:   crdTypeMeta("BGPAdvertisement"),
+			ObjectMeta: crdObjectMeta("pool1-3"),
+			Spec: BGPAdvertisementSpec{
+				IPAddressPools:      []string{"pool1"},
+				AggregationLengthV6: 64,
+				CIDRs:               []string{"2001:db8::/64"},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, got, timeComparer); diff != "" {
+		t.Errorf("wrong CRDs (-want +got)\n%s", diff)
+	}
+
+	back, err := FromCRDs(got)
+	if err != nil {
+		t.Fatalf("FromCRDs failed: %s", err)
+	}
+	cfg.Peers[0].Name = ""
+	back.Peers[0].Name = ""
+	cfg.Pools["pool1"].Advertisements = []*Advertisement{cfg.Pools["pool1"].Advertisements[0], cfg.Pools["pool1"].Advertisements[2]}
+	if diff := cmp.Diff(cfg, back, selectorComparer); diff != "" {
+		t.Errorf("config changed in round trip (-want +got)\n%s", diff)
+	}
+}
+
+func TestToCRDsUnsupported(t *testing.T) {
+	tests := []struct {
+		desc string
+		raw  string
+	}{
+		{
+			desc: "exclude-addresses",
+			raw: `
+exclude-addresses:
+- 10.20.0.5/32
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+`,
+		},
+		{
+			desc: "peer vrf",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 142
+  peer-address: 1.2.3.4
+  vrf: red
+`,
+		},
+		{
+			desc: "pool weight",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  weight: 3
+`,
+		},
+		{
+			desc: "advertisement origin",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  cidr:
+  - 10.20.0.0/24
+  advertisements:
+  - origin: incomplete
+`,
+		},
+	}
+
+	for _, test := range tests {
+		cfg, err := Parse([]byte(test.raw))
+		if err != nil {
+			t.Errorf("%q: parse failed: %s", test.desc, err)
+			continue
+		}
+		if _, err := cfg.ToCRDs(); err == nil {
+			t.Errorf("%q: ToCRDs accepted a setting it can't represent", test.desc)
+		}
+	}
+}
+
+func TestFromCRDsRoundTrip(t *testing.T) {
+	cfg, err := FromCRDs(allFeaturesCRDs())
+	if err != nil {
+		t.Fatalf("FromCRDs failed: %s", err)
+	}
+	want, err := Parse([]byte(allFeaturesConfig))
+	if err != nil {
+		t.Fatalf("parse failed: %s", err)
+	}
+	// ToCRDs names the peers, the original config doesn't.
+	for _, p := range want.Peers {
+		p.Name = ""
+	}
+	for _, p := range cfg.Peers {
+		p.Name = ""
+	}
+	if diff := cmp.Diff(want, cfg, selectorComparer); diff != "" {
+		t.Errorf("wrong config (-want +got)\n%s", diff)
+	}
+
+	got, err := cfg.ToCRDs()
+	if err != nil {
+		t.Fatalf("ToCRDs failed: %s", err)
+	}
+	if diff := cmp.Diff(allFeaturesCRDs(), got, timeComparer); diff != "" {
+		t.Errorf("CRDs changed in round trip (-want +got)\n%s", diff)
+	}
+}
+
+func TestFromCRDs(t *testing.T) {
+	pool := func(name string) *IPAddressPool {
+		return &IPAddressPool{
+			TypeMeta:   crdTypeMeta("IPAddressPool"),
+			ObjectMeta: crdObjectMeta(name),
+			Spec: IPAddressPoolSpec{
+				Addresses: []string{"10.20.0.0/24"},
+				Protocol:  BGP,
+			},
+		}
+	}
+	ad := func(name string, spec BGPAdvertisementSpec) *BGPAdvertisement {
+		return &BGPAdvertisement{
+			TypeMeta:   crdTypeMeta("BGPAdvertisement"),
+			ObjectMeta: crdObjectMeta(name),
+			Spec:       spec,
+		}
+	}
+	aliases := &Community{
+		TypeMeta:   crdTypeMeta("Community"),
+		ObjectMeta: crdObjectMeta("aliases"),
+		Spec: CommunitySpec{
+			Communities: []CommunityAlias{{Name: "bar", Value: "64512:1234"}},
+		},
+	}
+
+	tests := []struct {
+		desc string
+		objs []runtime.Object
+		want map[uint32]bool
+	}{
+		{
+			desc: "community alias, advertisement before its pool",
+			objs: []runtime.Object{
+				ad("ad", BGPAdvertisementSpec{IPAddressPools: []string{"pool1"}, Communities: []string{"bar"}}),
+				aliases,
+				pool("pool1"),
+			},
+			want: map[uint32]bool{0xfc0004d2: true},
+		},
+		{
+			desc: "unknown pool",
+			objs: []runtime.Object{
+				pool("pool1"),
+				ad("ad", BGPAdvertisementSpec{IPAddressPools: []string{"pool2"}}),
+			},
+		},
+		{
+			desc: "advertisement without pools",
+			objs: []runtime.Object{
+				pool("pool1"),
+				ad("ad", BGPAdvertisementSpec{}),
+			},
+		},
+		{
+			desc: "duplicate pool",
+			objs: []runtime.Object{pool("pool1"), pool("pool1")},
+		},
+		{
+			desc: "duplicate community alias",
+			objs: []runtime.Object{aliases, aliases},
+		},
+		{
+			desc: "unsupported object",
+			objs: []runtime.Object{&metav1.Status{}},
+		},
+	}
+
+	for _, test := range tests {
+		cfg, err := FromCRDs(test.objs)
+		if err != nil {
+			if test.want != nil {
+				t.Errorf("%q: FromCRDs failed: %s", test.desc, err)
+			}
+			continue
+		}
+		if test.want == nil {
+			t.Errorf("%q: FromCRDs unexpectedly succeeded", test.desc)
+			continue
+		}
+		got := cfg.Pools["pool1"].Advertisements[0].Communities
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("%q: wrong communities (-want +got)\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestFromCRDsPeerTimers(t *testing.T) {
+	peer := func(holdTime, keepaliveTime *metav1.Duration) []runtime.Object {
+		return []runtime.Object{&BGPPeer{
+			TypeMeta:   crdTypeMeta("BGPPeer"),
+			ObjectMeta: crdObjectMeta("peer"),
+			Spec: BGPPeerSpec{
+				MyASN:         42,
+				ASN:           142,
+				Address:       "1.2.3.4",
+				HoldTime:      holdTime,
+				KeepaliveTime: keepaliveTime,
+			},
+		}}
+	}
+
+	tests := []struct {
+		desc          string
+		objs          []runtime.Object
+		holdTime      time.Duration
+		keepaliveTime time.Duration
+	}{
+		{
+			desc:          "unset",
+			objs:          peer(nil, nil),
+			holdTime:      90 * time.Second,
+			keepaliveTime: 30 * time.Second,
+		},
+		{
+			desc: "zero",
+			objs: peer(&metav1.Duration{}, &metav1.Duration{}),
+		},
+		{
+			desc:          "set",
+			objs:          peer(&metav1.Duration{Duration: 9 * time.Second}, &metav1.Duration{Duration: time.Second}),
+			holdTime:      9 * time.Second,
+			keepaliveTime: time.Second,
+		},
+	}
+
+	for _, test := range tests {
+		cfg, err := FromCRDs(test.objs)
+		if err != nil {
+			t.Errorf("%q: FromCRDs failed: %s", test.desc, err)
+			continue
+		}
+		p := cfg.Peers[0]
+		if p.HoldTime != test.holdTime || p.KeepaliveTime != test.keepaliveTime {
+			t.Errorf("%q: got hold time %s and keepalive time %s, want %s and %s", test.desc, p.HoldTime, p.KeepaliveTime, test.holdTime, test.keepaliveTime)
+		}
+	}
+}
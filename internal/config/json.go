@@ -0,0 +1,402 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// MarshalJSON encodes c in the same schema as the YAML configuration
+// file, with communities, CIDRs and durations as strings. Defaults
+// that Parse merged into c (global timers, pool communities...) are
+// written out explicitly, so the result doesn't depend on them.
+// Warnings are not encoded, UnmarshalJSON recomputes them.
+func (c *Config) MarshalJSON() ([]byte, error) {
+	ret := map[string]interface{}{
+		"bgp-listen-port": c.BGPListenPort,
+	}
+
+	var peers []interface{}
+	for _, p := range c.Peers {
+		peers = append(peers, peerJSON(p))
+	}
+	if len(peers) > 0 {
+		ret["peers"] = peers
+	}
+
+	var pools []interface{}
+	for _, name := range c.PoolNames() {
+		pools = append(pools, poolJSON(name, c.Pools[name]))
+	}
+	if len(pools) > 0 {
+		ret["address-pools"] = pools
+	}
+
+	if len(c.ExcludeAddresses) > 0 {
+		var excl []string
+		for _, n := range c.ExcludeAddresses {
+			excl = append(excl, n.String())
+		}
+		ret["exclude-addresses"] = excl
+	}
+	if c.GracefulShutdownTime != 0 {
+		ret["graceful-shutdown-time"] = c.GracefulShutdownTime.String()
+	}
+	if c.ReloadMinInterval != 0 {
+		ret["reload-min-interval"] = c.ReloadMinInterval.String()
+	}
+	var rules []interface{}
+	for _, r := range c.Rules {
+		rule := map[string]interface{}{
+			"pool":      r.Pool,
+			"condition": r.Condition.String(),
+			"action":    r.Action,
+		}
+		if r.PeerGroup != "" {
+			rule["peer-group"] = r.PeerGroup
+		}
+		rules = append(rules, rule)
+	}
+	if len(rules) > 0 {
+		ret["rules"] = rules
+	}
+	if c.SpeakerNodeSelector != nil {
+		ret["speaker-node-selector"] = c.SpeakerNodeSelector.String()
+	}
+	if len(c.CommunityAliases) > 0 {
+		aliases := map[string]string{}
+		for name, v := range c.CommunityAliases {
+			aliases[name] = communityString(v)
+		}
+		ret["communities"] = aliases
+	}
+	if cf := c.Confederation; cf != nil {
+		ret["confederation"] = map[string]interface{}{
+			"confed-id": cf.ID,
+			"members":   cf.Members,
+		}
+	}
+	if d := c.Dampening; d != nil {
+		ret["dampening"] = map[string]interface{}{
+			"suppress-threshold": d.SuppressThreshold,
+			"reuse-threshold":    d.ReuseThreshold,
+			"half-life":          d.HalfLife.String(),
+			"max-suppress-time":  d.MaxSuppressTime.String(),
+		}
+	}
+
+	return json.Marshal(ret)
+}
+
+// UnmarshalJSON decodes a Config encoded by MarshalJSON, or any other
+// JSON rendering of the configuration file. It applies the same
+// defaults and validation as Parse.
+func (c *Config) UnmarshalJSON(bs []byte) error {
+	// JSON is a subset of YAML, so Parse can read it directly.
+	cfg, err := Parse(bs)
+	if err != nil {
+		return err
+	}
+	*c = *cfg
+	return nil
+}
+
+func peerJSON(p *Peer) map[string]interface{} {
+	addr := p.AddrHostname
+	if p.Addr != nil {
+		addr = p.Addr.String()
+		if p.Zone != "" {
+			addr += "%" + p.Zone
+		}
+	}
+	// Timers are always written, as a missing timer means "use the
+	// default" rather than zero.
+	ret := map[string]interface{}{
+		"my-asn":                           p.MyASN,
+		"peer-asn":                         p.ASN,
+		"peer-address":                     addr,
+		"peer-port":                        p.Port,
+		"hold-time":                        p.HoldTime.String(),
+		"keepalive-time":                   p.KeepaliveTime.String(),
+		"connect-retry-time":               p.ConnectRetryTime.String(),
+		"min-route-advertisement-interval": p.MRAI.String(),
+	}
+	if p.Name != "" {
+		ret["name"] = p.Name
+	}
+	if p.Passive {
+		ret["passive"] = true
+	}
+	if p.MinTTL != 0 {
+		ret["min-ttl"] = p.MinTTL
+	}
+	if p.MaxPrefixes.Limit != 0 {
+		ret["max-prefixes"] = p.MaxPrefixes.Limit
+		ret["max-prefixes-action"] = p.MaxPrefixes.Action
+	}
+	if p.VRF != "" {
+		ret["vrf"] = p.VRF
+	}
+	if p.PeerGroup != "" {
+		ret["peer-group"] = p.PeerGroup
+	}
+	if p.OriginateDefault {
+		ret["originate-default"] = true
+	}
+	if p.Disable4ByteASN {
+		ret["disable-4byte-asn"] = true
+	}
+	if !p.RouteRefresh {
+		ret["route-refresh"] = false
+	}
+	if !p.Enabled {
+		ret["enabled"] = false
+	}
+	if p.Communities != nil {
+		ret["communities"] = communityStrings(p.Communities)
+	}
+	if p.StripCommunities != nil {
+		ret["strip-communities"] = communityStrings(p.StripCommunities)
+	}
+	if p.Capabilities != nil {
+		caps := []string{}
+		for c := range p.Capabilities {
+			caps = append(caps, string(c))
+		}
+		sort.Strings(caps)
+		ret["capabilities"] = caps
+	}
+	if p.AddPaths != "" {
+		ret["add-paths"] = p.AddPaths
+	}
+	if gr := p.GracefulRestart; gr != nil {
+		ret["graceful-restart"] = map[string]interface{}{
+			"enabled":    true,
+			"stale-time": gr.StaleTime.String(),
+		}
+	}
+	return ret
+}
+
+func poolJSON(name string, p *Pool) map[string]interface{} {
+	ret := map[string]interface{}{
+		"name":            name,
+		"protocol":        p.Protocol,
+		"avoid-buggy-ips": p.AvoidBuggyIPs,
+		"auto-assign":     p.AutoAssign,
+	}
+	var cidrs []string
+	for _, n := range p.CIDR {
+		cidrs = append(cidrs, n.String())
+	}
+	if len(cidrs) > 0 {
+		ret["cidr"] = cidrs
+	}
+	if p.Protocols != nil {
+		ret["protocol"] = p.Protocols
+	}
+	if p.System {
+		ret["system"] = true
+	}
+	if p.IncludeNetwork {
+		ret["include-network"] = true
+	}
+	if p.IncludeBroadcast {
+		ret["include-broadcast"] = true
+	}
+	var reserved []string
+	for _, n := range p.Reserved {
+		reserved = append(reserved, n.String())
+	}
+	if len(reserved) > 0 {
+		ret["reserved-addresses"] = reserved
+	}
+	var pins []interface{}
+	for _, pin := range p.PinnedAddresses {
+		pins = append(pins, map[string]interface{}{
+			"address": pin.IP.String(),
+			"service": pin.Service,
+		})
+	}
+	if len(pins) > 0 {
+		ret["pinned-addresses"] = pins
+	}
+	if p.AllocationStrategy != "" {
+		ret["allocation-strategy"] = p.AllocationStrategy
+	}
+	if p.CIDROrder != "" {
+		ret["cidr-order"] = p.CIDROrder
+	}
+	var sels []string
+	for _, sel := range p.NodeSelectors {
+		sels = append(sels, sel.String())
+	}
+	if len(sels) > 0 {
+		ret["node-selectors"] = sels
+	}
+	var prios []interface{}
+	for _, np := range p.NodePriorities {
+		prios = append(prios, map[string]interface{}{
+			"node-selector": np.Selector.String(),
+			"priority":      np.Priority,
+		})
+	}
+	if len(prios) > 0 {
+		ret["node-priorities"] = prios
+	}
+	if p.InterfaceSelection != "" {
+		ret["interface-selection"] = p.InterfaceSelection
+	}
+	if len(p.Interfaces) > 0 {
+		ret["interfaces"] = p.Interfaces
+	}
+	var svcSels []string
+	for _, sel := range p.ServiceSelectors {
+		svcSels = append(svcSels, sel.String())
+	}
+	if len(svcSels) > 0 {
+		ret["service-selectors"] = svcSels
+	}
+	if p.Weight != 0 {
+		ret["weight"] = p.Weight
+	}
+	if p.AnnounceDelay != 0 {
+		ret["announce-delay"] = p.AnnounceDelay.String()
+	}
+	if p.ServiceClass != "" {
+		ret["service-class"] = p.ServiceClass
+	}
+	if p.IPFamily != "" {
+		ret["ip-family"] = p.IPFamily
+	}
+	if p.TagCommunityASN != 0 {
+		ret["tag-community-asn"] = p.TagCommunityASN
+	}
+	if p.AllowedAggregationLengths != nil {
+		ret["allowed-aggregation-lengths"] = p.AllowedAggregationLengths
+	}
+	if p.AllowedCommunities != nil {
+		ret["allowed-communities"] = communityStrings(p.AllowedCommunities)
+	}
+
+	var ads []interface{}
+	for _, ad := range p.Advertisements {
+		ads = append(ads, advertisementJSON(ad))
+	}
+	if len(ads) > 0 {
+		ret["advertisements"] = ads
+	}
+	return ret
+}
+
+func advertisementJSON(a *Advertisement) map[string]interface{} {
+	// Pool and default communities are already merged into
+	// a.Communities, so they are written out per advertisement.
+	ret := map[string]interface{}{
+		"aggregation-length":    a.AggregationLength,
+		"aggregation-length-v6": a.AggregationLengthV6,
+		"origin":                a.Origin,
+		"enabled":               a.Enabled,
+	}
+	// Parse rejects aggregation lengths for families that the
+	// selected CIDRs don't have, but still fills in their defaults.
+	if a.CIDR != nil {
+		hasV4, hasV6 := false, false
+		for _, n := range a.CIDR {
+			if n.IP.To4() != nil {
+				hasV4 = true
+			} else {
+				hasV6 = true
+			}
+		}
+		if !hasV4 {
+			delete(ret, "aggregation-length")
+		}
+		if !hasV6 {
+			delete(ret, "aggregation-length-v6")
+		}
+	}
+	if a.LocalPref != 0 {
+		ret["localpref"] = a.LocalPref
+	}
+	// An empty list must still be written out, a missing one would
+	// bring back the pool's communities.
+	if a.Communities != nil {
+		ret["communities"] = communityStrings(a.Communities)
+	}
+	if len(a.LargeCommunities) > 0 {
+		var large []string
+		for c := range a.LargeCommunities {
+			large = append(large, fmt.Sprintf("%d:%d:%d", c.GlobalAdmin, c.LocalData1, c.LocalData2))
+		}
+		sort.Strings(large)
+		ret["large-communities"] = large
+	}
+	if a.RemoveCommunities != nil {
+		ret["remove-communities"] = communityStrings(a.RemoveCommunities)
+	}
+	if a.Blackhole {
+		ret["blackhole"] = true
+	}
+	if a.LocalOnly {
+		ret["local-only"] = true
+	}
+	if a.Type != "" {
+		ret["advertisement-type"] = a.Type
+	}
+	if len(a.PeerGroups) > 0 {
+		ret["peer-groups"] = a.PeerGroups
+	}
+	if a.NoAdvertiseEBGP {
+		ret["no-advertise-ebgp"] = true
+	}
+	if a.CIDR != nil {
+		cidrs := []string{}
+		for _, n := range a.CIDR {
+			cidrs = append(cidrs, n.String())
+		}
+		ret["cidr"] = cidrs
+	}
+	if a.NextHop != nil {
+		ret["next-hop"] = a.NextHop.String()
+	}
+	if a.NextHopLinkLocal != nil {
+		ret["next-hop-link-local"] = a.NextHopLinkLocal.String()
+	}
+	return ret
+}
+
+// communityStrings returns the communities in m in the two-part
+// <asn>:<community number> form, in ascending numeric order.
+func communityStrings(m map[uint32]bool) []string {
+	var cs []uint32
+	for c := range m {
+		cs = append(cs, c)
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i] < cs[j] })
+	ret := []string{}
+	for _, c := range cs {
+		ret = append(ret, communityString(c))
+	}
+	return ret
+}
+
+// communityString returns c in the two-part <asn>:<community number>
+// form.
+func communityString(c uint32) string {
+	return fmt.Sprintf("%d:%d", c>>16, c&0xffff)
+}
@@ -0,0 +1,153 @@
+package config
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	tests := []struct {
+		desc string
+		raw  string
+	}{
+		{
+			desc: "config using all features",
+			raw:  allFeaturesConfig,
+		},
+
+		{
+			desc: "newer features",
+			raw: `
+hold-time: 0s
+default-communities: ["no-export"]
+exclude-addresses:
+- 10.20.0.1
+graceful-shutdown-time: 30s
+reload-min-interval: 5s
+localpref: 150
+bgp-listen-port: 1179
+speaker-node-selector: bgp in (true),!edge
+dampening:
+  half-life: 10m
+confederation:
+  confed-id: 100
+  members: [42, 43]
+rules:
+- pool: pool1
+  peer-group: tor
+  condition: service-count >= 2
+  action: advertise
+peers:
+- name: tor-1
+  my-asn: 42
+  peer-asn: 42
+  peer-address: fe80::1%eth0
+  passive: true
+  min-ttl: 254
+  max-prefixes: 100
+  vrf: red
+  peer-group: tor
+  disable-4byte-asn: true
+  route-refresh: false
+  enabled: false
+  capabilities: ["extended-nexthop"]
+  add-paths: send
+  graceful-restart:
+    enabled: true
+    stale-time: 120s
+  communities: ["64512:7"]
+  min-route-advertisement-interval: 1s
+  strip-communities: ["64512:100", "no-export"]
+- my-asn: 42
+  peer-asn: 43
+  peer-address: router.example.com
+address-pools:
+- name: pool1
+  protocol: [bgp, layer2]
+  cidr:
+  - 2001:db8::/64
+  - 10.20.0.0/24
+  ip-family: dual
+  avoid-buggy-ips: true
+  include-network: true
+  reserved-addresses:
+  - 10.20.0.128/25
+  pinned-addresses:
+  - address: 10.20.0.53
+    service: kube-system/dns
+  allocation-strategy: random
+  cidr-order: listed
+  weight: 3
+  announce-delay: 500ms
+  service-class: premium
+  auto-assign: false
+  system: true
+  allowed-communities: ["64512:5"]
+  allowed-aggregation-lengths: [24, 32, 64, 128]
+  tag-community-asn: 64512
+  advertisements:
+  - aggregate: true
+    aggregation-length: 24
+    aggregation-length-v6: 64
+    large-communities: ["4200000000:1:2"]
+    remove-communities: ["no-export"]
+    peer-groups: ["tor"]
+    no-advertise-ebgp: true
+    origin: egp
+    next-hop: 2001:db8:1::1
+    next-hop-link-local: fe80::1
+  - blackhole: true
+    cidr: ["10.20.0.0/25"]
+    local-only: true
+    enabled: false
+- name: pool2
+  protocol: layer2
+  cidr:
+  - 30.0.0.0/8
+  node-selectors:
+  - role=edge
+  service-selectors:
+  - tier=frontend
+  node-priorities:
+  - node-selector: rack=r1
+    priority: 10
+  interface-selection: explicit
+  interfaces: ["eth0", "bond0"]
+`,
+		},
+
+		{
+			desc: "advertisement clearing the tag community",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  cidr:
+  - 10.20.0.0/24
+  tag-community-asn: 65000
+  advertisements:
+  - communities: []
+`,
+		},
+	}
+
+	for _, test := range tests {
+		want, err := Parse([]byte(test.raw))
+		if err != nil {
+			t.Fatalf("%q: parse failed: %s", test.desc, err)
+		}
+		bs, err := json.Marshal(want)
+		if err != nil {
+			t.Fatalf("%q: marshal failed: %s", test.desc, err)
+		}
+		got := &Config{}
+		if err := json.Unmarshal(bs, got); err != nil {
+			t.Fatalf("%q: unmarshal of %s failed: %s", test.desc, bs, err)
+		}
+		if diff := cmp.Diff(want, got, selectorComparer); diff != "" {
+			t.Errorf("%q: config changed in JSON round trip (-want +got)\n%s\nJSON: %s", test.desc, diff, bs)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Severity is how serious a Diagnostic is.
+type Severity string
+
+// Diagnostic severities.
+const (
+	// The config would be rejected by Parse.
+	SeverityError Severity = "error"
+	// The config loads, but probably doesn't do what was intended.
+	SeverityWarning Severity = "warning"
+	// Harmless, but worth tidying up.
+	SeverityInfo Severity = "info"
+)
+
+// Diagnostic is one problem found by Lint.
+type Diagnostic struct {
+	Severity Severity
+	// Where the problem is, e.g. "line 3", "peers[0]" or
+	// "address-pools[2]". Empty for problems of the config as a
+	// whole.
+	Location string
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	if d.Location == "" {
+		return fmt.Sprintf("%s: %s", d.Severity, d.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", d.Severity, d.Location, d.Message)
+}
+
+var lintLineRe = regexp.MustCompile(`^could not parse config: (line \d+): (.*)$`)
+
+// Lint checks the configuration in bs, and returns all the problems
+// it finds. Unlike Parse, which stops at the first error, Lint checks
+// the global settings, each peer and each pool separately, so that
+// one error doesn't hide the others.
+func Lint(bs []byte) []Diagnostic {
+	opts := ParseOptions{AllowWellKnownShadowing: true}
+
+	var raw configFile
+	if err := yaml.Unmarshal(bs, &raw); err != nil {
+		_, err := ParseWithOptions(bs, opts)
+		return []Diagnostic{errorDiagnostic("", err)}
+	}
+	ret := unusedAliases(&raw)
+
+	cfg, err := ParseWithOptions(bs, opts)
+	if err == nil {
+		var diags []Diagnostic
+		for _, w := range cfg.Warnings {
+			diags = append(diags, Diagnostic{Severity: SeverityWarning, Message: w})
+		}
+		return append(diags, ret...)
+	}
+
+	// Something is wrong. Split the config into the global settings
+	// and one document per peer and pool, each with the globals, and
+	// check them separately.
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(bs, &doc); err != nil {
+		return append([]Diagnostic{errorDiagnostic("", err)}, ret...)
+	}
+	var (
+		globals yaml.MapSlice
+		peers   []interface{}
+		pools   []interface{}
+	)
+	for _, item := range doc {
+		switch item.Key {
+		case "peers":
+			peers, _ = item.Value.([]interface{})
+		case "address-pools":
+			pools, _ = item.Value.([]interface{})
+		case "rules":
+			// Rules refer to pools and peer groups, so they can
+			// only be checked as part of the whole config.
+		case "exclude-addresses":
+			// Likewise for references to pools.
+			excl, _ := item.Value.([]interface{})
+			var cidrs []interface{}
+			for _, e := range excl {
+				if s, ok := e.(string); !ok || !strings.HasPrefix(s, "pool:") {
+					cidrs = append(cidrs, e)
+				}
+			}
+			globals = append(globals, yaml.MapItem{Key: item.Key, Value: cidrs})
+		default:
+			globals = append(globals, item)
+		}
+	}
+
+	var diags []Diagnostic
+	seen := map[string]bool{}
+	check := func(loc string, part yaml.MapSlice) bool {
+		bs, err := yaml.Marshal(part)
+		if err != nil {
+			diags = append(diags, errorDiagnostic(loc, err))
+			return false
+		}
+		cfg, err := ParseWithOptions(bs, opts)
+		if err != nil {
+			diags = append(diags, errorDiagnostic(loc, err))
+			return false
+		}
+		for _, w := range cfg.Warnings {
+			if !seen[w] {
+				seen[w] = true
+				diags = append(diags, Diagnostic{Severity: SeverityWarning, Location: loc, Message: w})
+			}
+		}
+		return true
+	}
+
+	if !check("", globals) {
+		// Every peer and pool would repeat the same error.
+		return append(diags, ret...)
+	}
+	partsOK := true
+	var goodPeers []interface{}
+	for i, p := range peers {
+		part := append(yaml.MapSlice{{Key: "peers", Value: []interface{}{p}}}, globals...)
+		if check(fmt.Sprintf("peers[%d]", i), part) {
+			goodPeers = append(goodPeers, p)
+		} else {
+			partsOK = false
+		}
+	}
+	// Pools can refer to the peers (e.g. by peer group), so they are
+	// checked along with the peers that are fine on their own.
+	for i, p := range pools {
+		part := append(yaml.MapSlice{{Key: "address-pools", Value: []interface{}{p}}}, globals...)
+		if len(goodPeers) > 0 {
+			part = append(part, yaml.MapItem{Key: "peers", Value: goodPeers})
+		}
+		partsOK = check(fmt.Sprintf("address-pools[%d]", i), part) && partsOK
+	}
+	if partsOK {
+		// The problem is between peers and pools (e.g. overlapping
+		// CIDRs) or in the rules, and only shows up in the whole
+		// config.
+		diags = append(diags, errorDiagnostic("", err))
+	}
+	return append(diags, ret...)
+}
+
+// errorDiagnostic converts a Parse error into a Diagnostic, moving
+// any line number into the location.
+func errorDiagnostic(loc string, err error) Diagnostic {
+	msg := err.Error()
+	if m := lintLineRe.FindStringSubmatch(msg); m != nil && loc == "" {
+		loc, msg = m[1], m[2]
+	}
+	return Diagnostic{Severity: SeverityError, Location: loc, Message: msg}
+}
+
+// unusedAliases returns an info Diagnostic for each community alias
+// in raw that nothing refers to.
+func unusedAliases(raw *configFile) []Diagnostic {
+	used := map[string]bool{}
+	use := func(cs []string) {
+		for _, c := range cs {
+			used[c] = true
+		}
+	}
+	use(raw.DefaultCommunities)
+	// An alias can be defined in terms of another one.
+	for _, v := range raw.Communities {
+		use([]string{v})
+	}
+	for _, p := range raw.Peers {
+		use(p.Communities)
+		use(p.StripCommunities)
+	}
+	for _, p := range raw.Pools {
+		use(p.Communities)
+		use(p.AllowedCommunities)
+		for _, ad := range p.Advertisements {
+			use(ad.Communities)
+			use(ad.RemoveCommunities)
+		}
+	}
+
+	var names []string
+	for name := range raw.Communities {
+		if !used[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var ret []Diagnostic
+	for _, name := range names {
+		ret = append(ret, Diagnostic{
+			Severity: SeverityInfo,
+			Location: "communities",
+			Message:  fmt.Sprintf("community alias %q is never used", name),
+		})
+	}
+	return ret
+}
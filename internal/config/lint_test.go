@@ -0,0 +1,130 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		desc string
+		raw  string
+		want []Diagnostic
+	}{
+		{
+			desc: "valid config",
+			raw:  allFeaturesConfig,
+		},
+
+		{
+			desc: "syntax error",
+			raw: `
+peers:
+- my-asn: 42
+ peer-asn: 42
+`,
+			want: []Diagnostic{
+				{SeverityError, "line 4", "did not find expected key"},
+			},
+		},
+
+		{
+			desc: "several problems",
+			raw: `
+communities:
+  site: 64512:7
+  unused: 64512:8
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  hold-time: 1s
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.5
+  min-ttl: 300
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.6
+  peer-group: tor
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+  advertisements:
+  - communities: ["site"]
+    peer-groups: ["tor"]
+- name: pool2
+  protocol: layer2
+  cidr:
+  - 10.30.0.0/33
+- name: pool3
+  cidr:
+  - 10.20.0.10-10.20.0.5
+`,
+			want: []Diagnostic{
+				{SeverityError, "peers[0]", `invalid hold time "1s" for peer #1: must be 0 or >=3s`},
+				{SeverityError, "peers[1]", `invalid min-ttl 300 for peer "1.2.3.5": must be between 0 and 255`},
+				{SeverityError, "address-pools[1]", `invalid CIDR "10.30.0.0/33" in pool "pool2"`},
+				{SeverityError, "address-pools[2]", `invalid range "10.20.0.10-10.20.0.5" in pool "pool3": start address is after end address`},
+				{SeverityInfo, "communities", `community alias "unused" is never used`},
+			},
+		},
+
+		{
+			desc: "alias used by another alias",
+			raw: `
+communities:
+  base: 64512:7
+  derived: base
+address-pools:
+- name: pool1
+  protocol: bgp
+  cidr:
+  - 10.20.0.0/24
+  advertisements:
+  - communities: ["derived"]
+`,
+		},
+
+		{
+			desc: "pool reference in exclude-addresses",
+			raw: `
+exclude-addresses:
+- pool:missing
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  hold-time: 1s
+`,
+			want: []Diagnostic{
+				{SeverityError, "peers[0]", `invalid hold time "1s" for peer #1: must be 0 or >=3s`},
+			},
+		},
+
+		{
+			desc: "conflict between pools",
+			raw: `
+address-pools:
+- name: pool1
+  cidr:
+  - 10.20.0.0/24
+- name: pool2
+  cidr:
+  - 10.20.0.0/16
+`,
+			want: []Diagnostic{
+				{SeverityError, "", `CIDR "10.20.0.0/16" in pool "pool2" overlaps with already defined CIDR "10.20.0.0/24"`},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		got := Lint([]byte(test.raw))
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("%q: wrong diagnostics (-want +got)\n%s", test.desc, diff)
+		}
+	}
+}
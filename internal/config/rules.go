@@ -0,0 +1,132 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Rule conditionally changes how a pool is advertised, e.g.
+// "advertise pool1 to peer group tor only if service-count > 3".
+// Rules are parsed and validated, but not yet evaluated, so they
+// don't change how anything is advertised.
+type Rule struct {
+	// The pool the rule applies to.
+	Pool string
+	// The peer group the rule applies to. Empty means all peers.
+	PeerGroup string
+	Condition Condition
+	Action    RuleAction
+}
+
+// Condition is a comparison between a metric of the pool and a
+// constant, e.g. "service-count > 3".
+type Condition struct {
+	Metric RuleMetric
+	Op     RuleOp
+	Value  int
+}
+
+func (c Condition) String() string {
+	return fmt.Sprintf("%s %s %d", c.Metric, c.Op, c.Value)
+}
+
+// RuleMetric is a pool metric that a Condition tests.
+type RuleMetric string
+
+// Supported rule metrics.
+const (
+	// Number of services with an address from the pool.
+	MetricServiceCount RuleMetric = "service-count"
+	// Number of services with an address from the pool that have at
+	// least one ready endpoint.
+	MetricReadyServiceCount RuleMetric = "ready-service-count"
+)
+
+// RuleOp is the comparison of a Condition.
+type RuleOp string
+
+// Supported comparisons.
+const (
+	OpLess         RuleOp = "<"
+	OpLessEqual    RuleOp = "<="
+	OpEqual        RuleOp = "=="
+	OpNotEqual     RuleOp = "!="
+	OpGreaterEqual RuleOp = ">="
+	OpGreater      RuleOp = ">"
+)
+
+// RuleAction is what a Rule does to the pool's routes while its
+// Condition holds.
+type RuleAction string
+
+// Supported rule actions.
+const (
+	// Advertise the pool's routes only while the condition holds.
+	ActionAdvertise RuleAction = "advertise"
+	// Withdraw the pool's routes while the condition holds.
+	ActionWithdraw RuleAction = "withdraw"
+)
+
+// parseCondition parses a condition of the form
+// "<metric> <op> <value>".
+func parseCondition(s string) (Condition, error) {
+	fs := strings.Fields(s)
+	if len(fs) != 3 {
+		return Condition{}, errors.New(`must be of the form "<metric> <op> <value>"`)
+	}
+	v, err := strconv.Atoi(fs[2])
+	if err != nil {
+		return Condition{}, fmt.Errorf("invalid value %q: %s", fs[2], err)
+	}
+	return Condition{
+		Metric: RuleMetric(fs[0]),
+		Op:     RuleOp(fs[1]),
+		Value:  v,
+	}, nil
+}
+
+// validate checks that r uses known keywords, and refers to things
+// that exist in c. peerGroups is the set of peer groups with peers.
+func (r *Rule) validate(c *Config, peerGroups map[string]bool) error {
+	if c.Pools[r.Pool] == nil {
+		return fmt.Errorf("unknown pool %q", r.Pool)
+	}
+	if r.PeerGroup != "" && !peerGroups[r.PeerGroup] {
+		return fmt.Errorf("peer group %q has no peers", r.PeerGroup)
+	}
+	switch r.Condition.Metric {
+	case MetricServiceCount, MetricReadyServiceCount:
+	default:
+		return fmt.Errorf("unknown metric %q in condition", r.Condition.Metric)
+	}
+	switch r.Condition.Op {
+	case OpLess, OpLessEqual, OpEqual, OpNotEqual, OpGreaterEqual, OpGreater:
+	default:
+		return fmt.Errorf("unknown comparison %q in condition", r.Condition.Op)
+	}
+	if r.Condition.Value < 0 {
+		return fmt.Errorf("invalid value %d in condition: must not be negative", r.Condition.Value)
+	}
+	switch r.Action {
+	case ActionAdvertise, ActionWithdraw:
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseCondition(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Condition
+		wantErr bool
+	}{
+		{
+			in:   "service-count > 3",
+			want: Condition{Metric: MetricServiceCount, Op: OpGreater, Value: 3},
+		},
+		{
+			in:   "  ready-service-count   <=  0 ",
+			want: Condition{Metric: MetricReadyServiceCount, Op: OpLessEqual, Value: 0},
+		},
+		{
+			in:      "service-count>3",
+			wantErr: true,
+		},
+		{
+			in:      "service-count > three",
+			wantErr: true,
+		},
+		{
+			in:      "",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := parseCondition(test.in)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseCondition(%q) unexpectedly succeeded", test.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCondition(%q) failed: %s", test.in, err)
+			continue
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("parseCondition(%q) (-want +got)\n%s", test.in, diff)
+		}
+	}
+}
@@ -4,11 +4,13 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.universe.tf/metallb/internal/config"
 	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
@@ -51,6 +53,11 @@ type Client struct {
 	epInformer  cache.Controller
 	cmIndexer   cache.Indexer
 	cmInformer  cache.Controller
+
+	// When the config was last applied, and the reload-min-interval
+	// it asked for.
+	configLoadTime    time.Time
+	reloadMinInterval time.Duration
 }
 
 type svcKey string
@@ -204,6 +211,21 @@ func (c *Client) UpdateStatus(svc *v1.Service) error {
 	return err
 }
 
+// NodeLabels returns the labels of the named Node.
+func (c *Client) NodeLabels(name string) (map[string]string, error) {
+	node, err := c.client.CoreV1().Nodes().Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return node.Labels, nil
+}
+
+// RequeueAfter schedules another SetBalancer call for the named
+// service after d.
+func (c *Client) RequeueAfter(name string, d time.Duration) {
+	c.queue.AddAfter(svcKey(name), d)
+}
+
 // Infof logs an informational event about svc to the Kubernetes cluster.
 func (c *Client) Infof(svc *v1.Service, kind, msg string, args ...interface{}) {
 	c.events.Eventf(svc, v1.EventTypeNormal, kind, msg, args...)
@@ -242,6 +264,13 @@ func (c *Client) sync(key interface{}) error {
 		return c.controller.SetBalancer(string(k), svc.(*v1.Service), eps)
 
 	case cmKey:
+		if wait := c.reloadMinInterval - time.Since(c.configLoadTime); wait > 0 {
+			// The queue holds at most one copy of the key, so a
+			// burst of edits collapses into a single reload of the
+			// latest version.
+			c.queue.AddAfter(key, wait)
+			return nil
+		}
 		cmi, exists, err := c.cmIndexer.GetByKey(string(k))
 		if err != nil {
 			return fmt.Errorf("get configmap %q: %s", k, err)
@@ -257,6 +286,10 @@ func (c *Client) sync(key interface{}) error {
 			c.events.Eventf(cm, v1.EventTypeWarning, "InvalidConfig", "%s", err)
 			return nil
 		}
+		for _, w := range cfg.Warnings {
+			glog.Warningf("config warning: %s", w)
+			c.events.Eventf(cm, v1.EventTypeWarning, "ConfigWarning", "%s", w)
+		}
 
 		if err := c.controller.SetConfig(cfg); err != nil {
 			configStale.Set(1)
@@ -266,6 +299,8 @@ func (c *Client) sync(key interface{}) error {
 
 		configLoaded.Set(1)
 		configStale.Set(0)
+		c.configLoadTime = time.Now()
+		c.reloadMinInterval = cfg.ReloadMinInterval
 
 		glog.Infof("config changed, reconverging all services")
 		for _, k := range c.svcIndexer.ListKeys() {